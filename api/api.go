@@ -0,0 +1,680 @@
+package api
+
+import (
+	"../config"
+	"../datatypes"
+	"../elevio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Channels ...
+// Channels used for communication between the control API and other modules
+type Channels struct {
+	DestinationAnnouncementChan chan elevio.DestinationAnnouncement
+	RecallChan                  chan bool
+	AllNodeStatesChan           chan datatypes.AllNodeStatesMap
+	ETAsChan                    chan datatypes.HallETAsMatrix
+	ModuleHealthChan            chan datatypes.ModuleHealthMap
+	ReassignmentsChan           chan datatypes.ReassignmentsMatrix
+}
+
+// Requests are rejected if the receiving module hasn't accepted them within this time
+const requestTimeout = 1 * time.Second
+
+// destinationJSON ...
+// Format of a destination order, and of the announcement of which car to board
+type destinationJSON struct {
+	Origin      int    `json:"origin"`
+	Destination int    `json:"destination"`
+	Car         string `json:"car,omitempty"`
+}
+
+// status ...
+// The state of the node as seen by the API, shared between the HTTP handlers
+// and the Server goroutine
+type status struct {
+	mtx           sync.Mutex
+	announcements map[[2]int]string
+	recallActive  bool
+	nodeStates    datatypes.AllNodeStatesMap
+	etas          datatypes.HallETAsMatrix
+	alarms        map[datatypes.NodeID]alarm
+	modules       datatypes.ModuleHealthMap
+	reassignments datatypes.ReassignmentsMatrix
+}
+
+// alarm ...
+// A fault reported by a node, and when it was first reported
+// (Alarms are kept until the node reports that it is healthy, also if the node is lost)
+type alarm struct {
+	Fault  datatypes.FaultType
+	Raised time.Time
+}
+
+// recallJSON ...
+// Format of the fire recall status
+type recallJSON struct {
+	Active bool `json:"active"`
+}
+
+// Names of the node behaviours, modes, faults, traffic modes and module states shown by the API
+var behaviourNames = map[datatypes.NodeBehaviour]string{
+	datatypes.InitState:     "init",
+	datatypes.IdleState:     "idle",
+	datatypes.DoorOpenState: "doorOpen",
+	datatypes.MovingState:   "moving",
+	datatypes.ParkingState:  "parking",
+	datatypes.RecallState:   "recall",
+}
+var modeNames = map[datatypes.NodeMode]string{
+	datatypes.NormalMode:       "normal",
+	datatypes.OutOfServiceMode: "outofservice",
+	datatypes.IndependentMode:  "independent",
+}
+var faultNames = map[datatypes.FaultType]string{
+	datatypes.NoFault:                  "none",
+	datatypes.MotorStallFault:          "motorstall",
+	datatypes.StuckSensorFault:         "stucksensor",
+	datatypes.WrongDirectionFault:      "wrongdirection",
+	datatypes.SkippedFloorFault:        "skippedfloor",
+	datatypes.ArrivedWhileStoppedFault: "arrivedwhilestopped",
+	datatypes.RepeatedTimeoutFault:     "repeatedtimeouts",
+	datatypes.HardwareLostFault:        "hardwarelost",
+}
+var trafficNames = map[datatypes.TrafficMode]string{
+	datatypes.NormalTraffic:   config.TrafficNormal,
+	datatypes.UpPeakTraffic:   config.TrafficUpPeak,
+	datatypes.DownPeakTraffic: config.TrafficDownPeak,
+}
+var moduleStatusNames = map[datatypes.ModuleStatus]string{
+	datatypes.ModuleRunning:    "running",
+	datatypes.ModuleStalled:    "stalled",
+	datatypes.ModuleRestarting: "restarting",
+	datatypes.ModuleStopped:    "stopped",
+}
+
+// modeJSON ...
+// Format of a change of the mode of the node
+type modeJSON struct {
+	Mode string `json:"mode"`
+}
+
+// nodeJSON ...
+// Format of the state of a single node, as shown on the dashboard
+type nodeJSON struct {
+	ID        string  `json:"id"`
+	Behaviour string  `json:"behaviour"`
+	Floor     int     `json:"floor"`
+	Direction string  `json:"direction"`
+	Mode      string  `json:"mode"`
+	Traffic   string  `json:"traffic"`
+	Load      float64 `json:"load"`
+	Fault     string  `json:"fault"`
+}
+
+// alarmJSON ...
+// Format of an alarm raised by a fault on a node
+type alarmJSON struct {
+	ID     string `json:"id"`
+	Fault  string `json:"fault"`
+	Raised string `json:"raised"`
+}
+
+// moduleJSON ...
+// Format of the health of a single module of the node
+type moduleJSON struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	Since     string `json:"since"`
+	Restarts  int    `json:"restarts"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+// cancelJSON ...
+// Format of the cancellation of an order. A hall order is given by its direction
+// ("up" or "down"), while a cab order of the node has no direction.
+type cancelJSON struct {
+	Floor     int    `json:"floor"`
+	Direction string `json:"direction,omitempty"`
+}
+
+// etaJSON ...
+// Format of the estimated time of arrival of the car assigned to a hall order
+type etaJSON struct {
+	Floor     int     `json:"floor"`
+	Direction string  `json:"direction"`
+	Car       string  `json:"car"`
+	ETA       float64 `json:"eta"`
+}
+
+// reassignmentsJSON ...
+// Format of the number of times a confirmed hall order has been moved to another node
+type reassignmentsJSON struct {
+	Floor         int    `json:"floor"`
+	Direction     string `json:"direction"`
+	Reassignments int    `json:"reassignments"`
+}
+
+// writeJSON ...
+// Writes v as the JSON response body
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// destinationHandler ...
+// POST registers a destination order, as entered on a lobby keypad.
+// GET lists which car to board for every destination order currently assigned.
+func destinationHandler(
+	currStatus *status,
+	NewDestinationOrderChan chan<- elevio.DestinationEvent) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+
+		case http.MethodGet:
+			currStatus.mtx.Lock()
+			announcements := []destinationJSON{}
+			for key, car := range currStatus.announcements {
+				announcements = append(announcements, destinationJSON{
+					Origin:      key[0],
+					Destination: key[1],
+					Car:         car,
+				})
+			}
+			currStatus.mtx.Unlock()
+			writeJSON(w, announcements)
+
+		case http.MethodPost:
+			var order destinationJSON
+			if err := json.NewDecoder(r.Body).Decode(&order); err != nil {
+				http.Error(w, "invalid destination order: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if order.Origin < 0 || order.Origin >= elevio.NumFloors ||
+				order.Destination < 0 || order.Destination >= elevio.NumFloors ||
+				order.Origin == order.Destination {
+				http.Error(w, fmt.Sprintf("origin and destination must be different floors between 0 and %d",
+					elevio.NumFloors-1), http.StatusBadRequest)
+				return
+			}
+
+			select {
+			case NewDestinationOrderChan <- elevio.DestinationEvent{Origin: order.Origin, Destination: order.Destination}:
+				w.WriteHeader(http.StatusAccepted)
+			case <-time.After(requestTimeout):
+				http.Error(w, "node busy", http.StatusServiceUnavailable)
+			}
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// recallHandler ...
+// POST activates (active = true) or resets (active = false) the group-wide fire recall.
+// GET shows whether the fire recall is active.
+func recallHandler(
+	currStatus *status,
+	RecallCommandChan chan<- bool,
+	active bool) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+
+		case http.MethodGet:
+			currStatus.mtx.Lock()
+			currRecall := recallJSON{Active: currStatus.recallActive}
+			currStatus.mtx.Unlock()
+			writeJSON(w, currRecall)
+
+		case http.MethodPost:
+			select {
+			case RecallCommandChan <- active:
+				w.WriteHeader(http.StatusAccepted)
+			case <-time.After(requestTimeout):
+				http.Error(w, "node busy", http.StatusServiceUnavailable)
+			}
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// modeHandler ...
+// POST changes the mode of the node, e.g. taking it out of service for maintenance.
+func modeHandler(ModeChan chan<- datatypes.NodeMode) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var request modeJSON
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "invalid mode: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		for mode, name := range modeNames {
+			if name != request.Mode {
+				continue
+			}
+
+			select {
+			case ModeChan <- mode:
+				w.WriteHeader(http.StatusAccepted)
+			case <-time.After(requestTimeout):
+				http.Error(w, "node busy", http.StatusServiceUnavailable)
+			}
+			return
+		}
+
+		http.Error(w, fmt.Sprintf("unknown mode %q", request.Mode), http.StatusBadRequest)
+	}
+}
+
+// cancelHandler ...
+// POST cancels a cab order of the node, or a hall order if allowed by cancelHallOrders.
+func cancelHandler(
+	CancelCabOrderChan chan<- int,
+	CancelHallOrderChan chan<- elevio.ButtonEvent,
+	cancelHallOrders bool) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var request cancelJSON
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "invalid cancellation: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if request.Floor < 0 || request.Floor >= elevio.NumFloors {
+			http.Error(w, fmt.Sprintf("floor must be between 0 and %d", elevio.NumFloors-1),
+				http.StatusBadRequest)
+			return
+		}
+
+		var sent bool
+		switch request.Direction {
+
+		case "":
+			select {
+			case CancelCabOrderChan <- request.Floor:
+				sent = true
+			case <-time.After(requestTimeout):
+			}
+
+		case "up", "down":
+			if !cancelHallOrders {
+				http.Error(w, "cancelling hall orders is disabled", http.StatusForbidden)
+				return
+			}
+
+			button := elevio.BT_HallUp
+			if request.Direction == "down" {
+				button = elevio.BT_HallDown
+			}
+
+			select {
+			case CancelHallOrderChan <- elevio.ButtonEvent{Floor: request.Floor, Button: button}:
+				sent = true
+			case <-time.After(requestTimeout):
+			}
+
+		default:
+			http.Error(w, fmt.Sprintf("unknown direction %q", request.Direction), http.StatusBadRequest)
+			return
+		}
+
+		if !sent {
+			http.Error(w, "node busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// nodesHandler ...
+// GET lists the states of all nodes on the network, sorted by ID.
+func nodesHandler(currStatus *status) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		currStatus.mtx.Lock()
+		nodes := []nodeJSON{}
+		for currID, currState := range currStatus.nodeStates {
+			direction := "up"
+			if currState.Dir == datatypes.Down {
+				direction = "down"
+			}
+
+			nodes = append(nodes, nodeJSON{
+				ID:        string(currID),
+				Behaviour: behaviourNames[currState.Behaviour],
+				Floor:     currState.Floor,
+				Direction: direction,
+				Mode:      modeNames[currState.Mode],
+				Traffic:   trafficNames[currState.Traffic],
+				Load:      currState.Load,
+				Fault:     faultNames[currState.Fault],
+			})
+		}
+		currStatus.mtx.Unlock()
+
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+		writeJSON(w, nodes)
+	}
+}
+
+// alarmsHandler ...
+// GET lists the alarms raised by faults on the nodes, sorted by ID.
+func alarmsHandler(currStatus *status) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		currStatus.mtx.Lock()
+		alarms := []alarmJSON{}
+		for currID, currAlarm := range currStatus.alarms {
+			alarms = append(alarms, alarmJSON{
+				ID:     string(currID),
+				Fault:  faultNames[currAlarm.Fault],
+				Raised: currAlarm.Raised.Format(time.RFC3339),
+			})
+		}
+		currStatus.mtx.Unlock()
+
+		sort.Slice(alarms, func(i, j int) bool { return alarms[i].ID < alarms[j].ID })
+		writeJSON(w, alarms)
+	}
+}
+
+// healthHandler ...
+// GET lists the health of the modules of the node, sorted by name.
+// Responds with 503 if any module is stalled or not running, for use by a health check.
+func healthHandler(currStatus *status) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		healthy := true
+		currStatus.mtx.Lock()
+		modules := []moduleJSON{}
+		for name, currHealth := range currStatus.modules {
+			modules = append(modules, moduleJSON{
+				Name:      name,
+				Status:    moduleStatusNames[currHealth.Status],
+				Since:     currHealth.Since.Format(time.RFC3339),
+				Restarts:  currHealth.Restarts,
+				LastError: currHealth.LastError,
+			})
+			if currHealth.Status != datatypes.ModuleRunning {
+				healthy = false
+			}
+		}
+		currStatus.mtx.Unlock()
+
+		sort.Slice(modules, func(i, j int) bool { return modules[i].Name < modules[j].Name })
+		if !healthy {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		writeJSON(w, modules)
+	}
+}
+
+// updateAlarms ...
+// Raises an alarm for every node reporting a new fault, and clears the alarms of the
+// nodes reporting that they are healthy.
+func updateAlarms(alarms map[datatypes.NodeID]alarm, nodeStates datatypes.AllNodeStatesMap) {
+	for currID, currState := range nodeStates {
+		currAlarm, raised := alarms[currID]
+
+		if currState.Fault == datatypes.NoFault {
+			if raised {
+				fmt.Println("(api) Alarm cleared:", currID, faultNames[currAlarm.Fault])
+				delete(alarms, currID)
+			}
+			continue
+		}
+
+		if !raised || currAlarm.Fault != currState.Fault {
+			fmt.Println("(api) Alarm raised:", currID, faultNames[currState.Fault])
+			alarms[currID] = alarm{
+				Fault:  currState.Fault,
+				Raised: time.Now(),
+			}
+		}
+	}
+}
+
+// etaHandler ...
+// GET lists the car assigned to every confirmed hall order, and the estimated number
+// of seconds until it arrives.
+func etaHandler(currStatus *status) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		currStatus.mtx.Lock()
+		etas := []etaJSON{}
+		for floor := range currStatus.etas {
+			for orderType, currETA := range currStatus.etas[floor] {
+				if currETA.Car == "" {
+					continue
+				}
+
+				direction := "up"
+				if elevio.ButtonType(orderType) == elevio.BT_HallDown {
+					direction = "down"
+				}
+
+				remaining := time.Until(currETA.Arrival)
+				if remaining < 0 {
+					remaining = 0
+				}
+
+				etas = append(etas, etaJSON{
+					Floor:     floor,
+					Direction: direction,
+					Car:       string(currETA.Car),
+					ETA:       remaining.Round(100 * time.Millisecond).Seconds(),
+				})
+			}
+		}
+		currStatus.mtx.Unlock()
+
+		writeJSON(w, etas)
+	}
+}
+
+// reassignmentsHandler ...
+// GET lists how many times every confirmed hall order has been moved to another node.
+func reassignmentsHandler(currStatus *status) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		currStatus.mtx.Lock()
+		reassignments := []reassignmentsJSON{}
+		for floor := range currStatus.reassignments {
+			for orderType, count := range currStatus.reassignments[floor] {
+				if count == 0 {
+					continue
+				}
+
+				direction := "up"
+				if elevio.ButtonType(orderType) == elevio.BT_HallDown {
+					direction = "down"
+				}
+
+				reassignments = append(reassignments, reassignmentsJSON{
+					Floor:         floor,
+					Direction:     direction,
+					Reassignments: count,
+				})
+			}
+		}
+		currStatus.mtx.Unlock()
+
+		writeJSON(w, reassignments)
+	}
+}
+
+// Time allowed for the requests being served to finish when the server is shut down
+const shutdownTimeout = 1 * time.Second
+
+// Server ...
+// Serves the control API of the node over HTTP on addr (the API is disabled if addr is empty),
+// and keeps the status shown by the API updated.
+//
+//	POST /destination  {"origin": 0, "destination": 3}  Registers a destination order
+//	GET  /destination                                   Lists which car to board for each destination order
+//	POST /recall                                        Activates the fire recall of all elevators
+//	POST /recall/reset                                  Resets the fire recall
+//	GET  /recall                                        Shows whether the fire recall is active
+//	POST /mode         {"mode": "outofservice"}          Changes the mode of the node ("normal", "outofservice" or "independent")
+//	GET  /nodes                                         Lists the states of all nodes
+//	POST /cancel       {"floor": 2, "direction": "up"}  Cancels a hall order, or a cab order if no direction is given
+//	GET  /eta                                           Lists the estimated time of arrival at each hall order
+//	GET  /reassignments                                 Lists how many times each hall order has been reassigned
+//	GET  /alarms                                        Lists the alarms raised by faults on the nodes
+//	GET  /health                                        Lists the health of the modules of the node (503 if unhealthy)
+//
+// The server is shut down when ctx is cancelled.
+// @return: The error the server failed with, ctx.Err() if it was shut down
+func Server(
+	ctx context.Context,
+	heartbeat <-chan struct{},
+	addr string,
+	localID datatypes.NodeID,
+	NewDestinationOrderChan chan<- elevio.DestinationEvent,
+	DestinationAnnouncementChan <-chan elevio.DestinationAnnouncement,
+	RecallCommandChan chan<- bool,
+	RecallChan <-chan bool,
+	ModeChan chan<- datatypes.NodeMode,
+	AllNodeStatesChan <-chan datatypes.AllNodeStatesMap,
+	ETAsChan <-chan datatypes.HallETAsMatrix,
+	CancelCabOrderChan chan<- int,
+	CancelHallOrderChan chan<- elevio.ButtonEvent,
+	cancelHallOrders bool,
+	ModuleHealthChan <-chan datatypes.ModuleHealthMap,
+	ReassignmentsChan <-chan datatypes.ReassignmentsMatrix) error {
+
+	currStatus := &status{
+		announcements: make(map[[2]int]string),
+		nodeStates:    make(datatypes.AllNodeStatesMap),
+		alarms:        make(map[datatypes.NodeID]alarm),
+		modules:       make(datatypes.ModuleHealthMap),
+	}
+
+	var server *http.Server
+	serveErr := make(chan error, 1)
+	if addr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/destination", destinationHandler(currStatus, NewDestinationOrderChan))
+		mux.HandleFunc("/recall", recallHandler(currStatus, RecallCommandChan, true))
+		mux.HandleFunc("/recall/reset", recallHandler(currStatus, RecallCommandChan, false))
+		mux.HandleFunc("/mode", modeHandler(ModeChan))
+		mux.HandleFunc("/nodes", nodesHandler(currStatus))
+		mux.HandleFunc("/eta", etaHandler(currStatus))
+		mux.HandleFunc("/reassignments", reassignmentsHandler(currStatus))
+		mux.HandleFunc("/alarms", alarmsHandler(currStatus))
+		mux.HandleFunc("/cancel", cancelHandler(CancelCabOrderChan, CancelHallOrderChan, cancelHallOrders))
+		mux.HandleFunc("/health", healthHandler(currStatus))
+
+		server = &http.Server{Addr: addr, Handler: mux}
+		go func() {
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				serveErr <- err
+			}
+		}()
+
+		fmt.Println("(api) Initialized, serving", localID, "on", addr)
+	}
+
+	// Keep the status updated
+	// (Also when the API is disabled, so that the other modules are never blocked)
+	for {
+		select {
+		case a := <-DestinationAnnouncementChan:
+			currStatus.mtx.Lock()
+			if a.Car == "" {
+				delete(currStatus.announcements, [2]int{a.Origin, a.Destination})
+			} else {
+				currStatus.announcements[[2]int{a.Origin, a.Destination}] = a.Car
+			}
+			currStatus.mtx.Unlock()
+
+		case a := <-RecallChan:
+			currStatus.mtx.Lock()
+			currStatus.recallActive = a
+			currStatus.mtx.Unlock()
+
+		case a := <-AllNodeStatesChan:
+			currStatus.mtx.Lock()
+			currStatus.nodeStates = a
+			updateAlarms(currStatus.alarms, a)
+			currStatus.mtx.Unlock()
+
+		case a := <-ETAsChan:
+			currStatus.mtx.Lock()
+			currStatus.etas = a
+			currStatus.mtx.Unlock()
+
+		case a := <-ReassignmentsChan:
+			currStatus.mtx.Lock()
+			currStatus.reassignments = a
+			currStatus.mtx.Unlock()
+
+		case a := <-ModuleHealthChan:
+			currStatus.mtx.Lock()
+			currStatus.modules = a
+			currStatus.mtx.Unlock()
+
+		case err := <-serveErr:
+			return fmt.Errorf("serving on %s: %v", addr, err)
+
+		case <-heartbeat:
+
+		// Let the requests being served finish before stopping
+		case <-ctx.Done():
+			if server != nil {
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+				server.Shutdown(shutdownCtx)
+				cancel()
+			}
+			fmt.Println("(api) Stopped")
+			return ctx.Err()
+		}
+	}
+}
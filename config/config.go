@@ -0,0 +1,770 @@
+package config
+
+import (
+	"../elevio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// Duration ...
+// A time.Duration written as a string in the config file, e.g. "3s" or "250ms"
+type Duration struct {
+	time.Duration
+}
+
+// MarshalJSON ...
+// Writes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON ...
+// Reads the duration from a string
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durations must be strings like \"3s\" or \"250ms\"")
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+// Timings ...
+// Timings of the elevator, used both by the FSM and by the order assignment.
+type Timings struct {
+	// Time the doors are kept open when a hall order is served at the floor
+	DoorOpenHall Duration
+
+	// Time the doors are kept open when only cab orders are served at the floor
+	DoorOpenCab Duration
+
+	// The elevator is regarded as obstructed if it hasn't arrived at a floor
+	// within this time after it started moving
+	MotorTimeout Duration
+
+	// Estimated time of travelling between two neighbouring floors
+	TravelTime Duration
+}
+
+// Clear request types, deciding which hall orders are served when stopping at a floor
+// (Named as the clear request types of the hall request assigner)
+const (
+	// ClearAll ...
+	// Serve the hall orders in both directions
+	ClearAll = "all"
+
+	// ClearInDirn ...
+	// Only serve the hall order in the direction the elevator departs in
+	ClearInDirn = "inDirn"
+)
+
+// Orders ...
+// Configuration of how orders are served.
+type Orders struct {
+	// Which hall orders are served when stopping at a floor (ClearAll or ClearInDirn)
+	ClearRequestType string
+
+	// An order is cancelled when its button is pressed twice within this time
+	// (0 disables cancelling by double press, the default)
+	CancelWindow Duration
+
+	// Let hall orders be cancelled as well, not only cab orders
+	CancelHallOrders bool
+}
+
+// Parking policies, deciding where idle elevators go
+const (
+	// ParkNone ...
+	// Idle elevators stay where they stopped
+	ParkNone = "none"
+
+	// ParkLobby ...
+	// Idle elevators return to the lobby
+	ParkLobby = "lobby"
+
+	// ParkZones ...
+	// Idle elevators are distributed evenly across the floors
+	ParkZones = "zones"
+
+	// ParkBusiest ...
+	// Idle elevators go to the floors with the most hall orders lately
+	ParkBusiest = "busiest"
+)
+
+// Parking ...
+// Configuration of where idle elevators are parked.
+type Parking struct {
+	// One of ParkNone, ParkLobby, ParkZones or ParkBusiest
+	Policy string
+
+	// Time an elevator has to be idle before it is parked
+	Delay Duration
+
+	// Floor used by ParkLobby
+	LobbyFloor int
+
+	// Hall orders older than this are not counted by ParkBusiest
+	History Duration
+}
+
+// Traffic modes, deciding how idle elevators are dispatched
+const (
+	// TrafficNormal ...
+	// Idle elevators are parked according to the parking policy
+	TrafficNormal = "normal"
+
+	// TrafficUpPeak ...
+	// Idle elevators return to the lobby immediately
+	TrafficUpPeak = "uppeak"
+
+	// TrafficDownPeak ...
+	// Idle elevators go to the top floor immediately, sweeping down from there
+	TrafficDownPeak = "downpeak"
+)
+
+// TimeOfDayLayout ...
+// Layout of the times of day in TrafficPeriod
+const TimeOfDayLayout = "15:04"
+
+// TrafficPeriod ...
+// A period of the day with a fixed traffic mode.
+type TrafficPeriod struct {
+	// Local time of day ("15:04") the period starts and ends
+	// (A period ending before it starts lasts over midnight)
+	Start string
+	End   string
+
+	// One of TrafficNormal, TrafficUpPeak or TrafficDownPeak
+	Mode string
+}
+
+// Traffic ...
+// Configuration of the traffic modes.
+type Traffic struct {
+	// Periods of the day with a fixed traffic mode
+	Schedule []TrafficPeriod
+
+	// Detect up-peak and down-peak traffic from the hall orders outside the
+	// scheduled periods
+	Detect bool
+
+	// Hall orders older than this are not counted by the detection
+	Window Duration
+
+	// Least number of hall orders within Window needed to detect a peak
+	MinOrders int
+
+	// Share of the hall orders within Window that must be up from the lobby (up-peak),
+	// or down from the other floors (down-peak), for a peak to be detected
+	PeakShare float64
+}
+
+// Recall ...
+// Configuration of the fire recall.
+type Recall struct {
+	// Floor all elevators return to during a fire recall
+	Floor int
+}
+
+// Sources of the load of the elevator
+const (
+	// LoadSimulated ...
+	// The load is estimated from the orders served at every stop
+	LoadSimulated = "simulated"
+
+	// LoadSensor ...
+	// The load is read from the load-weighing input of the elevator
+	LoadSensor = "sensor"
+)
+
+// CarLoad ...
+// Configuration of the load of the elevator.
+type CarLoad struct {
+	// One of LoadSimulated or LoadSensor
+	Source string
+
+	// Number of passengers the elevator can take
+	Capacity int
+
+	// Share of the capacity at which the elevator is full, and bypasses hall orders
+	// (Should be equal on all nodes)
+	FullThreshold float64
+
+	// Estimated number of passengers boarding for every hall order served (LoadSimulated)
+	PassengersPerHallOrder float64
+}
+
+// Nuisance ...
+// Configuration of the detection of nuisance cab orders (e.g. all cab buttons pressed).
+type Nuisance struct {
+	// Detect nuisance cab orders, and cancel them
+	Detect bool
+
+	// All cab orders are cancelled when more than this many cab orders are placed
+	// without the load changing
+	MaxCabOrders int
+
+	// All cab orders are cancelled after this many stops in a row at the floors of cab
+	// orders without any passenger transfer (a load change or the doors being reopened)
+	MaxEmptyStops int
+}
+
+// Faults ...
+// Configuration of the fault diagnosis of the elevator.
+type Faults struct {
+	// Motor timeouts are reported as repeated once this many have happened within TimeoutWindow
+	MaxTimeouts   int
+	TimeoutWindow Duration
+
+	// A fault is cleared when no new faults have been diagnosed within this time
+	ClearAfter Duration
+}
+
+// IO ...
+// Configuration of how the inputs of the elevator are read.
+type IO struct {
+	// Time between readings of the buttons, the stop button and the obstruction switch
+	PollRate Duration
+
+	// Time between readings of the floor sensor (at most PollRate)
+	FloorPollRate Duration
+
+	// Let the elevator server notify all changes of the inputs, only reading all inputs
+	// every PollRate (Not supported by the standard elevator server)
+	Notify bool
+}
+
+// Car ...
+// A car run by the node process, as a separate node.
+type Car struct {
+	// ID of the node running the car (the node is named "node_" + ID)
+	ID string
+
+	// Address of the elevator server (hardware or simulator) of the car, e.g. "localhost:15657"
+	Driver string
+
+	// Address of the HTTP control API of the node (empty: disabled)
+	API string
+}
+
+// Node ...
+// Configuration of the cars run by the process.
+type Node struct {
+	// Number of floors of the building
+	// (Fixed when building, must equal elevio.NumFloors)
+	Floors int
+
+	// The cars run by the process, each as a separate node
+	Cars []Car
+}
+
+// Ports ...
+// UDP ports used for broadcasting on the network (must be equal on all nodes)
+type Ports struct {
+	Peers             int
+	States            int
+	HallOrders        int
+	CabOrders         int
+	DestinationOrders int
+	Recall            int
+	ETAs              int
+	Handover          int
+}
+
+// Minority policies, deciding which orders are served in a minority partition
+const (
+	// MinorityCabOnly ...
+	// Only cab orders are served
+	MinorityCabOnly = "cabonly"
+
+	// MinorityAll ...
+	// Both hall and cab orders are served
+	MinorityAll = "all"
+)
+
+// Peers ...
+// Configuration of the heartbeats and of the failure detection of the peers.
+type Peers struct {
+	// Time between heartbeats
+	Interval Duration
+
+	// A peer is never lost before being silent for Timeout, and always lost after MaxTimeout
+	Timeout    Duration
+	MaxTimeout Duration
+
+	// Phi at which a silent peer is lost (0: only use the fixed Timeout)
+	PhiThreshold float64
+
+	// Phi and loss rate at which a peer is demoted from hall orders
+	SuspectPhi  float64
+	SuspectLoss float64
+
+	// Number of heartbeat inter-arrival times used to estimate the arrival distribution
+	WindowSize int
+}
+
+// Network ...
+// Configuration of the network and of the group of nodes.
+type Network struct {
+	Ports Ports
+
+	// Number of nodes in the group (0: use the peer history)
+	GroupSize int
+
+	// Nodes not seen for this long are removed from the peer history (0: never)
+	ForgetAfter Duration
+
+	// Orders served in a minority partition (MinorityCabOnly or MinorityAll)
+	MinorityPolicy string
+
+	// Node states not refreshed within this time are left out of the order assignment
+	StateTimeout Duration
+
+	Peers Peers
+}
+
+// Assignment ...
+// Configuration of the hall order assignment.
+type Assignment struct {
+	// Path to the hall request assigner binary
+	// (Searched for next to the executable and in the working directory if empty)
+	AssignerPath string
+
+	// Deadline for a single run of the hall request assigner
+	AssignerTimeout Duration
+
+	// Cost (in floors) of moving a committed hall order (0: disabled)
+	SwitchingCost int
+
+	// Freeze hall orders this many floors ahead of a node (-1: disabled)
+	FreezeDistance int
+}
+
+// Logging ...
+// Configuration of the log of the node.
+type Logging struct {
+	// File the log is appended to (empty: standard output)
+	File string
+}
+
+// Supervision ...
+// Configuration of the supervisor running the modules of the node.
+type Supervision struct {
+	// A module whose loop hasn't answered a heartbeat within this time is flagged as stalled
+	StallTimeout Duration
+
+	// Time to wait before restarting a module that has failed
+	RestartDelay Duration
+}
+
+// Features ...
+// Optional features of the node.
+type Features struct {
+	// Show the estimated times of arrival of the hall orders on the floor displays
+	ETADisplay bool
+}
+
+// Config ...
+// Configuration of a single node, read from a JSON config file.
+// Values not given in the file keep their default values.
+type Config struct {
+	Node        Node
+	Network     Network
+	Assignment  Assignment
+	Logging     Logging
+	Supervision Supervision
+	Features    Features
+	Timings     Timings
+	Orders      Orders
+	Parking     Parking
+	Traffic     Traffic
+	Recall      Recall
+	Load        CarLoad
+	Nuisance    Nuisance
+	Faults      Faults
+	IO          IO
+}
+
+// Default ...
+// @return: The configuration used if nothing else is specified
+func Default() Config {
+	return Config{
+		Node: Node{
+			Floors: elevio.NumFloors,
+			Cars:   []Car{{ID: "1", Driver: "localhost:15657", API: ""}},
+		},
+		Network: Network{
+			Ports: Ports{
+				Peers:             15519,
+				States:            15510,
+				HallOrders:        15511,
+				CabOrders:         15512,
+				DestinationOrders: 15513,
+				Recall:            15514,
+				ETAs:              15515,
+				Handover:          15516,
+			},
+			GroupSize:      0,
+			ForgetAfter:    Duration{1 * time.Minute},
+			MinorityPolicy: MinorityCabOnly,
+			StateTimeout:   Duration{1 * time.Second},
+			Peers: Peers{
+				Interval:     Duration{15 * time.Millisecond},
+				Timeout:      Duration{200 * time.Millisecond},
+				MaxTimeout:   Duration{1 * time.Second},
+				PhiThreshold: 8,
+				SuspectPhi:   3,
+				SuspectLoss:  0.25,
+				WindowSize:   100,
+			},
+		},
+		Assignment: Assignment{
+			AssignerPath:    "",
+			AssignerTimeout: Duration{500 * time.Millisecond},
+			SwitchingCost:   0,
+			FreezeDistance:  -1,
+		},
+		Logging: Logging{
+			File: "",
+		},
+		Supervision: Supervision{
+			StallTimeout: Duration{2 * time.Second},
+			RestartDelay: Duration{1 * time.Second},
+		},
+		Features: Features{
+			ETADisplay: false,
+		},
+		Timings: Timings{
+			DoorOpenHall: Duration{3 * time.Second},
+			DoorOpenCab:  Duration{3 * time.Second},
+			MotorTimeout: Duration{4 * time.Second},
+			TravelTime:   Duration{2500 * time.Millisecond},
+		},
+		Orders: Orders{
+			ClearRequestType: ClearAll,
+			CancelWindow:     Duration{0},
+			CancelHallOrders: false,
+		},
+		Parking: Parking{
+			Policy:     ParkNone,
+			Delay:      Duration{10 * time.Second},
+			LobbyFloor: 0,
+			History:    Duration{2 * time.Hour},
+		},
+		Traffic: Traffic{
+			Schedule:  []TrafficPeriod{},
+			Detect:    false,
+			Window:    Duration{5 * time.Minute},
+			MinOrders: 10,
+			PeakShare: 0.7,
+		},
+		Recall: Recall{
+			Floor: 0,
+		},
+		Load: CarLoad{
+			Source:                 LoadSimulated,
+			Capacity:               8,
+			FullThreshold:          0.8,
+			PassengersPerHallOrder: 2,
+		},
+		Nuisance: Nuisance{
+			Detect:        false,
+			MaxCabOrders:  3,
+			MaxEmptyStops: 2,
+		},
+		Faults: Faults{
+			MaxTimeouts:   3,
+			TimeoutWindow: Duration{2 * time.Minute},
+			ClearAfter:    Duration{1 * time.Minute},
+		},
+		IO: IO{
+			PollRate:      Duration{20 * time.Millisecond},
+			FloorPollRate: Duration{10 * time.Millisecond},
+			Notify:        false,
+		},
+	}
+}
+
+// LoadFile ...
+// Overrides the configuration with the values in the JSON config file at path
+// (Values not given in the file are left as they are)
+// @return: An error if the file could not be read
+func LoadFile(path string, config *Config) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// Validate ...
+// @return: An error telling which value is invalid and what is expected, nil if the
+// configuration is valid
+func Validate(config Config) error {
+	if err := validateNode(config.Node); err != nil {
+		return err
+	}
+	if err := validateNetwork(config.Network); err != nil {
+		return err
+	}
+
+	if config.Assignment.AssignerTimeout.Duration <= 0 {
+		return fmt.Errorf("Assignment.AssignerTimeout must be positive, got %v",
+			config.Assignment.AssignerTimeout)
+	}
+	if config.Assignment.SwitchingCost < 0 {
+		return fmt.Errorf("Assignment.SwitchingCost can't be negative, got %d",
+			config.Assignment.SwitchingCost)
+	}
+	if config.Assignment.FreezeDistance < -1 {
+		return fmt.Errorf("Assignment.FreezeDistance must be at least -1 (disabled), got %d",
+			config.Assignment.FreezeDistance)
+	}
+
+	if config.Supervision.StallTimeout.Duration <= 0 || config.Supervision.RestartDelay.Duration <= 0 {
+		return fmt.Errorf("Supervision.StallTimeout and Supervision.RestartDelay must be positive")
+	}
+
+	timings := config.Timings
+	if timings.DoorOpenHall.Duration <= 0 || timings.DoorOpenCab.Duration <= 0 {
+		return fmt.Errorf("Timings.DoorOpenHall and Timings.DoorOpenCab must be positive, got %v and %v",
+			timings.DoorOpenHall, timings.DoorOpenCab)
+	}
+	if timings.TravelTime.Duration <= 0 {
+		return fmt.Errorf("Timings.TravelTime must be positive, got %v", timings.TravelTime)
+	}
+	// (Otherwise every trip between two floors would be taken for an obstruction)
+	if timings.MotorTimeout.Duration <= timings.TravelTime.Duration {
+		return fmt.Errorf("Timings.MotorTimeout must be longer than Timings.TravelTime, got %v and %v",
+			timings.MotorTimeout, timings.TravelTime)
+	}
+
+	if config.Orders.ClearRequestType != ClearAll && config.Orders.ClearRequestType != ClearInDirn {
+		return fmt.Errorf("Orders.ClearRequestType must be %q or %q, got %q",
+			ClearAll, ClearInDirn, config.Orders.ClearRequestType)
+	}
+
+	if config.Orders.CancelWindow.Duration < 0 {
+		return fmt.Errorf("Orders.CancelWindow can't be negative, got %v",
+			config.Orders.CancelWindow)
+	}
+
+	switch config.Parking.Policy {
+	case ParkNone, ParkLobby, ParkZones, ParkBusiest:
+	default:
+		return fmt.Errorf("Parking.Policy must be %q, %q, %q or %q, got %q",
+			ParkNone, ParkLobby, ParkZones, ParkBusiest, config.Parking.Policy)
+	}
+
+	if config.Parking.LobbyFloor < 0 || config.Parking.LobbyFloor >= elevio.NumFloors {
+		return fmt.Errorf("Parking.LobbyFloor must be between 0 and %d, got %d",
+			elevio.NumFloors-1, config.Parking.LobbyFloor)
+	}
+	if config.Parking.Delay.Duration < 0 {
+		return fmt.Errorf("Parking.Delay can't be negative (0: park at once), got %v",
+			config.Parking.Delay)
+	}
+	if config.Parking.History.Duration <= 0 {
+		return fmt.Errorf("Parking.History must be positive, got %v", config.Parking.History)
+	}
+
+	for _, period := range config.Traffic.Schedule {
+		if err := validateTrafficPeriod(period); err != nil {
+			return fmt.Errorf("Traffic.Schedule: %v", err)
+		}
+	}
+
+	if config.Traffic.Window.Duration <= 0 {
+		return fmt.Errorf("Traffic.Window must be positive, got %v", config.Traffic.Window)
+	}
+
+	// (A share of more than half makes sure up-peak and down-peak are never detected at once)
+	if config.Traffic.PeakShare <= 0.5 || config.Traffic.PeakShare > 1 {
+		return fmt.Errorf("Traffic.PeakShare must be above 0.5 and at most 1, got %v",
+			config.Traffic.PeakShare)
+	}
+	if config.Traffic.MinOrders < 1 {
+		return fmt.Errorf("Traffic.MinOrders must be at least 1, got %d",
+			config.Traffic.MinOrders)
+	}
+
+	if config.Recall.Floor < 0 || config.Recall.Floor >= elevio.NumFloors {
+		return fmt.Errorf("Recall.Floor must be between 0 and %d, got %d",
+			elevio.NumFloors-1, config.Recall.Floor)
+	}
+
+	if config.Load.Source != LoadSimulated && config.Load.Source != LoadSensor {
+		return fmt.Errorf("Load.Source must be %q or %q, got %q",
+			LoadSimulated, LoadSensor, config.Load.Source)
+	}
+	if config.Load.Capacity < 1 {
+		return fmt.Errorf("Load.Capacity must be at least 1, got %d",
+			config.Load.Capacity)
+	}
+	if config.Load.FullThreshold <= 0 || config.Load.FullThreshold > 1 {
+		return fmt.Errorf("Load.FullThreshold must be above 0 and at most 1, got %v",
+			config.Load.FullThreshold)
+	}
+	if config.Load.PassengersPerHallOrder < 0 {
+		return fmt.Errorf("Load.PassengersPerHallOrder can't be negative, got %v",
+			config.Load.PassengersPerHallOrder)
+	}
+
+	if config.Nuisance.MaxCabOrders < 1 {
+		return fmt.Errorf("Nuisance.MaxCabOrders must be at least 1, got %d",
+			config.Nuisance.MaxCabOrders)
+	}
+	if config.Nuisance.MaxEmptyStops < 1 {
+		return fmt.Errorf("Nuisance.MaxEmptyStops must be at least 1, got %d",
+			config.Nuisance.MaxEmptyStops)
+	}
+
+	if config.Faults.MaxTimeouts < 1 {
+		return fmt.Errorf("Faults.MaxTimeouts must be at least 1, got %d",
+			config.Faults.MaxTimeouts)
+	}
+	if config.Faults.TimeoutWindow.Duration <= 0 || config.Faults.ClearAfter.Duration <= 0 {
+		return fmt.Errorf("Faults.TimeoutWindow and Faults.ClearAfter must be positive")
+	}
+
+	if config.IO.FloorPollRate.Duration <= 0 || config.IO.FloorPollRate.Duration > config.IO.PollRate.Duration {
+		return fmt.Errorf("IO.FloorPollRate must be positive and at most IO.PollRate, got %v and %v",
+			config.IO.FloorPollRate, config.IO.PollRate)
+	}
+
+	return nil
+}
+
+// validateTrafficPeriod ...
+// @return: An error if the period has an invalid time of day or traffic mode
+func validateTrafficPeriod(period TrafficPeriod) error {
+	for _, timeOfDay := range []string{period.Start, period.End} {
+		if _, err := time.Parse(TimeOfDayLayout, timeOfDay); err != nil {
+			return fmt.Errorf("invalid time of day %q (expected e.g. \"07:30\")", timeOfDay)
+		}
+	}
+
+	switch period.Mode {
+	case TrafficNormal, TrafficUpPeak, TrafficDownPeak:
+	default:
+		return fmt.Errorf("Mode must be %q, %q or %q, got %q",
+			TrafficNormal, TrafficUpPeak, TrafficDownPeak, period.Mode)
+	}
+
+	return nil
+}
+
+// validateNode ...
+// @return: An error if the floor count or any of the cars is invalid
+func validateNode(node Node) error {
+	if node.Floors != elevio.NumFloors {
+		return fmt.Errorf("Node.Floors must be %d (the number of floors is fixed when building, "+
+			"change elevio.NumFloors and rebuild), got %d", elevio.NumFloors, node.Floors)
+	}
+
+	if len(node.Cars) == 0 {
+		return fmt.Errorf("Node.Cars must contain at least one car")
+	}
+	ids := map[string]bool{}
+	apiAddrs := map[string]bool{}
+	for i, car := range node.Cars {
+		if car.ID == "" {
+			return fmt.Errorf("Node.Cars[%d].ID can't be empty", i)
+		}
+		if ids[car.ID] {
+			return fmt.Errorf("Node.Cars[%d].ID %q is used by another car", i, car.ID)
+		}
+		ids[car.ID] = true
+
+		if _, _, err := net.SplitHostPort(car.Driver); err != nil {
+			return fmt.Errorf("Node.Cars[%d].Driver must be an address like \"localhost:15657\", got %q",
+				i, car.Driver)
+		}
+
+		if car.API == "" {
+			continue
+		}
+		if apiAddrs[car.API] {
+			return fmt.Errorf("Node.Cars[%d].API %q is used by another car", i, car.API)
+		}
+		apiAddrs[car.API] = true
+	}
+	return nil
+}
+
+// validateNetwork ...
+// @return: An error if any of the ports, the group or the failure detection is invalid
+func validateNetwork(network Network) error {
+	ports := []struct {
+		name string
+		port int
+	}{
+		{"Peers", network.Ports.Peers},
+		{"States", network.Ports.States},
+		{"HallOrders", network.Ports.HallOrders},
+		{"CabOrders", network.Ports.CabOrders},
+		{"DestinationOrders", network.Ports.DestinationOrders},
+		{"Recall", network.Ports.Recall},
+		{"ETAs", network.Ports.ETAs},
+		{"Handover", network.Ports.Handover},
+	}
+	used := map[int]string{}
+	for _, p := range ports {
+		if p.port < 1 || p.port > 65535 {
+			return fmt.Errorf("Network.Ports.%s must be between 1 and 65535, got %d", p.name, p.port)
+		}
+		if other, ok := used[p.port]; ok {
+			return fmt.Errorf("Network.Ports.%s and Network.Ports.%s can't both be %d", other, p.name, p.port)
+		}
+		used[p.port] = p.name
+	}
+
+	if network.GroupSize < 0 {
+		return fmt.Errorf("Network.GroupSize can't be negative (0: use the peer history), got %d",
+			network.GroupSize)
+	}
+	if network.ForgetAfter.Duration < 0 {
+		return fmt.Errorf("Network.ForgetAfter can't be negative (0: never forget), got %v",
+			network.ForgetAfter)
+	}
+	if network.MinorityPolicy != MinorityCabOnly && network.MinorityPolicy != MinorityAll {
+		return fmt.Errorf("Network.MinorityPolicy must be %q or %q, got %q",
+			MinorityCabOnly, MinorityAll, network.MinorityPolicy)
+	}
+	if network.StateTimeout.Duration <= 0 {
+		return fmt.Errorf("Network.StateTimeout must be positive, got %v", network.StateTimeout)
+	}
+
+	peers := network.Peers
+	if peers.Interval.Duration <= 0 {
+		return fmt.Errorf("Network.Peers.Interval must be positive, got %v", peers.Interval)
+	}
+	if peers.Timeout.Duration <= peers.Interval.Duration || peers.MaxTimeout.Duration < peers.Timeout.Duration {
+		return fmt.Errorf("Network.Peers must have Interval < Timeout <= MaxTimeout, got %v, %v and %v",
+			peers.Interval, peers.Timeout, peers.MaxTimeout)
+	}
+	if peers.PhiThreshold < 0 || peers.SuspectPhi < 0 || peers.SuspectLoss < 0 || peers.SuspectLoss > 1 {
+		return fmt.Errorf("Network.Peers.PhiThreshold and SuspectPhi can't be negative, "+
+			"and SuspectLoss must be between 0 and 1, got %v, %v and %v",
+			peers.PhiThreshold, peers.SuspectPhi, peers.SuspectLoss)
+	}
+	if peers.WindowSize < 2 {
+		return fmt.Errorf("Network.Peers.WindowSize must be at least 2, got %d", peers.WindowSize)
+	}
+	return nil
+}
@@ -3,7 +3,9 @@ package consensus
 import (
 	"../datatypes"
 	"../elevio"
+	"context"
 	"fmt"
+	"time"
 	//"github.com/jinzhu/copier"
 )
 
@@ -11,12 +13,15 @@ import (
 // Channels used for communication related to consensus of cab orders with other modules
 type CabOrderChannels struct {
 	NewOrderChan        chan int
+	BoardingOrderChan   chan int
 	CompletedOrderChan  chan int
 	ConfirmedOrdersChan chan datatypes.ConfirmedCabOrdersMap
 	LocalOrdersChan     chan datatypes.CabOrdersMap
 	RemoteOrdersChan    chan datatypes.CabOrdersMap
 	PeerlistUpdateChan  chan []datatypes.NodeID
 	LostPeerChan        chan datatypes.NodeID
+	RecallChan          chan bool
+	CancelOrderChan     chan int
 }
 
 // LocalCabOrdersMsg ...
@@ -47,6 +52,32 @@ func calcConfirmedOrders(localCabOrders datatypes.CabOrdersMap) datatypes.Confir
 	return confirmedOrders
 }
 
+// cancelCabOrders ...
+// Sets all pending and confirmed cab orders in the list to Inactive and clears their lights
+// @return: true if any orders were cancelled
+func cancelCabOrders(
+	cabOrders datatypes.CabOrdersList,
+	TurnOffCabLightChan chan<- elevio.ButtonEvent) bool {
+
+	cancelledFlag := false
+
+	for floor := range cabOrders {
+		if cabOrders[floor].State != datatypes.PendingAck && cabOrders[floor].State != datatypes.Confirmed {
+			continue
+		}
+
+		cabOrders[floor] = datatypes.Req{
+			State:      datatypes.Inactive,
+			AckBy:      nil,
+			Generation: cabOrders[floor].Generation,
+		}
+		clearCabLight(floor, TurnOffCabLightChan)
+		cancelledFlag = true
+	}
+
+	return cancelledFlag
+}
+
 // deepcopyCabOrders ...
 // @return: A pointer to a hard copied map of type CabOrdersMap
 func deepcopyCabOrders(m datatypes.CabOrdersMap) datatypes.CabOrdersMap {
@@ -62,8 +93,9 @@ func deepcopyCabOrders(m datatypes.CabOrdersMap) datatypes.CabOrdersMap {
 			copy(tempAckBy, currAckBy)
 
 			tempReq := datatypes.Req{
-				State: currReq.State,
-				AckBy: currReq.AckBy,
+				State:      currReq.State,
+				AckBy:      currReq.AckBy,
+				Generation: currReq.Generation,
 			}
 
 			tempCabOrdersList[currReqIndex] = tempReq
@@ -95,9 +127,17 @@ func deepcopyConfirmedCabOrders(m datatypes.ConfirmedCabOrdersMap) datatypes.Con
 // pending acknowledgement, and which orders are completed (Inactive). Only
 // confirmed orders are passed along to the optimal assigner, making sure
 // that all nodes agree on the distribution of all of the orders at all times.
+// The cab orders of the local node are cancelled during a fire recall.
+// A cab order of the local node is withdrawn when its button is pressed twice within
+// cancelWindow (0 disables double-press cancellation), or when cancelled through the API.
+// The cab orders registered for passengers boarding on destination calls are no button presses,
+// and never count towards a double press.
 func CabOrdersModule(
+	ctx context.Context,
+	heartbeat <-chan struct{},
 	localID datatypes.NodeID,
 	NewOrderChan <-chan int,
+	BoardingOrderChan <-chan int,
 	ConfirmedOrdersChan chan<- datatypes.ConfirmedCabOrdersMap,
 	CompletedOrderChan <-chan int,
 	TurnOffCabLightChan chan<- elevio.ButtonEvent,
@@ -105,11 +145,18 @@ func CabOrdersModule(
 	LocalOrdersChan chan<- datatypes.CabOrdersMap,
 	RemoteOrdersChan <-chan datatypes.CabOrdersMap,
 	PeerlistUpdateChan <-chan []datatypes.NodeID,
-	LostPeerChan <-chan datatypes.NodeID) {
+	LostPeerChan <-chan datatypes.NodeID,
+	RecallChan <-chan bool,
+	CancelOrderChan <-chan int,
+	cancelWindow time.Duration) error {
 
 	// Initialize variables
 	// ----
 	peerlist := []datatypes.NodeID{}
+	recallActive := false
+
+	// When each cab button of the local node was last pressed, used for detecting double presses
+	lastPressed := make([]time.Time, elevio.NumFloors)
 
 	// Note: These variables are initialized dynamically, as opposed to the hall order matrices.
 	// Hence these values will need to be deep copied before being sent on any channels, as the
@@ -143,14 +190,43 @@ func CabOrdersModule(
 		// Store new local orders as pendingAck and update network module
 		case a := <-NewOrderChan:
 
-			localCabOrders[localID][a] = datatypes.Req{
-				State: datatypes.PendingAck,
-				AckBy: []datatypes.NodeID{localID},
+			// Don't accept cab orders during a fire recall
+			if recallActive {
+				break
+			}
+
+			// A second press within cancelWindow withdraws the order (e.g. a mis-press)
+			if cancelWindow > 0 && time.Since(lastPressed[a]) < cancelWindow {
+				lastPressed[a] = time.Time{}
+
+				if cancelOrder(&localCabOrders[localID][a], localID) {
+					fmt.Println("(consensus:caborders) Cab order at floor", a, "cancelled by double press")
+					clearCabLight(a, TurnOffCabLightChan)
+
+					confirmedCabOrders = calcConfirmedOrders(localCabOrders)
+					ConfirmedOrdersChan <- deepcopyConfirmedCabOrders(confirmedCabOrders)
+					LocalOrdersChan <- deepcopyCabOrders(localCabOrders)
+				}
+				break
 			}
+			lastPressed[a] = time.Now()
+
+			// (A press after a cancellation is newer than it, and isn't withdrawn)
+			pressOrder(&localCabOrders[localID][a], localID)
 
 			// Send updates to network module
 			LocalOrdersChan <- deepcopyCabOrders(localCabOrders)
 
+		// Store the destinations of boarding passengers as pendingAck and update network module
+		// (Unlike button presses, these never cancel an order placed just before)
+		case a := <-BoardingOrderChan:
+			if recallActive {
+				break
+			}
+
+			pressOrder(&localCabOrders[localID][a], localID)
+			LocalOrdersChan <- deepcopyCabOrders(localCabOrders)
+
 		// Mark completed orders (with localID) as inactive and update network
 		// module and optimalAssigner with all confirmedCabOrders
 		case a := <-CompletedOrderChan:
@@ -159,8 +235,9 @@ func CabOrdersModule(
 			clearCabLight(a, TurnOffCabLightChan)
 
 			localCabOrders[localID][a] = datatypes.Req{
-				State: datatypes.Inactive,
-				AckBy: nil,
+				State:      datatypes.Inactive,
+				AckBy:      nil,
+				Generation: localCabOrders[localID][a].Generation,
 			}
 
 			confirmedCabOrders = calcConfirmedOrders(localCabOrders)
@@ -169,6 +246,29 @@ func CabOrdersModule(
 			// Send updates to network module
 			LocalOrdersChan <- deepcopyCabOrders(localCabOrders)
 
+		// Withdraw a cab order of the local node, cancelled through the API
+		case a := <-CancelOrderChan:
+			if !cancelOrder(&localCabOrders[localID][a], localID) {
+				break
+			}
+
+			fmt.Println("(consensus:caborders) Cab order at floor", a, "cancelled")
+			clearCabLight(a, TurnOffCabLightChan)
+
+			confirmedCabOrders = calcConfirmedOrders(localCabOrders)
+			ConfirmedOrdersChan <- deepcopyConfirmedCabOrders(confirmedCabOrders)
+			LocalOrdersChan <- deepcopyCabOrders(localCabOrders)
+
+		// Cancel the cab orders of the local node when a fire recall is activated
+		case a := <-RecallChan:
+			recallActive = a
+
+			if recallActive && cancelCabOrders(localCabOrders[localID], TurnOffCabLightChan) {
+				confirmedCabOrders = calcConfirmedOrders(localCabOrders)
+				ConfirmedOrdersChan <- deepcopyConfirmedCabOrders(confirmedCabOrders)
+				LocalOrdersChan <- deepcopyCabOrders(localCabOrders)
+			}
+
 		// Update peerlist with changes received from network module
 		case a := <-PeerlistUpdateChan:
 			peerlist = UniqueIDSlice(a)
@@ -225,6 +325,11 @@ func CabOrdersModule(
 				}
 			}
 
+			// Keep cancelling cab orders of the local node still pending on other nodes
+			if recallActive && cancelCabOrders(localCabOrders[localID], TurnOffCabLightChan) {
+				confirmedOrdersChangedFlag = true
+			}
+
 			// Only update confirmedCabOrders when orders are changed to Inactive or Confirmed
 			if confirmedOrdersChangedFlag {
 				confirmedCabOrders = calcConfirmedOrders(localCabOrders)
@@ -233,6 +338,11 @@ func CabOrdersModule(
 
 			// Update network module with new data
 			LocalOrdersChan <- deepcopyCabOrders(localCabOrders)
+
+		case <-heartbeat:
+
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 }
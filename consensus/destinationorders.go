@@ -0,0 +1,311 @@
+package consensus
+
+import (
+	"../datatypes"
+	"../elevio"
+	"context"
+	"fmt"
+)
+
+// DestinationOrderChannels ...
+// Channels used for communication related to consensus of destination orders with other modules
+type DestinationOrderChannels struct {
+	NewOrderChan        chan elevio.DestinationEvent
+	CompletedOrderChan  chan elevio.ButtonEvent
+	ConfirmedOrdersChan chan datatypes.ConfirmedDestinationOrdersMatrix
+	AssignmentChan      chan datatypes.DestinationAssignmentMatrix
+	LocalOrdersChan     chan datatypes.DestinationOrdersMatrix
+	RemoteOrdersChan    chan datatypes.DestinationOrdersMatrix
+	PeerlistUpdateChan  chan []datatypes.NodeID
+	PartitionUpdateChan chan datatypes.PartitionStatus
+	RecallChan          chan bool
+}
+
+// LocalDestinationOrdersMsg ...
+// Used for broadcasting localDestinationOrders to other nodes
+type LocalDestinationOrdersMsg struct {
+	ID                datatypes.NodeID
+	DestinationOrders datatypes.DestinationOrdersMatrix
+}
+
+// calcConfirmedDestinationOrders ...
+// @return: boolean matrix where only Confirmed destination orders are set to true
+func calcConfirmedDestinationOrders(
+	localDestinationOrders datatypes.DestinationOrdersMatrix) datatypes.ConfirmedDestinationOrdersMatrix {
+
+	var confirmedOrders datatypes.ConfirmedDestinationOrdersMatrix
+
+	for origin := range localDestinationOrders {
+		for destination := range localDestinationOrders[origin] {
+			confirmedOrders[origin][destination] =
+				localDestinationOrders[origin][destination].State == datatypes.Confirmed
+		}
+	}
+
+	return confirmedOrders
+}
+
+// DestinationOrdersModule ...
+// Handles the information distribution for destination orders between nodes, following the
+// same consensus logic as the hall orders.
+// When the local node stops at the origin floor of destination orders assigned to it, the
+// passengers have boarded: The orders are completed, and their destinations are registered
+// as cab orders of the local node. (The assigner keeps every order with the node committed to
+// it in the broadcast node states, so that all nodes agree on which node completes it)
+// Changes in which car the passengers of each order should board are announced on the displays.
+// All destination orders are cancelled during a fire recall.
+func DestinationOrdersModule(
+	ctx context.Context,
+	heartbeat <-chan struct{},
+	localID datatypes.NodeID,
+	NewOrderChan <-chan elevio.DestinationEvent,
+	ConfirmedOrdersChan chan<- datatypes.ConfirmedDestinationOrdersMatrix,
+	CompletedOrderChan <-chan elevio.ButtonEvent,
+	AssignmentChan <-chan datatypes.DestinationAssignmentMatrix,
+	BoardingCabOrderChan chan<- int,
+	DestinationDisplayChan chan<- elevio.DestinationAnnouncement,
+	ApiAnnouncementChan chan<- elevio.DestinationAnnouncement,
+	LocalOrdersChan chan<- datatypes.DestinationOrdersMatrix,
+	RemoteOrdersChan <-chan datatypes.DestinationOrdersMatrix,
+	PeerlistUpdateChan <-chan []datatypes.NodeID,
+	minorityPolicy datatypes.MinorityPolicy,
+	PartitionUpdateChan <-chan datatypes.PartitionStatus,
+	RecallChan <-chan bool) error {
+
+	// Initialize variables
+	// ----
+	peerlist := []datatypes.NodeID{}
+	inMajority := true
+	recallActive := false
+
+	// All orders will be initialized to Unknown
+	// (due to Golang's zero-state initialization)
+	var localDestinationOrders datatypes.DestinationOrdersMatrix
+	var assignment datatypes.DestinationAssignmentMatrix
+
+	// Send initialized variables to other modules
+	LocalOrdersChan <- localDestinationOrders
+	ConfirmedOrdersChan <- calcConfirmedDestinationOrders(localDestinationOrders)
+
+	fmt.Println("(consensus:destinationorders) Initialized")
+
+	// Logic for handling consensus when new data enters system
+	// ------
+	for {
+
+		select {
+
+		// Store new destination orders as pendingAck and update network module
+		case a := <-NewOrderChan:
+
+			// Don't accept new destination orders when alone on network, or when
+			// they are owned by the majority partition (same as for hall orders)
+			if ContainsID(peerlist, localID) && len(peerlist) == 1 {
+				break
+			}
+			if !inMajority && minorityPolicy == datatypes.ServeCabOnly {
+				break
+			}
+			if recallActive {
+				break
+			}
+
+			// (Make sure to never access elements outside of array)
+			if a.Origin < 0 || a.Origin >= elevio.NumFloors ||
+				a.Destination < 0 || a.Destination >= elevio.NumFloors ||
+				a.Origin == a.Destination {
+				break
+			}
+
+			pressOrder(&localDestinationOrders[a.Origin][a.Destination], localID)
+
+			// Send updates to network module
+			LocalOrdersChan <- localDestinationOrders
+
+		// The local node has stopped at a floor, and will depart in the given direction.
+		// Complete the destination orders assigned to it from this floor in the same direction,
+		// and register their destinations as cab orders.
+		case a := <-CompletedOrderChan:
+
+			completedFlag := false
+			origin := a.Floor
+
+			for destination := range localDestinationOrders[origin] {
+				if localDestinationOrders[origin][destination].State != datatypes.Confirmed ||
+					assignment[origin][destination] != localID {
+					continue
+				}
+
+				// Passengers going the other way won't board
+				goingUp := destination > origin
+				if goingUp != (a.Button == elevio.BT_HallUp) {
+					continue
+				}
+
+				localDestinationOrders[origin][destination] = datatypes.Req{
+					State:      datatypes.Inactive,
+					AckBy:      nil,
+					Generation: localDestinationOrders[origin][destination].Generation,
+				}
+				completedFlag = true
+
+				assignment[origin][destination] = ""
+				announceDestination(origin, destination, "", DestinationDisplayChan, ApiAnnouncementChan)
+				BoardingCabOrderChan <- destination
+			}
+
+			if completedFlag {
+				// Send updates to optimalAssigner
+				ConfirmedOrdersChan <- calcConfirmedDestinationOrders(localDestinationOrders)
+
+				// Send updates to network module
+				LocalOrdersChan <- localDestinationOrders
+			}
+
+		// Announce changes in which car should be boarded for each order
+		case a := <-AssignmentChan:
+
+			for origin := range a {
+				for destination := range a[origin] {
+
+					// (The assignment might be outdated, only orders still confirmed are announced)
+					car := a[origin][destination]
+					if localDestinationOrders[origin][destination].State != datatypes.Confirmed {
+						car = ""
+					}
+
+					if car != assignment[origin][destination] {
+						assignment[origin][destination] = car
+						announceDestination(origin, destination, car,
+							DestinationDisplayChan, ApiAnnouncementChan)
+					}
+				}
+			}
+
+		// Cancel all destination orders when a fire recall is activated
+		case a := <-RecallChan:
+			recallActive = a
+
+			if recallActive && cancelDestinationOrders(&localDestinationOrders, &assignment,
+				DestinationDisplayChan, ApiAnnouncementChan) {
+				ConfirmedOrdersChan <- calcConfirmedDestinationOrders(localDestinationOrders)
+				LocalOrdersChan <- localDestinationOrders
+			}
+
+		// Received changes in peerlist from network module
+		case a := <-PeerlistUpdateChan:
+
+			peerlist = UniqueIDSlice(a)
+
+			// Set all inactive orders to unknown if alone on network
+			if len(peerlist) <= 1 {
+				setInactiveDestinationOrdersUnknown(&localDestinationOrders)
+				LocalOrdersChan <- localDestinationOrders
+			}
+
+		// Set all inactive orders to unknown when losing the majority
+		case a := <-PartitionUpdateChan:
+			lostMajority := inMajority && !a.Majority
+			inMajority = a.Majority
+
+			if lostMajority {
+				setInactiveDestinationOrdersUnknown(&localDestinationOrders)
+				LocalOrdersChan <- localDestinationOrders
+			}
+
+		// Merge received remoteDestinationOrders from network module with local data
+		case a := <-RemoteOrdersChan:
+
+			remoteDestinationOrders := a
+
+			confirmedOrdersChangedFlag := false
+
+			// Merge world views for every order in the destination order matrix
+			for origin := range localDestinationOrders {
+				for destination := range localDestinationOrders[origin] {
+
+					pLocal := &localDestinationOrders[origin][destination]
+					remote := remoteDestinationOrders[origin][destination]
+
+					newInactiveFlag, newConfirmedFlag := merge(pLocal, remote, localID, peerlist)
+
+					// Make flag stay true if set to true once
+					confirmedOrdersChangedFlag = confirmedOrdersChangedFlag || newInactiveFlag || newConfirmedFlag
+
+					if newInactiveFlag && assignment[origin][destination] != "" {
+						assignment[origin][destination] = ""
+						announceDestination(origin, destination, "", DestinationDisplayChan, ApiAnnouncementChan)
+					}
+				}
+			}
+
+			// Keep cancelling orders from nodes that haven't seen the fire recall yet
+			if recallActive && cancelDestinationOrders(&localDestinationOrders, &assignment,
+				DestinationDisplayChan, ApiAnnouncementChan) {
+				confirmedOrdersChangedFlag = true
+			}
+
+			// Only update confirmed orders when orders are changed to Inactive or Confirmed
+			if confirmedOrdersChangedFlag {
+				ConfirmedOrdersChan <- calcConfirmedDestinationOrders(localDestinationOrders)
+			}
+
+			// Update network module with new data
+			LocalOrdersChan <- localDestinationOrders
+
+		case <-heartbeat:
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// setInactiveDestinationOrdersUnknown ...
+// Sets all Inactive destination orders to Unknown, allowing them to be
+// overridden by the network
+func setInactiveDestinationOrdersUnknown(localDestinationOrders *datatypes.DestinationOrdersMatrix) {
+	for origin := range localDestinationOrders {
+		for destination := range localDestinationOrders[origin] {
+			if (*localDestinationOrders)[origin][destination].State == datatypes.Inactive {
+				(*localDestinationOrders)[origin][destination].State = datatypes.Unknown
+			}
+		}
+	}
+}
+
+// cancelDestinationOrders ...
+// Sets all pending and confirmed destination orders to Inactive, and tells the passengers
+// of assigned orders that no car is coming
+// @return: true if any orders were cancelled
+func cancelDestinationOrders(
+	localDestinationOrders *datatypes.DestinationOrdersMatrix,
+	assignment *datatypes.DestinationAssignmentMatrix,
+	DestinationDisplayChan chan<- elevio.DestinationAnnouncement,
+	ApiAnnouncementChan chan<- elevio.DestinationAnnouncement) bool {
+
+	cancelledFlag := false
+
+	for origin := range localDestinationOrders {
+		for destination := range localDestinationOrders[origin] {
+			currState := (*localDestinationOrders)[origin][destination].State
+			if currState != datatypes.PendingAck && currState != datatypes.Confirmed {
+				continue
+			}
+
+			(*localDestinationOrders)[origin][destination] = datatypes.Req{
+				State:      datatypes.Inactive,
+				AckBy:      nil,
+				Generation: (*localDestinationOrders)[origin][destination].Generation,
+			}
+			cancelledFlag = true
+
+			if (*assignment)[origin][destination] != "" {
+				(*assignment)[origin][destination] = ""
+				announceDestination(origin, destination, "", DestinationDisplayChan, ApiAnnouncementChan)
+			}
+		}
+	}
+
+	return cancelledFlag
+}
@@ -7,6 +7,8 @@ import (
 // merge ...
 // Forms the basis for all the consensus logic.
 // Merges the wordview of a single local order request with a single remote order request.
+// A Cancelled order only withdraws orders of older generations, while a pending or confirmed order
+// at least as new as a Cancelled order is a new press made after the cancellation.
 // @return newConfirmedFlag: the order was set to Confirmed
 // @return newInactiveFlag: the order was set to Inactive
 func merge(
@@ -18,22 +20,60 @@ func merge(
 	newConfirmedFlag := false
 	newInactiveFlag := false
 
+	generation := (*pLocal).Generation
+	if remote.Generation > generation {
+		generation = remote.Generation
+	}
+
 	// Set the new state of the local order based on the remote order
 	switch (*pLocal).State {
 
-	// Set the local order from Inactive to Pending and add the localID if the remote order is Pending.
+	// Set the local order from Inactive to Pending and add the localID if the remote order is Pending,
+	// unless it is a stale copy of an older generation (e.g. from a peer rejoining after the order was withdrawn).
+	// (A remote Cancelled order has already been withdrawn locally, only its generation is kept
+	// so that new presses are newer than the cancellation)
 	case datatypes.Inactive:
-		if remote.State == datatypes.PendingAck {
+		if remote.State == datatypes.PendingAck && remote.Generation >= (*pLocal).Generation {
 			*pLocal = datatypes.Req{
-				State: datatypes.PendingAck,
-				AckBy: UniqueIDSlice(append(remote.AckBy, localID)),
+				State:      datatypes.PendingAck,
+				AckBy:      UniqueIDSlice(append(remote.AckBy, localID)),
+				Generation: remote.Generation,
 			}
+			break
 		}
+		(*pLocal).Generation = generation
 
 	// Set local order from Pending to Confirmed if all nodes have acknowledged the order or if the remote order is already Confirmed.
 	// Add the localID to the ackBy list if the order is not yet Confirmed.
+	// The order is withdrawn if the remote order is cancelled in a newer generation, and dropped if the
+	// remote order is Inactive in a newer generation (the local order is a stale copy, e.g. after rejoining).
 	case datatypes.PendingAck:
 
+		if remote.State == datatypes.Inactive && remote.Generation > (*pLocal).Generation {
+			*pLocal = datatypes.Req{
+				State:      datatypes.Inactive,
+				AckBy:      nil,
+				Generation: remote.Generation,
+			}
+			newInactiveFlag = true
+			break
+		}
+
+		if remote.State == datatypes.Cancelled {
+			if remote.Generation > (*pLocal).Generation {
+				*pLocal = datatypes.Req{
+					State:      datatypes.Cancelled,
+					AckBy:      UniqueIDSlice(append(remote.AckBy, localID)),
+					Generation: remote.Generation,
+				}
+			}
+			break
+		}
+
+		if remote.State == datatypes.PendingAck || remote.State == datatypes.Confirmed {
+			(*pLocal).Generation = generation
+		}
+
 		if (remote.State == datatypes.Confirmed) || containsList((*pLocal).AckBy, peerlist) {
 			(*pLocal).State = datatypes.Confirmed
 			newConfirmedFlag = true
@@ -41,46 +81,156 @@ func merge(
 		}
 		(*pLocal).AckBy = UniqueIDSlice(append(remote.AckBy, localID))
 
-	// Set the local order to Inactive if the remote order is Inactive
+	// Set the local order to Inactive if the remote order is Inactive,
+	// and withdraw it if the remote order is cancelled in a newer generation
 	case datatypes.Confirmed:
-		if remote.State == datatypes.Inactive {
+		switch remote.State {
+
+		case datatypes.Inactive:
 			*pLocal = datatypes.Req{
-				State: datatypes.Inactive,
-				AckBy: nil,
+				State:      datatypes.Inactive,
+				AckBy:      nil,
+				Generation: generation,
 			}
 			newInactiveFlag = true
+
+		case datatypes.Cancelled:
+			if remote.Generation > (*pLocal).Generation {
+				*pLocal = datatypes.Req{
+					State:      datatypes.Cancelled,
+					AckBy:      UniqueIDSlice(append(remote.AckBy, localID)),
+					Generation: remote.Generation,
+				}
+				newInactiveFlag = true
+			}
+
+		case datatypes.PendingAck, datatypes.Confirmed:
+			(*pLocal).Generation = generation
 		}
 
-	// Blindly copy the remote order state (including ackBy list) if the local order is Unknown
+	// Collect acknowledgements of the withdrawal, and set the local order to Inactive once
+	// all nodes have acknowledged it, or if the remote order is already Inactive.
+	// (Remote Pending and Confirmed orders of older generations are stale, and are ignored until then,
+	// while newer ones have been pressed again after the cancellation)
+	case datatypes.Cancelled:
+		switch remote.State {
+
+		case datatypes.Inactive:
+			*pLocal = datatypes.Req{
+				State:      datatypes.Inactive,
+				AckBy:      nil,
+				Generation: generation,
+			}
+
+		case datatypes.Cancelled:
+			if remote.Generation < (*pLocal).Generation {
+				break
+			}
+			if remote.Generation > (*pLocal).Generation {
+				*pLocal = datatypes.Req{
+					State:      datatypes.Cancelled,
+					AckBy:      nil,
+					Generation: remote.Generation,
+				}
+			}
+
+			(*pLocal).AckBy = UniqueIDSlice(append(append((*pLocal).AckBy, remote.AckBy...), localID))
+			if containsList((*pLocal).AckBy, peerlist) {
+				*pLocal = datatypes.Req{
+					State:      datatypes.Inactive,
+					AckBy:      nil,
+					Generation: (*pLocal).Generation,
+				}
+			}
+
+		case datatypes.PendingAck:
+			if remote.Generation >= (*pLocal).Generation {
+				*pLocal = datatypes.Req{
+					State:      datatypes.PendingAck,
+					AckBy:      UniqueIDSlice(append(remote.AckBy, localID)),
+					Generation: remote.Generation,
+				}
+			}
+
+		case datatypes.Confirmed:
+			if remote.Generation >= (*pLocal).Generation {
+				*pLocal = datatypes.Req{
+					State:      datatypes.Confirmed,
+					AckBy:      UniqueIDSlice(append(remote.AckBy, localID)),
+					Generation: remote.Generation,
+				}
+				newConfirmedFlag = true
+			}
+		}
+
+	// Blindly copy the remote order state (including ackBy list and generation) if the local order is Unknown
 	case datatypes.Unknown:
 		switch remote.State {
 
 		case datatypes.Inactive:
 			*pLocal = datatypes.Req{
-				State: datatypes.Inactive,
-				AckBy: nil,
+				State:      datatypes.Inactive,
+				AckBy:      nil,
+				Generation: remote.Generation,
 			}
 			newInactiveFlag = true
 
 		case datatypes.PendingAck:
 			*pLocal = datatypes.Req{
-				State: datatypes.PendingAck,
-				AckBy: UniqueIDSlice(append(remote.AckBy, localID)),
+				State:      datatypes.PendingAck,
+				AckBy:      UniqueIDSlice(append(remote.AckBy, localID)),
+				Generation: remote.Generation,
 			}
 
 		case datatypes.Confirmed:
 			*pLocal = datatypes.Req{
-				State: datatypes.Confirmed,
-				AckBy: UniqueIDSlice(append(remote.AckBy, localID)),
+				State:      datatypes.Confirmed,
+				AckBy:      UniqueIDSlice(append(remote.AckBy, localID)),
+				Generation: remote.Generation,
 			}
 			newConfirmedFlag = true
 
+		case datatypes.Cancelled:
+			*pLocal = datatypes.Req{
+				State:      datatypes.Cancelled,
+				AckBy:      UniqueIDSlice(append(remote.AckBy, localID)),
+				Generation: remote.Generation,
+			}
+
 		}
 	}
 
 	return newInactiveFlag, newConfirmedFlag
 }
 
+// pressOrder ...
+// Places a new press of an order as pending, in a newer generation than any earlier press
+// or cancellation of the order seen by the local node.
+func pressOrder(pLocal *datatypes.Req, localID datatypes.NodeID) {
+	*pLocal = datatypes.Req{
+		State:      datatypes.PendingAck,
+		AckBy:      []datatypes.NodeID{localID},
+		Generation: (*pLocal).Generation + 1,
+	}
+}
+
+// cancelOrder ...
+// Withdraws a pending or confirmed order, leaving a Cancelled tombstone acknowledged by the local node.
+// (The tombstone is a newer generation than the order, and withdraws it on the other nodes)
+// @return: true if the order was withdrawn
+func cancelOrder(pLocal *datatypes.Req, localID datatypes.NodeID) bool {
+	if (*pLocal).State != datatypes.PendingAck && (*pLocal).State != datatypes.Confirmed {
+		return false
+	}
+
+	*pLocal = datatypes.Req{
+		State:      datatypes.Cancelled,
+		AckBy:      []datatypes.NodeID{localID},
+		Generation: (*pLocal).Generation + 1,
+	}
+	return true
+}
+
 // UniqueIDSlice ...
 // @return: A list of NodeID's not containing any duplicates.
 // (Note that the returned list is not sorted, as this is not required by any other functionality).
@@ -0,0 +1,110 @@
+package consensus
+
+import (
+	"../datatypes"
+	"testing"
+)
+
+var allNodes = []datatypes.NodeID{"node_1", "node_2", "node_3"}
+
+// mergeAll ...
+// Merges every order with every other order, as the nodes do when they can all see each other again
+func mergeAll(orders map[datatypes.NodeID]*datatypes.Req) {
+	for round := 0; round < 3; round++ {
+		for localID, pLocal := range orders {
+			for remoteID, pRemote := range orders {
+				if remoteID != localID {
+					merge(pLocal, *pRemote, localID, allNodes)
+				}
+			}
+		}
+	}
+}
+
+func TestStalePendingNotResurrected(t *testing.T) {
+	// node_3 has the order pending in generation 1 when it is cut off
+	stale := datatypes.Req{State: datatypes.PendingAck, AckBy: []datatypes.NodeID{"node_3"}, Generation: 1}
+
+	// Meanwhile, node_1 and node_2 confirm the order, cancel it and withdraw it
+	order1 := datatypes.Req{State: datatypes.Confirmed, AckBy: allNodes[:2], Generation: 1}
+	order2 := order1
+	if !cancelOrder(&order1, "node_1") {
+		t.Fatal("confirmed order was not cancelled")
+	}
+	merge(&order2, order1, "node_2", allNodes[:2])
+	merge(&order1, order2, "node_1", allNodes[:2])
+	merge(&order2, order1, "node_2", allNodes[:2])
+	if order1.State != datatypes.Inactive || order2.State != datatypes.Inactive {
+		t.Fatalf("withdrawal not completed: %v, %v", order1.State, order2.State)
+	}
+
+	// The stale pending order of node_3 isn't taken on by the others
+	if merge(&order1, stale, "node_1", allNodes); order1.State != datatypes.Inactive {
+		t.Errorf("stale pending order taken on by node_1, state %v", order1.State)
+	}
+
+	// node_3 drops its stale pending order
+	newInactive, _ := merge(&stale, order1, "node_3", allNodes)
+	if stale.State != datatypes.Inactive || !newInactive {
+		t.Errorf("node_3 kept its stale order, state %v", stale.State)
+	}
+	if stale.Generation != order1.Generation {
+		t.Errorf("node_3 is at generation %d, want %d", stale.Generation, order1.Generation)
+	}
+}
+
+func TestStalePendingNotResurrectedWhenRejoining(t *testing.T) {
+	orders := map[datatypes.NodeID]*datatypes.Req{
+		"node_1": {State: datatypes.Inactive, Generation: 2},
+		"node_2": {State: datatypes.Inactive, Generation: 2},
+		"node_3": {State: datatypes.PendingAck, AckBy: []datatypes.NodeID{"node_3"}, Generation: 1},
+	}
+
+	mergeAll(orders)
+
+	for currID, pOrder := range orders {
+		if pOrder.State != datatypes.Inactive {
+			t.Errorf("order of %s is %v after rejoining, want Inactive", currID, pOrder.State)
+		}
+	}
+}
+
+func TestStaleConfirmedNotResurrected(t *testing.T) {
+	order := datatypes.Req{State: datatypes.Confirmed, AckBy: allNodes, Generation: 1}
+	tombstone := order
+	cancelOrder(&tombstone, "node_1")
+
+	// A stale copy of the cancelled order is ignored by the tombstone
+	merge(&tombstone, order, "node_1", allNodes)
+	if tombstone.State != datatypes.Cancelled {
+		t.Fatalf("tombstone is %v after meeting a stale copy, want Cancelled", tombstone.State)
+	}
+
+	// ... and is withdrawn by it
+	if newInactive, _ := merge(&order, tombstone, "node_2", allNodes); order.State != datatypes.Cancelled || !newInactive {
+		t.Errorf("stale copy is %v after meeting the tombstone, want Cancelled", order.State)
+	}
+}
+
+func TestPressAfterCancellation(t *testing.T) {
+	order := datatypes.Req{State: datatypes.Confirmed, AckBy: allNodes, Generation: 1}
+	tombstone := order
+	cancelOrder(&tombstone, "node_1")
+
+	// node_2 completes the withdrawal, and is pressed again before node_1 hears of it
+	pressed := datatypes.Req{State: datatypes.Inactive, Generation: tombstone.Generation}
+	pressOrder(&pressed, "node_2")
+
+	// The new press isn't withdrawn by the older cancellation
+	if merge(&pressed, tombstone, "node_2", allNodes); pressed.State != datatypes.PendingAck {
+		t.Errorf("new press is %v after meeting the tombstone, want PendingAck", pressed.State)
+	}
+
+	// ... and replaces the tombstone
+	if merge(&tombstone, pressed, "node_1", allNodes); tombstone.State != datatypes.PendingAck {
+		t.Errorf("tombstone is %v after meeting the new press, want PendingAck", tombstone.State)
+	}
+	if tombstone.Generation != pressed.Generation {
+		t.Errorf("node_1 is at generation %d, want %d", tombstone.Generation, pressed.Generation)
+	}
+}
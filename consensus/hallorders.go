@@ -3,18 +3,23 @@ package consensus
 import (
 	"../datatypes"
 	"../elevio"
+	"context"
 	"fmt"
+	"time"
 )
 
 // HallOrderChannels ...
 // Channels used for communication related to consensus of hall orders with other modules
 type HallOrderChannels struct {
 	NewOrderChan        chan elevio.ButtonEvent
-	CompletedOrderChan  chan int
+	CompletedOrderChan  chan elevio.ButtonEvent
 	ConfirmedOrdersChan chan datatypes.ConfirmedHallOrdersMatrix
 	LocalOrdersChan     chan datatypes.HallOrdersMatrix
 	RemoteOrdersChan    chan datatypes.HallOrdersMatrix
 	PeerlistUpdateChan  chan []datatypes.NodeID
+	PartitionUpdateChan chan datatypes.PartitionStatus
+	RecallChan          chan bool
+	CancelOrderChan     chan elevio.ButtonEvent
 }
 
 // LocalHallOrdersMsg ...
@@ -24,6 +29,35 @@ type LocalHallOrdersMsg struct {
 	HallOrders datatypes.HallOrdersMatrix
 }
 
+// cancelHallOrders ...
+// Sets all pending and confirmed hall orders to Inactive and clears their lights
+// @return: true if any orders were cancelled
+func cancelHallOrders(
+	localHallOrders *datatypes.HallOrdersMatrix,
+	TurnOffHallLightChan chan<- elevio.ButtonEvent) bool {
+
+	cancelledFlag := false
+
+	for floor := range localHallOrders {
+		for orderType := range localHallOrders[floor] {
+			currState := (*localHallOrders)[floor][orderType].State
+			if currState != datatypes.PendingAck && currState != datatypes.Confirmed {
+				continue
+			}
+
+			(*localHallOrders)[floor][orderType] = datatypes.Req{
+				State:      datatypes.Inactive,
+				AckBy:      nil,
+				Generation: (*localHallOrders)[floor][orderType].Generation,
+			}
+			clearHallLight(floor, elevio.ButtonType(orderType), TurnOffHallLightChan)
+			cancelledFlag = true
+		}
+	}
+
+	return cancelledFlag
+}
+
 // updateConfirmedHallOrders ...
 // Updated the boolean matrix of confirmed hall orders,
 // where only confirmed hall orders are set to true
@@ -42,25 +76,80 @@ func updateConfirmedHallOrders(
 	}
 }
 
+// ForgetInactiveHallOrders ...
+// Sets all inactive (and cancelled) hall orders to Unknown, so that they never override
+// orders confirmed by other nodes (when alone on the network, or losing the majority)
+func ForgetInactiveHallOrders(localHallOrders *datatypes.HallOrdersMatrix) {
+	for floor := range localHallOrders {
+		for orderType := range localHallOrders[floor] {
+
+			currState := (*localHallOrders)[floor][orderType].State
+			if currState == datatypes.Inactive || currState == datatypes.Cancelled {
+				(*localHallOrders)[floor][orderType] = datatypes.Req{
+					State:      datatypes.Unknown,
+					AckBy:      nil,
+					Generation: (*localHallOrders)[floor][orderType].Generation,
+				}
+			}
+		}
+	}
+}
+
+// MergeHallOrders ...
+// Merges the world view of the remote hall orders with the local hall orders, order by order (see merge)
+// @return: The hall orders set to Inactive, and the hall orders set to Confirmed
+func MergeHallOrders(
+	localHallOrders *datatypes.HallOrdersMatrix,
+	remoteHallOrders datatypes.HallOrdersMatrix,
+	localID datatypes.NodeID,
+	peerlist []datatypes.NodeID) (datatypes.ConfirmedHallOrdersMatrix, datatypes.ConfirmedHallOrdersMatrix) {
+
+	var newInactive, newConfirmed datatypes.ConfirmedHallOrdersMatrix
+
+	for floor := range localHallOrders {
+		for orderType := range localHallOrders[floor] {
+			newInactive[floor][orderType], newConfirmed[floor][orderType] = merge(
+				&(*localHallOrders)[floor][orderType], remoteHallOrders[floor][orderType], localID, peerlist)
+		}
+	}
+
+	return newInactive, newConfirmed
+}
+
 // HallOrdersModule ...
 // Handles the information distribution for hall orders between nodes.
 // Keeps track of which orders are currently confirmed by all nodes, which orders that are still pending acknowledgement,
 // and which orders that are completed (Inactive). Only confirmed orders are passed along to the optimal assigner, making
 // sure that all nodes agree on the distribution of all of the orders at all times.
+// All hall orders are cancelled during a fire recall.
+// A hall order is withdrawn when its button is pressed twice within cancelWindow
+// (0 disables double-press cancellation), or when cancelled through the API.
 func HallOrdersModule(
+	ctx context.Context,
+	heartbeat <-chan struct{},
 	localID datatypes.NodeID,
 	NewOrderChan <-chan elevio.ButtonEvent,
 	ConfirmedOrdersChan chan<- datatypes.ConfirmedHallOrdersMatrix,
-	CompletedOrderChan <-chan int,
+	CompletedOrderChan <-chan elevio.ButtonEvent,
 	TurnOffHallLightChan chan<- elevio.ButtonEvent,
 	TurnOnHallLightChan chan<- elevio.ButtonEvent,
 	LocalOrdersChan chan<- datatypes.HallOrdersMatrix,
 	RemoteOrdersChan <-chan datatypes.HallOrdersMatrix,
-	PeerlistUpdateChan <-chan []datatypes.NodeID) {
+	PeerlistUpdateChan <-chan []datatypes.NodeID,
+	minorityPolicy datatypes.MinorityPolicy,
+	PartitionUpdateChan <-chan datatypes.PartitionStatus,
+	RecallChan <-chan bool,
+	CancelOrderChan <-chan elevio.ButtonEvent,
+	cancelWindow time.Duration) error {
 
 	// Initialize variables
 	// ----
 	peerlist := []datatypes.NodeID{}
+	inMajority := true
+	recallActive := false
+
+	// When each hall button was last pressed on this node, used for detecting double presses
+	var lastPressed [elevio.NumFloors][2]time.Time
 
 	// All orders will be initialized to Unknown
 	// (due to Golang's zero-state initialization)
@@ -96,35 +185,83 @@ func HallOrdersModule(
 				break
 			}
 
+			// Leave hall orders to the majority partition if restricted to cab orders
+			// (Otherwise the same hall order might be served on both sides of a partition)
+			if !inMajority && minorityPolicy == datatypes.ServeCabOnly {
+				break
+			}
+
+			// Don't accept hall orders during a fire recall
+			if recallActive {
+				break
+			}
+
 			// Set order to pendingAck
 			// (Make sure to never access elements outside of array)
-			if a.Button == elevio.BT_HallUp || a.Button == elevio.BT_HallDown {
+			if a.Button != elevio.BT_HallUp && a.Button != elevio.BT_HallDown {
+				break
+			}
 
-				localHallOrders[a.Floor][a.Button] = datatypes.Req{
-					State: datatypes.PendingAck,
-					AckBy: []datatypes.NodeID{localID},
+			// A second press within cancelWindow withdraws the order (e.g. a mis-press)
+			if cancelWindow > 0 && time.Since(lastPressed[a.Floor][a.Button]) < cancelWindow {
+				lastPressed[a.Floor][a.Button] = time.Time{}
+
+				if cancelOrder(&localHallOrders[a.Floor][a.Button], localID) {
+					fmt.Printf("(consensus:hallorders) Hall order at floor %d (type %d) cancelled by double press\n",
+						a.Floor, a.Button)
+					clearHallLight(a.Floor, a.Button, TurnOffHallLightChan)
+
+					updateConfirmedHallOrders(localHallOrders, &confirmedHallOrders)
+					ConfirmedOrdersChan <- confirmedHallOrders
+					LocalOrdersChan <- localHallOrders
 				}
+				break
+			}
+			lastPressed[a.Floor][a.Button] = time.Now()
 
-				// Send updates to network module
-				LocalOrdersChan <- localHallOrders
+			// (A press after a cancellation is newer than it, and isn't withdrawn)
+			pressOrder(&localHallOrders[a.Floor][a.Button], localID)
 
+			// Send updates to network module
+			LocalOrdersChan <- localHallOrders
+
+		// Withdraw a hall order cancelled through the API
+		// (Only in the majority partition, which owns the hall orders)
+		case a := <-CancelOrderChan:
+			if len(peerlist) <= 1 || !inMajority {
+				fmt.Println("(consensus:hallorders) Hall orders can only be cancelled in the majority partition")
+				break
+			}
+			if a.Button != elevio.BT_HallUp && a.Button != elevio.BT_HallDown {
+				break
+			}
+			if !cancelOrder(&localHallOrders[a.Floor][a.Button], localID) {
+				break
 			}
 
+			fmt.Printf("(consensus:hallorders) Hall order at floor %d (type %d) cancelled\n", a.Floor, a.Button)
+			clearHallLight(a.Floor, a.Button, TurnOffHallLightChan)
+
+			updateConfirmedHallOrders(localHallOrders, &confirmedHallOrders)
+			ConfirmedOrdersChan <- confirmedHallOrders
+			LocalOrdersChan <- localHallOrders
+
 		// Clear lights, mark completed orders as inactive and update network module
 		// and optimalAssigner with all confirmedHallOrders when orders are completed
+		// (Only the completed direction is cleared, the FSM decides which directions are served)
 		case a := <-CompletedOrderChan:
 
-			clearHallLights(a, TurnOffHallLightChan)
+			if a.Button != elevio.BT_HallUp && a.Button != elevio.BT_HallDown {
+				break
+			}
+
+			clearHallLight(a.Floor, a.Button, TurnOffHallLightChan)
 
-			// Set both dir Up and dir Down to inactive
-			inactiveReq := datatypes.Req{
+			localHallOrders[a.Floor][a.Button] = datatypes.Req{
 				State: datatypes.Inactive,
 				// Delete ackBy list when transitioning to inactive
-				AckBy: nil,
-			}
-			localHallOrders[a] = [2]datatypes.Req{
-				inactiveReq,
-				inactiveReq,
+				AckBy:      nil,
+				Generation: localHallOrders[a.Floor][a.Button].Generation,
 			}
 
 			updateConfirmedHallOrders(localHallOrders, &confirmedHallOrders)
@@ -140,21 +277,39 @@ func HallOrdersModule(
 
 			peerlist = UniqueIDSlice(a)
 
-			// Set all inactive hall orders to unknown if alone on network
+			// Set all inactive (and cancelled) hall orders to unknown if alone on network
 			if len(peerlist) <= 1 {
-				for floor := range localHallOrders {
-					for orderType := range localHallOrders[floor] {
+				ForgetInactiveHallOrders(&localHallOrders)
 
-						if localHallOrders[floor][orderType].State == datatypes.Inactive {
-							localHallOrders[floor][orderType].State = datatypes.Unknown
-						}
-					}
-				}
+				// Inform network module that changes have been made
+				LocalOrdersChan <- localHallOrders
+			}
+
+		// Received changes in partition status from network module
+		// Set all inactive (and cancelled) hall orders to unknown when losing the majority
+		// (Otherwise they would override orders confirmed by the majority
+		// when the partition heals)
+		case a := <-PartitionUpdateChan:
+			lostMajority := inMajority && !a.Majority
+			inMajority = a.Majority
+
+			if lostMajority {
+				ForgetInactiveHallOrders(&localHallOrders)
 
 				// Inform network module that changes have been made
 				LocalOrdersChan <- localHallOrders
 			}
 
+		// Cancel all hall orders when a fire recall is activated
+		case a := <-RecallChan:
+			recallActive = a
+
+			if recallActive && cancelHallOrders(&localHallOrders, TurnOffHallLightChan) {
+				updateConfirmedHallOrders(localHallOrders, &confirmedHallOrders)
+				ConfirmedOrdersChan <- confirmedHallOrders
+				LocalOrdersChan <- localHallOrders
+			}
+
 		// Merge received remoteHallOrders from network module with local data in localHallOrders
 		case a := <-RemoteOrdersChan:
 
@@ -163,25 +318,29 @@ func HallOrdersModule(
 			confirmedOrdersChangedFlag := false
 
 			// Merge world views for every order in HallOrder matrix
+			newInactive, newConfirmed := MergeHallOrders(&localHallOrders, remoteHallOrders, localID, peerlist)
 			for floor := range localHallOrders {
 				for orderType := range localHallOrders[floor] {
 
-					pLocal := &localHallOrders[floor][orderType]
-					remote := remoteHallOrders[floor][orderType]
-
-					newInactiveFlag, newConfirmedFlag := merge(pLocal, remote, localID, peerlist)
+					newInactiveFlag := newInactive[floor][orderType]
+					newConfirmedFlag := newConfirmed[floor][orderType]
 
 					// Make flag stay true if set to true once
 					confirmedOrdersChangedFlag = confirmedOrdersChangedFlag || newInactiveFlag || newConfirmedFlag
 
 					if newInactiveFlag {
-						clearHallLights(floor, TurnOffHallLightChan)
+						clearHallLight(floor, elevio.ButtonType(orderType), TurnOffHallLightChan)
 					} else if newConfirmedFlag {
 						setHallLight(floor, orderType, TurnOnHallLightChan)
 					}
 				}
 			}
 
+			// Keep cancelling orders from nodes that haven't seen the fire recall yet
+			if recallActive && cancelHallOrders(&localHallOrders, TurnOffHallLightChan) {
+				confirmedOrdersChangedFlag = true
+			}
+
 			// Only update confirmedHallOrders when orders are changed to Inactive or Confirmed
 			if confirmedOrdersChangedFlag {
 				updateConfirmedHallOrders(localHallOrders, &confirmedHallOrders)
@@ -190,6 +349,11 @@ func HallOrdersModule(
 
 			// Update network module with new data
 			LocalOrdersChan <- localHallOrders
+
+		case <-heartbeat:
+
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 }
@@ -1,6 +1,7 @@
 package consensus
 
 import (
+	"../datatypes"
 	"../elevio"
 )
 
@@ -14,20 +15,14 @@ func setHallLight(currFloor int, orderType int, TurnOnHallLightChan chan<- elevi
 	TurnOnHallLightChan <- buttonToIlluminate
 }
 
-func clearHallLights(currFloor int, TurnOffHallLightChan chan<- elevio.ButtonEvent) {
+func clearHallLight(currFloor int, orderType elevio.ButtonType, TurnOffHallLightChan chan<- elevio.ButtonEvent) {
 
-	callUpAtFloor := elevio.ButtonEvent{
-		Floor:  currFloor,
-		Button: elevio.BT_HallUp,
-	}
-
-	callDownAtFloor := elevio.ButtonEvent{
+	buttonToClear := elevio.ButtonEvent{
 		Floor:  currFloor,
-		Button: elevio.BT_HallDown,
+		Button: orderType,
 	}
 
-	TurnOffHallLightChan <- callDownAtFloor
-	TurnOffHallLightChan <- callUpAtFloor
+	TurnOffHallLightChan <- buttonToClear
 }
 
 func setCabLight(currFloor int, TurnOnCabLightChan chan<- elevio.ButtonEvent) {
@@ -49,3 +44,20 @@ func clearCabLight(currFloor int, TurnOffCabLightChan chan<- elevio.ButtonEvent)
 
 	TurnOffCabLightChan <- buttonToClear
 }
+
+func announceDestination(
+	origin int,
+	destination int,
+	car datatypes.NodeID,
+	DestinationDisplayChan chan<- elevio.DestinationAnnouncement,
+	ApiAnnouncementChan chan<- elevio.DestinationAnnouncement) {
+
+	announcement := elevio.DestinationAnnouncement{
+		Origin:      origin,
+		Destination: destination,
+		Car:         string(car),
+	}
+
+	DestinationDisplayChan <- announcement
+	ApiAnnouncementChan <- announcement
+}
@@ -0,0 +1,152 @@
+package consensus
+
+import (
+	"../datatypes"
+	"context"
+	"fmt"
+)
+
+// RecallChannels ...
+// Channels used for communication related to consensus of the fire recall with other modules
+type RecallChannels struct {
+	CommandChan         chan bool
+	LocalRecallChan     chan datatypes.Req
+	RemoteRecallChan    chan datatypes.Req
+	PeerlistUpdateChan  chan []datatypes.NodeID
+	PartitionUpdateChan chan datatypes.PartitionStatus
+}
+
+// LocalRecallMsg ...
+// Used for broadcasting localRecall to other nodes
+type LocalRecallMsg struct {
+	ID     datatypes.NodeID
+	Recall datatypes.Req
+}
+
+// announceRecall ...
+// Informs the modules affected by the fire recall whether it is active
+func announceRecall(recallActive bool, RecallChans ...chan<- bool) {
+	for _, RecallChan := range RecallChans {
+		RecallChan <- recallActive
+	}
+}
+
+// RecallModule ...
+// Handles the information distribution for the group-wide fire recall between nodes.
+// The recall is a single request following the same consensus logic as the orders:
+// Activating it sets it to PendingAck, and it is only regarded as active by the other
+// modules once it is Confirmed, making sure that all nodes agree on it.
+// The recall stays active until it is explicitly reset, which sets it to Inactive.
+// (A recall can only be reset from the majority partition, as the reset would otherwise
+// cancel the recall of the majority when the partition heals)
+func RecallModule(
+	ctx context.Context,
+	heartbeat <-chan struct{},
+	localID datatypes.NodeID,
+	CommandChan <-chan bool,
+	LocalRecallChan chan<- datatypes.Req,
+	RemoteRecallChan <-chan datatypes.Req,
+	PeerlistUpdateChan <-chan []datatypes.NodeID,
+	PartitionUpdateChan <-chan datatypes.PartitionStatus,
+	FsmRecallChan chan<- bool,
+	HallRecallChan chan<- bool,
+	CabRecallChan chan<- bool,
+	DestinationRecallChan chan<- bool,
+	ApiRecallChan chan<- bool) error {
+
+	// Initialize variables
+	// ----
+	peerlist := []datatypes.NodeID{}
+	inMajority := true
+
+	// The recall will be initialized to Unknown
+	// (due to Golang's zero-state initialization)
+	var localRecall datatypes.Req
+	recallActive := false
+
+	// Send initialized variable to network module
+	LocalRecallChan <- localRecall
+
+	fmt.Println("(consensus:recall) Initialized")
+
+	// Logic for handling consensus when new data enters system
+	// ------
+	for {
+
+		select {
+
+		// Activate (true) or reset (false) the recall and update network module
+		case a := <-CommandChan:
+			pending := localRecall.State == datatypes.PendingAck || localRecall.State == datatypes.Confirmed
+
+			if a && !pending {
+				localRecall = datatypes.Req{
+					State: datatypes.PendingAck,
+					AckBy: []datatypes.NodeID{localID},
+				}
+				fmt.Println("(consensus:recall) Fire recall requested")
+
+			} else if !a && localRecall.State == datatypes.Confirmed {
+				if !inMajority {
+					fmt.Println("(consensus:recall) Fire recall can't be reset from a minority partition")
+					break
+				}
+
+				localRecall = datatypes.Req{
+					State: datatypes.Inactive,
+					AckBy: nil,
+				}
+				fmt.Println("(consensus:recall) Fire recall reset")
+			}
+
+			// Send updates to network module
+			LocalRecallChan <- localRecall
+
+		// Received changes in peerlist from network module
+		// Set an inactive recall to unknown if alone on network
+		case a := <-PeerlistUpdateChan:
+			peerlist = UniqueIDSlice(a)
+
+			if len(peerlist) <= 1 && localRecall.State == datatypes.Inactive {
+				localRecall.State = datatypes.Unknown
+				LocalRecallChan <- localRecall
+			}
+
+		// Received changes in partition status from network module
+		// Set an inactive recall to unknown when losing the majority
+		case a := <-PartitionUpdateChan:
+			lostMajority := inMajority && !a.Majority
+			inMajority = a.Majority
+
+			if lostMajority && localRecall.State == datatypes.Inactive {
+				localRecall.State = datatypes.Unknown
+				LocalRecallChan <- localRecall
+			}
+
+		// Merge received remoteRecall from network module with local data
+		case a := <-RemoteRecallChan:
+			merge(&localRecall, a, localID, peerlist)
+
+			// Update network module with new data
+			LocalRecallChan <- localRecall
+
+		case <-heartbeat:
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		// Inform the other modules when the recall is activated or reset
+		if (localRecall.State == datatypes.Confirmed) != recallActive {
+			recallActive = localRecall.State == datatypes.Confirmed
+
+			if recallActive {
+				fmt.Println("(consensus:recall) Fire recall active")
+			} else {
+				fmt.Println("(consensus:recall) Fire recall inactive")
+			}
+			announceRecall(recallActive, FsmRecallChan, HallRecallChan, CabRecallChan,
+				DestinationRecallChan, ApiRecallChan)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package datatypes
 
 import (
 	"../elevio"
+	"time"
 )
 
 // -------------
@@ -34,6 +35,16 @@ const (
 	// MovingState ...
 	// Node is moving.
 	MovingState
+
+	// ParkingState ...
+	// Node is moving to its parking floor without any orders.
+	// (Parking is cancelled as soon as the node is assigned an order)
+	ParkingState
+
+	// RecallState ...
+	// Node is returning nonstop to the recall floor during a fire recall, or is
+	// standing there with the doors open. (The node is not assigned any orders)
+	RecallState
 )
 
 // NodeDir ...
@@ -47,12 +58,115 @@ const (
 	Down
 )
 
+// TrafficMode ...
+// The traffic pattern the group of nodes is dispatching for.
+type TrafficMode int
+
+// Possible traffic modes
+const (
+	// NormalTraffic ...
+	// No dominating traffic pattern.
+	NormalTraffic TrafficMode = iota
+
+	// UpPeakTraffic ...
+	// Most passengers travel up from the lobby (e.g. in the morning).
+	UpPeakTraffic
+
+	// DownPeakTraffic ...
+	// Most passengers travel down to the lobby (e.g. in the evening).
+	DownPeakTraffic
+)
+
+// NodeMode ...
+// The administrative mode of a node.
+type NodeMode int
+
+// Possible node modes
+const (
+	// NormalMode ...
+	// Node serves hall orders and cab orders.
+	NormalMode NodeMode = iota
+
+	// OutOfServiceMode ...
+	// Node is taken out of service for maintenance.
+	// (Its hall orders are handed off to the other nodes, while it finishes its cab orders)
+	OutOfServiceMode
+
+	// IndependentMode ...
+	// Node is reserved, only serving its own cab orders.
+	// (The doors are kept open until a cab button is pressed)
+	IndependentMode
+)
+
+// FaultType ...
+// The fault last diagnosed on a node, reported as the health of the node.
+type FaultType int
+
+// Possible faults
+const (
+	// NoFault ...
+	// Node is healthy.
+	NoFault FaultType = iota
+
+	// MotorStallFault ...
+	// Node didn't arrive at a floor within the motor timeout, and is between floors.
+	MotorStallFault
+
+	// StuckSensorFault ...
+	// Node didn't arrive at a floor within the motor timeout, while the floor sensor
+	// still shows a floor. (The sensor is stuck on, or the car never left the floor)
+	StuckSensorFault
+
+	// WrongDirectionFault ...
+	// Node arrived at a floor behind it, travelling in the wrong direction.
+	WrongDirectionFault
+
+	// SkippedFloorFault ...
+	// Node arrived at a floor without passing the floors in between.
+	SkippedFloorFault
+
+	// ArrivedWhileStoppedFault ...
+	// Node arrived at another floor while the motor was stopped.
+	ArrivedWhileStoppedFault
+
+	// RepeatedTimeoutFault ...
+	// Node has had too many motor timeouts within a short time.
+	RepeatedTimeoutFault
+
+	// HardwareLostFault ...
+	// Node has lost the connection to its elevator, and doesn't know its position.
+	HardwareLostFault
+)
+
 // NodeState ...
 // Contains all the state information of a node
+// (Traffic is the traffic mode detected or scheduled by the node,
+// Load is the load of the car as a share of its capacity, and Fault is the health of the node)
 type NodeState struct {
 	Behaviour NodeBehaviour
 	Floor     int
 	Dir       NodeDir
+	Traffic   TrafficMode
+	Mode      NodeMode
+	Load      float64
+	Fault     FaultType
+
+	// The hall and destination orders the node is committed to, as assigned by its own
+	// order assigner (Shared so that all nodes agree on which node an order is kept with)
+	HallOrders        ConfirmedHallOrdersMatrix
+	DestinationOrders ConfirmedDestinationOrdersMatrix
+
+	// The peers the node suspects to be marginal
+	// (Shared so that a peer is only demoted when all the other nodes agree)
+	Suspects []NodeID
+}
+
+// ParkingTarget ...
+// Where an idle node should be parked (Floor -1: stay), and how long it
+// has to be idle first
+type ParkingTarget struct {
+	Floor int
+	Delay time.Duration
 }
 
 // AllNodeStatesMap ...
@@ -67,9 +181,12 @@ type AllNodeStatesMap map[NodeID]NodeState
 // Req ...
 // Holds the level of consensus of a single order request on the network
 // (both consensus state and all informed nodes)
+// The generation is increased by every new press and every cancellation of the order,
+// so that a cancellation only withdraws the orders placed before it.
 type Req struct {
-	State ReqState
-	AckBy []NodeID
+	State      ReqState
+	AckBy      []NodeID
+	Generation int
 }
 
 // ReqState ...
@@ -96,6 +213,13 @@ const (
 	// 	The order is confirmed by all nodes on the network and is
 	//	ready to be served by a node.
 	Confirmed
+
+	//	Cancelled ...
+	//	The order has been withdrawn before it was served, and is
+	//	pending acknowledgement of the withdrawal from the other nodes.
+	//	(Kept as a tombstone until all nodes have acknowledged it, so that
+	//	stale pending or confirmed copies of older generations can't bring the order back)
+	Cancelled
 )
 
 // HallOrdersMatrix ...
@@ -128,7 +252,121 @@ type ConfirmedCabOrdersList []bool
 // Contains one confirmed list for each node currently in the system.
 type ConfirmedCabOrdersMap map[NodeID]ConfirmedCabOrdersList
 
+// DestinationOrdersMatrix ...
+// Used to represent all the destination orders and their state on the network,
+// indexed by the origin floor and the destination floor of the order.
+type DestinationOrdersMatrix [elevio.NumFloors][elevio.NumFloors]Req
+
+// ConfirmedDestinationOrdersMatrix ...
+// Equivalent logic to that of ConfirmedHallOrdersMatrix.
+type ConfirmedDestinationOrdersMatrix [elevio.NumFloors][elevio.NumFloors]bool
+
+// DestinationAssignmentMatrix ...
+// Contains the node assigned to each confirmed destination order (the car
+// the passengers should board), and an empty NodeID for all other orders.
+type DestinationAssignmentMatrix [elevio.NumFloors][elevio.NumFloors]NodeID
+
 // AssignedOrdersMatrix ...
 // Contains all the orders assigned to the current elevator, both
 // hall orders and cab orders, as boolean values.
 type AssignedOrdersMatrix [elevio.NumFloors][3]bool
+
+// HallETA ...
+// The car assigned to a confirmed hall order, and the time it is estimated to arrive
+// (An empty Car means that there is no estimate for the order)
+type HallETA struct {
+	Car     NodeID
+	Arrival time.Time
+}
+
+// ReassignmentsMatrix ...
+// Counts how many times each confirmed hall order has been moved to another node
+type ReassignmentsMatrix [elevio.NumFloors][2]int
+
+// HallETAsMatrix ...
+// Contains the estimated time of arrival of every confirmed hall order.
+type HallETAsMatrix [elevio.NumFloors][2]HallETA
+
+// -------------
+// Network Datatypes
+// -------------
+
+// MinorityPolicy ...
+// Decides which orders a node is allowed to serve while it is part of a
+// minority partition of the network.
+type MinorityPolicy int
+
+const (
+	// ServeCabOnly ...
+	// Only serve cab orders while in minority, leaving all hall orders
+	// to the majority partition.
+	ServeCabOnly MinorityPolicy = iota
+
+	// ServeAll ...
+	// Keep serving both hall and cab orders while in minority.
+	// (Hall orders confirmed on both sides of a partition might be served twice)
+	ServeAll
+)
+
+// PartitionStatus ...
+// Describes the partition of the network the node currently is a part of.
+// Majority is true if the visible peers form a quorum of all the nodes known
+// to the group, in which case the partition owns the hall orders.
+type PartitionStatus struct {
+	Majority   bool
+	Peers      []NodeID
+	KnownNodes []NodeID
+}
+
+// PeerHealth ...
+// Liveness statistics of a single peer, as seen by the local node.
+// A Suspect peer is still in peerlist, but is marginal and should be
+// demoted before it eventually gets declared lost (once the other nodes agree).
+type PeerHealth struct {
+	Phi      float64
+	LossRate float64
+	Jitter   time.Duration
+	Suspect  bool
+}
+
+// PeerHealthMap ...
+// Holds the health of all the peers currently visible on the network
+type PeerHealthMap map[NodeID]PeerHealth
+
+// ModuleStatus ...
+// The state of a module run by the supervisor.
+type ModuleStatus int
+
+// Possible module states
+const (
+	// ModuleRunning ...
+	// Module is running, and its loop answers the heartbeats of the supervisor.
+	ModuleRunning ModuleStatus = iota
+
+	// ModuleStalled ...
+	// Module is running, but its loop hasn't answered a heartbeat within the stall timeout.
+	// (Typically blocked on a channel send to a module that never reads it)
+	ModuleStalled
+
+	// ModuleRestarting ...
+	// Module failed, and is waiting to be restarted.
+	ModuleRestarting
+
+	// ModuleStopped ...
+	// Module has returned after the node was shut down.
+	ModuleStopped
+)
+
+// ModuleHealth ...
+// Health of a single module of the node, as seen by the supervisor.
+// Since is the time the module entered its current Status.
+type ModuleHealth struct {
+	Status    ModuleStatus
+	Since     time.Time
+	Restarts  int
+	LastError string
+}
+
+// ModuleHealthMap ...
+// Holds the health of all the modules of the node, by module name
+type ModuleHealthMap map[string]ModuleHealth
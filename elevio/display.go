@@ -0,0 +1,75 @@
+package elevio
+
+import (
+	"fmt"
+	"time"
+)
+
+// DestinationEvent ...
+// A destination call entered on a lobby keypad. Contains both the floor the
+// passenger is waiting at and the floor the passenger wants to go to.
+type DestinationEvent struct {
+	Origin      int
+	Destination int
+}
+
+// DestinationAnnouncement ...
+// Tells the passengers of a destination call which car to board.
+// (An empty Car means that the call is served, and the announcement should be removed)
+type DestinationAnnouncement struct {
+	Origin      int
+	Destination int
+	Car         string
+}
+
+// SetDestinationDisplay ...
+// Shows which car the passengers of a destination call should board on the
+// display at the origin floor.
+// (The elevator hardware has no such display, so the announcement is printed instead)
+func (drv *Driver) SetDestinationDisplay(a DestinationAnnouncement) {
+	if a.Car == "" {
+		fmt.Printf("(elevio) Display floor %d of %s: clear floor %d\n", a.Origin, drv.addr, a.Destination)
+		return
+	}
+	fmt.Printf("(elevio) Display floor %d of %s: floor %d, board %s\n", a.Origin, drv.addr, a.Destination, a.Car)
+}
+
+// ETAAnnouncement ...
+// Tells the passengers of a hall order which car is coming, and when it is estimated to arrive.
+// (An empty Car means that there is no estimate, and the announcement should be removed)
+type ETAAnnouncement struct {
+	Floor  int
+	Button ButtonType
+	Car    string
+	ETA    time.Duration
+}
+
+// SetETADisplay ...
+// Shows which car is coming to the hall order, and when it is estimated to arrive, on
+// the display at the floor of the order.
+// (The elevator hardware has no such display, so the announcement is printed instead)
+func (drv *Driver) SetETADisplay(a ETAAnnouncement) {
+	dir := "up"
+	if a.Button == BT_HallDown {
+		dir = "down"
+	}
+
+	if a.Car == "" {
+		fmt.Printf("(elevio) Display floor %d of %s: clear %s\n", a.Floor, drv.addr, dir)
+		return
+	}
+	fmt.Printf("(elevio) Display floor %d of %s: %s, car %s in ~%d s\n", a.Floor, drv.addr, dir, a.Car,
+		int(a.ETA.Round(time.Second)/time.Second))
+}
+
+// SetDirectionIndicator ...
+// Announces the direction the elevator will depart in to the passengers waiting at the floor
+// (The elevator hardware has no direction indicator, so the announcement is printed instead)
+func (drv *Driver) SetDirectionIndicator(dir MotorDirection) {
+	switch dir {
+	case MD_Up:
+		fmt.Println("(elevio) Direction indicator of", drv.addr+": going up")
+	case MD_Down:
+		fmt.Println("(elevio) Direction indicator of", drv.addr+": going down")
+	}
+}
@@ -1,7 +1,9 @@
 package elevio
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net"
 	"sync"
 	"time"
@@ -20,11 +22,54 @@ import (
 // Will be used to initialize size of matrices for the different types defined in 'datatypes.go'
 const NumFloors int = 4
 
-const _pollRate = 20 * time.Millisecond
+// Time allowed for a single command to the elevator server
+const _ioTimeout = 500 * time.Millisecond
 
-var _initialized = false
-var _mtx sync.Mutex
-var _conn net.Conn
+// Limits of the time between attempts to reconnect to the elevator server
+const _minBackoff = 100 * time.Millisecond
+const _maxBackoff = 5 * time.Second
+
+// Commands reading the inputs of the elevator
+// (Commands 10 to 12 are not part of the standard elevator server protocol)
+const (
+	_cmdButton       = 6
+	_cmdFloor        = 7
+	_cmdStop         = 8
+	_cmdObstruction  = 9
+	_cmdLoad         = 10
+	_cmdSubscribe    = 11 // Asks the server to notify changes of the inputs (no reply)
+	_cmdNotification = 12 // A change of an input, sent by the server without being asked
+)
+
+// Largest number of commands sent at once (all the inputs read in a single poll cycle)
+const _maxBatchSize = 3*NumFloors + 3
+
+// Driver ...
+// The connection to the elevator server of a single car
+// (A process running several cars has a driver for each of them)
+type Driver struct {
+	mtx        sync.Mutex
+	conn       net.Conn
+	addr       string
+	pollConfig PollConfig
+
+	// Replies to the commands sent on the current connection, in the order the commands were sent
+	replies chan [4]byte
+
+	// Changes of the inputs notified by the elevator server (PollConfig.Notify)
+	notifications chan [4]byte
+
+	// Signals the ConnectionHandler that the connection was lost
+	lostChan chan struct{}
+
+	// The outputs last set, restored after reconnecting
+	outputs struct {
+		lamps          [NumFloors][3]bool
+		floorIndicator int
+		doorOpen       bool
+		stopLamp       bool
+	}
+}
 
 // MotorDirection ...
 // Data type for holding the direction of the elevator motor
@@ -59,151 +104,322 @@ type ButtonEvent struct {
 	Button ButtonType
 }
 
-// Init ...
-// Connects to the elevator hardware or the elevator simulator through TCP
-func Init(addr string) {
-	if _initialized {
-		fmt.Println("Driver already initialized!")
-		return
+// NewDriver ...
+// Connects to the elevator hardware or the elevator simulator of a car through TCP, with the
+// inputs read as given by pollConfig
+// (If the elevator server is not up, the connection is established by the ConnectionHandler)
+// @return: The driver of the car
+func NewDriver(addr string, pollConfig PollConfig) *Driver {
+	drv := &Driver{
+		addr:          addr,
+		pollConfig:    pollConfig,
+		notifications: make(chan [4]byte, 64),
+		lostChan:      make(chan struct{}, 1),
 	}
-	_mtx = sync.Mutex{}
-	var err error
-	_conn, err = net.Dial("tcp", addr)
+	if err := drv.connect(); err != nil {
+		fmt.Println("(elevio) Could not connect to", addr+":", err)
+	}
+	return drv
+}
+
+// connect ...
+// Connects to the elevator server, replacing any previous connection
+// @return: An error if the elevator server could not be reached
+func (drv *Driver) connect() error {
+	conn, err := net.DialTimeout("tcp", drv.addr, _ioTimeout)
 	if err != nil {
-		panic(err.Error())
+		return err
+	}
+
+	drv.mtx.Lock()
+	defer drv.mtx.Unlock()
+	drv.conn = conn
+	drv.replies = make(chan [4]byte, _maxBatchSize)
+	go drv.readMessages(conn, drv.replies)
+
+	// Forget that any previous connection was lost
+	select {
+	case <-drv.lostChan:
+	default:
 	}
-	_initialized = true
+
+	// Ask the elevator server to notify all changes of the inputs on this connection
+	if drv.pollConfig.Notify {
+		drv.writeLocked([4]byte{_cmdSubscribe, 1, 0, 0})
+	}
+	return nil
 }
 
-// SetMotorDirection ...
-// Sets the direction of the physical motor
-func SetMotorDirection(dir MotorDirection) {
-	_mtx.Lock()
-	defer _mtx.Unlock()
-	_conn.Write([]byte{1, byte(dir), 0, 0})
+// readMessages ...
+// Reads all messages from the elevator server on the connection, passing the notifications
+// to the poller and the replies to the commands waiting for them
+func (drv *Driver) readMessages(conn net.Conn, replies chan<- [4]byte) {
+	for {
+		var buf [4]byte
+		if _, err := io.ReadFull(conn, buf[:]); err != nil {
+			drv.mtx.Lock()
+			if drv.conn == conn {
+				drv.dropConnection(err)
+			}
+			drv.mtx.Unlock()
+			return
+		}
+
+		// (Messages are dropped if nobody is keeping up, the inputs are polled again anyway)
+		if buf[0] == _cmdNotification {
+			select {
+			case drv.notifications <- buf:
+			default:
+			}
+			continue
+		}
+		select {
+		case replies <- buf:
+		default:
+		}
+	}
 }
 
-// SetButtonLamp ...
-// Ignites the lamp on a button
-func SetButtonLamp(button ButtonType, floor int, value bool) {
-	_mtx.Lock()
-	defer _mtx.Unlock()
-	_conn.Write([]byte{2, byte(button), byte(floor), toByte(value)})
+// dropConnection ...
+// Closes the connection after an I/O error, and lets the ConnectionHandler reconnect
+// (Must be called with drv.mtx held)
+func (drv *Driver) dropConnection(err error) {
+	fmt.Println("(elevio) Connection to", drv.addr, "lost:", err)
+	drv.conn.Close()
+	drv.conn = nil
+
+	select {
+	case drv.lostChan <- struct{}{}:
+	default:
+	}
 }
 
-// SetFloorIndicator ...
-// Ignites the lamp indicating the current floor
-func SetFloorIndicator(floor int) {
-	_mtx.Lock()
-	defer _mtx.Unlock()
-	_conn.Write([]byte{3, byte(floor), 0, 0})
+// write ...
+// Sends a command to the elevator server
+// @return: false if there is no connection to the elevator server
+func (drv *Driver) write(cmd [4]byte) bool {
+	drv.mtx.Lock()
+	defer drv.mtx.Unlock()
+	return drv.writeLocked(cmd)
 }
 
-// SetDoorOpenLamp ...
-// Ignites the lamp representing that the door is open
-func SetDoorOpenLamp(value bool) {
-	_mtx.Lock()
-	defer _mtx.Unlock()
-	_conn.Write([]byte{4, toByte(value), 0, 0})
+// writeLocked ...
+// Same as write, but must be called with drv.mtx held
+func (drv *Driver) writeLocked(cmd [4]byte) bool {
+	if drv.conn == nil {
+		return false
+	}
+
+	drv.conn.SetWriteDeadline(time.Now().Add(_ioTimeout))
+	if _, err := drv.conn.Write(cmd[:]); err != nil {
+		drv.dropConnection(err)
+		return false
+	}
+	return true
 }
 
-// SetStopLamp ...
-// Ignites the red 'stop' button
-func SetStopLamp(value bool) {
-	_mtx.Lock()
-	defer _mtx.Unlock()
-	_conn.Write([]byte{5, toByte(value), 0, 0})
+// query ...
+// Sends a command to the elevator server and reads the reply
+// @return: The reply, and false if there is no connection to the elevator server
+func (drv *Driver) query(cmd [4]byte) ([4]byte, bool) {
+	replies, ok := drv.queryBatch([][4]byte{cmd})
+	if !ok {
+		return [4]byte{}, false
+	}
+	return replies[0], true
 }
 
-func pollButtons(receiver chan<- ButtonEvent) {
-	prev := make([][3]bool, NumFloors)
-	for {
-		time.Sleep(_pollRate)
-		for f := 0; f < NumFloors; f++ {
-			for b := ButtonType(0); b < 3; b++ {
-				v := getButton(b, f)
-				if v != prev[f][b] && v != false {
-					receiver <- ButtonEvent{f, ButtonType(b)}
-				}
-				prev[f][b] = v
+// queryBatch ...
+// Sends all the commands to the elevator server at once, and then reads all the replies
+// (A single round trip instead of one per command).
+// The replies start with their commands, anything else means the connection is out of sync.
+// @return: The replies in the order of the commands, and false if there is no connection
+// to the elevator server
+func (drv *Driver) queryBatch(cmds [][4]byte) ([][4]byte, bool) {
+	drv.mtx.Lock()
+	defer drv.mtx.Unlock()
+
+	if drv.conn == nil {
+		return nil, false
+	}
+
+	msg := make([]byte, 0, 4*len(cmds))
+	for _, cmd := range cmds {
+		msg = append(msg, cmd[:]...)
+	}
+	drv.conn.SetWriteDeadline(time.Now().Add(_ioTimeout))
+	if _, err := drv.conn.Write(msg); err != nil {
+		drv.dropConnection(err)
+		return nil, false
+	}
+
+	timeout := time.NewTimer(_ioTimeout)
+	defer timeout.Stop()
+
+	replies := make([][4]byte, len(cmds))
+	for i, cmd := range cmds {
+		select {
+		case reply := <-drv.replies:
+			if reply[0] != cmd[0] {
+				drv.dropConnection(fmt.Errorf("unexpected reply %v to command %v", reply, cmd))
+				return nil, false
 			}
+			replies[i] = reply
+
+		case <-timeout.C:
+			drv.dropConnection(fmt.Errorf("no reply to command %v", cmd))
+			return nil, false
 		}
 	}
+	return replies, true
 }
 
-func pollFloorSensor(receiver chan<- int) {
-	prev := -1
-	for {
-		time.Sleep(_pollRate)
-		v := getFloor()
-		if v != prev && v != -1 {
-			receiver <- v
+// restoreOutputs ...
+// Sets the lamps of a reconnected elevator to their last known values, and stops the motor
+// (The FSM reinitializes the elevator, as its position is unknown)
+func (drv *Driver) restoreOutputs() {
+	drv.mtx.Lock()
+	outputs := drv.outputs
+	drv.mtx.Unlock()
+
+	drv.write([4]byte{1, byte(MD_Stop), 0, 0})
+	for floor := range outputs.lamps {
+		for button := range outputs.lamps[floor] {
+			drv.write([4]byte{2, byte(button), byte(floor), toByte(outputs.lamps[floor][button])})
 		}
-		prev = v
 	}
+	drv.write([4]byte{3, byte(outputs.floorIndicator), 0, 0})
+	drv.write([4]byte{4, toByte(outputs.doorOpen), 0, 0})
+	drv.write([4]byte{5, toByte(outputs.stopLamp), 0, 0})
 }
 
-func pollStopButton(receiver chan<- bool) {
-	prev := false
-	for {
-		time.Sleep(_pollRate)
-		v := getStop()
-		if v != prev {
-			receiver <- v
+// ConnectionHandler ...
+// Reconnects to the elevator server whenever the connection is lost, waiting longer
+// between every attempt (up to _maxBackoff).
+// Tells the FSM whenever the connection to the elevator is lost (false) or regained (true).
+// The connection is closed when ctx is cancelled.
+func (drv *Driver) ConnectionHandler(
+	ctx context.Context,
+	heartbeat <-chan struct{},
+	ConnectedChan chan<- bool) error {
+
+	drv.mtx.Lock()
+	connected := drv.conn != nil
+	drv.mtx.Unlock()
+
+	// Reconnection attempts are only scheduled while disconnected
+	backoff := _minBackoff
+	var retry <-chan time.Time
+	if !connected {
+		retry = time.After(backoff)
+		select {
+		case ConnectedChan <- false:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-		prev = v
 	}
-}
 
-func pollObstructionSwitch(receiver chan<- bool) {
-	prev := false
 	for {
-		time.Sleep(_pollRate)
-		v := getObstruction()
-		if v != prev {
-			receiver <- v
+		select {
+		case <-drv.lostChan:
+			backoff = _minBackoff
+			retry = time.After(backoff)
+			select {
+			case ConnectedChan <- false:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+		case <-retry:
+			if err := drv.connect(); err != nil {
+				backoff *= 2
+				if backoff > _maxBackoff {
+					backoff = _maxBackoff
+				}
+				retry = time.After(backoff)
+				break
+			}
+
+			fmt.Println("(elevio) Connected to", drv.addr)
+			drv.restoreOutputs()
+			retry = nil
+			select {
+			case ConnectedChan <- true:
+			case <-ctx.Done():
+				drv.close()
+				return ctx.Err()
+			}
+
+		case <-heartbeat:
+
+		case <-ctx.Done():
+			drv.close()
+			return ctx.Err()
 		}
-		prev = v
 	}
 }
 
-func getButton(button ButtonType, floor int) bool {
-	_mtx.Lock()
-	defer _mtx.Unlock()
-	_conn.Write([]byte{6, byte(button), byte(floor), 0})
-	var buf [4]byte
-	_conn.Read(buf[:])
-	return toBool(buf[1])
+// close ...
+// Closes the connection to the elevator server, leaving the outputs as they are
+func (drv *Driver) close() {
+	drv.mtx.Lock()
+	defer drv.mtx.Unlock()
+	if drv.conn != nil {
+		drv.conn.Close()
+		drv.conn = nil
+	}
 }
 
-func getFloor() int {
-	_mtx.Lock()
-	defer _mtx.Unlock()
-	_conn.Write([]byte{7, 0, 0, 0})
-	var buf [4]byte
-	_conn.Read(buf[:])
-	if buf[1] != 0 {
-		return int(buf[2])
-	}
-	return -1
+// SetMotorDirection ...
+// Sets the direction of the physical motor
+func (drv *Driver) SetMotorDirection(dir MotorDirection) {
+	drv.write([4]byte{1, byte(dir), 0, 0})
 }
 
-func getStop() bool {
-	_mtx.Lock()
-	defer _mtx.Unlock()
-	_conn.Write([]byte{8, 0, 0, 0})
-	var buf [4]byte
-	_conn.Read(buf[:])
-	return toBool(buf[1])
+// SetButtonLamp ...
+// Ignites the lamp on a button
+func (drv *Driver) SetButtonLamp(button ButtonType, floor int, value bool) {
+	drv.mtx.Lock()
+	drv.outputs.lamps[floor][button] = value
+	drv.mtx.Unlock()
+	drv.write([4]byte{2, byte(button), byte(floor), toByte(value)})
 }
 
-func getObstruction() bool {
-	_mtx.Lock()
-	defer _mtx.Unlock()
-	_conn.Write([]byte{9, 0, 0, 0})
-	var buf [4]byte
-	_conn.Read(buf[:])
-	return toBool(buf[1])
+// SetFloorIndicator ...
+// Ignites the lamp indicating the current floor
+func (drv *Driver) SetFloorIndicator(floor int) {
+	drv.mtx.Lock()
+	drv.outputs.floorIndicator = floor
+	drv.mtx.Unlock()
+	drv.write([4]byte{3, byte(floor), 0, 0})
+}
+
+// SetDoorOpenLamp ...
+// Ignites the lamp representing that the door is open
+func (drv *Driver) SetDoorOpenLamp(value bool) {
+	drv.mtx.Lock()
+	drv.outputs.doorOpen = value
+	drv.mtx.Unlock()
+	drv.write([4]byte{4, toByte(value), 0, 0})
+}
+
+// SetStopLamp ...
+// Ignites the red 'stop' button
+func (drv *Driver) SetStopLamp(value bool) {
+	drv.mtx.Lock()
+	drv.outputs.stopLamp = value
+	drv.mtx.Unlock()
+	drv.write([4]byte{5, toByte(value), 0, 0})
+}
+
+// GetFloor ...
+// @return: The floor shown by the floor sensor, -1 if between floors (or unknown)
+func (drv *Driver) GetFloor() int {
+	reply, ok := drv.query([4]byte{_cmdFloor, 0, 0, 0})
+	if !ok || reply[1] == 0 {
+		return -1
+	}
+	return int(reply[2])
 }
 
 func toByte(a bool) byte {
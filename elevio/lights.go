@@ -1,46 +1,64 @@
 package elevio
 
+import "context"
+
 // LightsChannels ...
 // Channels used for communication with the Elevator LightHandler
 type LightsChannels struct {
-	TurnOffLightsChan    chan ButtonEvent
-	TurnOnLightsChan     chan ButtonEvent
-	FloorIndicatorChan   chan int
-	TurnOffHallLightChan chan ButtonEvent
-	TurnOnHallLightChan  chan ButtonEvent
-	TurnOffCabLightChan  chan ButtonEvent
-	TurnOnCabLightChan   chan ButtonEvent
+	TurnOffLightsChan      chan ButtonEvent
+	TurnOnLightsChan       chan ButtonEvent
+	FloorIndicatorChan     chan int
+	TurnOffHallLightChan   chan ButtonEvent
+	TurnOnHallLightChan    chan ButtonEvent
+	TurnOffCabLightChan    chan ButtonEvent
+	TurnOnCabLightChan     chan ButtonEvent
+	DestinationDisplayChan chan DestinationAnnouncement
+	ETADisplayChan         chan ETAAnnouncement
 }
 
 // LightHandler ...
 // GoRoutine for controlling the lights of a single elevator
 func LightHandler(
+	ctx context.Context,
+	heartbeat <-chan struct{},
+	drv *Driver,
 	numFloors int,
 	TurnOffHallLight <-chan ButtonEvent,
 	TurnOnHallLight <-chan ButtonEvent,
 	TurnOffCabLight <-chan ButtonEvent,
 	TurnOnCabLight <-chan ButtonEvent,
-	FloorIndicator <-chan int) {
+	FloorIndicator <-chan int,
+	DestinationDisplay <-chan DestinationAnnouncement,
+	ETADisplay <-chan ETAAnnouncement) error {
 
 	// Turn off all lights at init
 	for floor := 0; floor < numFloors; floor++ {
 		for orderType := BT_HallUp; orderType <= BT_Cab; orderType++ {
-			SetButtonLamp(orderType, floor, false)
+			drv.SetButtonLamp(orderType, floor, false)
 		}
 	}
 
 	for {
 		select {
 		case a := <-TurnOffHallLight:
-			SetButtonLamp(a.Button, a.Floor, false)
+			drv.SetButtonLamp(a.Button, a.Floor, false)
 		case a := <-TurnOnHallLight:
-			SetButtonLamp(a.Button, a.Floor, true)
+			drv.SetButtonLamp(a.Button, a.Floor, true)
 		case a := <-TurnOffCabLight:
-			SetButtonLamp(a.Button, a.Floor, false)
+			drv.SetButtonLamp(a.Button, a.Floor, false)
 		case a := <-TurnOnCabLight:
-			SetButtonLamp(a.Button, a.Floor, true)
+			drv.SetButtonLamp(a.Button, a.Floor, true)
 		case a := <-FloorIndicator:
-			SetFloorIndicator(a)
+			drv.SetFloorIndicator(a)
+		case a := <-DestinationDisplay:
+			drv.SetDestinationDisplay(a)
+		case a := <-ETADisplay:
+			drv.SetETADisplay(a)
+
+		case <-heartbeat:
+
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 
 	}
@@ -0,0 +1,49 @@
+package elevio
+
+import (
+	"context"
+	"time"
+)
+
+// Time between readings of the load-weighing input
+const _loadPollRate = 100 * time.Millisecond
+
+// getLoad ...
+// @return: The load of the car as a share of its capacity, read from the load-weighing input,
+// and false if there is no connection to the elevator server
+// (_cmdLoad is not part of the standard elevator server protocol, and must be answered
+// by the hardware server with the load in percent)
+func (drv *Driver) getLoad() (float64, bool) {
+	buf, ok := drv.query([4]byte{_cmdLoad, 0, 0, 0})
+	return float64(buf[1]) / 100, ok
+}
+
+// LoadReader ...
+// Reads the load-weighing input of the car, passing on every change of the load
+// (Only started if the car has a load-weighing input)
+func LoadReader(ctx context.Context, heartbeat <-chan struct{}, drv *Driver, LoadChan chan<- float64) error {
+	pollTicker := time.NewTicker(_loadPollRate)
+	defer pollTicker.Stop()
+
+	prev := -1.0
+	for {
+		select {
+		case <-pollTicker.C:
+
+		case <-heartbeat:
+			continue
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		v, ok := drv.getLoad()
+		if !ok {
+			continue
+		}
+		if v != prev {
+			LoadChan <- v
+		}
+		prev = v
+	}
+}
@@ -0,0 +1,196 @@
+package elevio
+
+import (
+	"context"
+	"time"
+)
+
+// PollConfig ...
+// How the inputs of the elevator are read
+type PollConfig struct {
+	// Time between readings of the buttons, the stop button and the obstruction switch
+	PollRate time.Duration
+
+	// Time between readings of the floor sensor (at most PollRate)
+	FloorPollRate time.Duration
+
+	// Let the elevator server notify all changes of the inputs, only reading all inputs
+	// every PollRate to recover lost notifications.
+	// (Not supported by the standard elevator server, see applyNotification)
+	Notify bool
+}
+
+// inputState ...
+// The inputs last read, used for passing on only the changes
+type inputState struct {
+	buttons     [NumFloors][3]bool
+	floor       int
+	stop        bool
+	obstruction bool
+}
+
+// updateButton ...
+// Passes on the button being pressed (unless ctx is cancelled first)
+func updateButton(ctx context.Context, state *inputState, button ButtonType, floor int, pressed bool,
+	receiver chan<- ButtonEvent) {
+
+	if pressed && !state.buttons[floor][button] {
+		select {
+		case receiver <- ButtonEvent{floor, button}:
+		case <-ctx.Done():
+		}
+	}
+	state.buttons[floor][button] = pressed
+}
+
+// updateFloor ...
+// Passes on the arrival at a new floor (-1: between floors)
+func updateFloor(ctx context.Context, state *inputState, floor int, receiver chan<- int) {
+	if floor != state.floor && floor != -1 {
+		select {
+		case receiver <- floor:
+		case <-ctx.Done():
+		}
+	}
+	state.floor = floor
+}
+
+// updateSwitch ...
+// Passes on any change of a switch (the stop button or the obstruction switch)
+func updateSwitch(ctx context.Context, prev *bool, value bool, receiver chan<- bool) {
+	if value != *prev {
+		select {
+		case receiver <- value:
+		case <-ctx.Done():
+		}
+	}
+	*prev = value
+}
+
+// floorFromReply ...
+// @return: The floor in a reply of the floor sensor, -1 if between floors
+func floorFromReply(reply [4]byte) int {
+	if reply[1] != 0 {
+		return int(reply[2])
+	}
+	return -1
+}
+
+// applyNotification ...
+// Passes on a change of an input notified by the elevator server. The notifications are
+//
+//	[_cmdNotification, button type (0-2), floor, pressed]
+//	[_cmdNotification, 3, at floor, floor]
+//	[_cmdNotification, 4, stop, 0]
+//	[_cmdNotification, 5, obstruction, 0]
+func applyNotification(
+	ctx context.Context,
+	state *inputState,
+	notification [4]byte,
+	buttons chan<- ButtonEvent,
+	floors chan<- int,
+	obstruction chan<- bool,
+	stop chan<- bool) {
+
+	switch input := notification[1]; {
+
+	case input <= BT_Cab:
+		floor := int(notification[2])
+		if floor < NumFloors {
+			updateButton(ctx, state, ButtonType(input), floor, toBool(notification[3]), buttons)
+		}
+
+	case input == 3:
+		floor := -1
+		if notification[2] != 0 {
+			floor = int(notification[3])
+		}
+		updateFloor(ctx, state, floor, floors)
+
+	case input == 4:
+		updateSwitch(ctx, &state.stop, toBool(notification[2]), stop)
+
+	case input == 5:
+		updateSwitch(ctx, &state.obstruction, toBool(notification[2]), obstruction)
+	}
+}
+
+// pollInputs ...
+// Reads the inputs of the elevator, passing on the changes.
+// All inputs due in a poll cycle are read with a single batch of commands. The floor sensor
+// is read every FloorPollRate, and first in every batch, as arriving at a floor is the most
+// time critical input. The other inputs are only read every PollRate.
+// With notifications, the inputs are passed on as soon as they change, and all inputs are
+// read every PollRate. (The readings are skipped while there is no connection to the elevator server)
+// Returns when ctx is cancelled.
+func (drv *Driver) pollInputs(
+	ctx context.Context,
+	buttons chan<- ButtonEvent,
+	floors chan<- int,
+	obstruction chan<- bool,
+	stop chan<- bool) {
+
+	pollConfig := drv.pollConfig
+	state := inputState{floor: -1}
+
+	period := pollConfig.FloorPollRate
+	if pollConfig.Notify {
+		period = pollConfig.PollRate
+	}
+	fullPollEvery := int(pollConfig.PollRate / period)
+	if fullPollEvery < 1 {
+		fullPollEvery = 1
+	}
+
+	pollTicker := time.NewTicker(period)
+	defer pollTicker.Stop()
+	cycle := 0
+
+	for {
+		select {
+		case a := <-drv.notifications:
+			applyNotification(ctx, &state, a, buttons, floors, obstruction, stop)
+			continue
+
+		case <-pollTicker.C:
+
+		case <-ctx.Done():
+			return
+		}
+
+		fullPoll := cycle%fullPollEvery == 0
+		cycle++
+
+		cmds := [][4]byte{{_cmdFloor, 0, 0, 0}}
+		if fullPoll {
+			cmds = append(cmds, [4]byte{_cmdStop, 0, 0, 0}, [4]byte{_cmdObstruction, 0, 0, 0})
+			for f := 0; f < NumFloors; f++ {
+				for b := ButtonType(0); b < 3; b++ {
+					cmds = append(cmds, [4]byte{_cmdButton, byte(b), byte(f), 0})
+				}
+			}
+		}
+
+		replies, ok := drv.queryBatch(cmds)
+		if !ok {
+			// (The floor is reported again once reconnected)
+			state.floor = -1
+			continue
+		}
+
+		updateFloor(ctx, &state, floorFromReply(replies[0]), floors)
+		if !fullPoll {
+			continue
+		}
+
+		updateSwitch(ctx, &state.stop, toBool(replies[1][1]), stop)
+		updateSwitch(ctx, &state.obstruction, toBool(replies[2][1]), obstruction)
+		i := 3
+		for f := 0; f < NumFloors; f++ {
+			for b := ButtonType(0); b < 3; b++ {
+				updateButton(ctx, &state, b, f, toBool(replies[i][1]), buttons)
+				i++
+			}
+		}
+	}
+}
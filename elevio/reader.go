@@ -1,26 +1,32 @@
 package elevio
 
 import (
+	"context"
 	"fmt"
 )
 
 // IOReader ...
 // Main routine for reading io values and passing them on to the corresponding channels
+// (The inputs are polled until the reader returns)
 func IOReader(
+	ctx context.Context,
+	heartbeat <-chan struct{},
+	drv *Driver,
 	NewHallOrderChan chan<- ButtonEvent,
 	NewCabOrderChan chan<- int,
 	ArrivedAtFloorChan chan<- int,
-	FloorIndicatorChan chan<- int) {
+	FloorIndicatorChan chan<- int,
+	KeySwitchChan chan<- bool,
+	ObstructionChan chan<- bool) error {
 
 	drvButtons := make(chan ButtonEvent)
 	drvFloors := make(chan int)
 	drvObstr := make(chan bool)
 	drvStop := make(chan bool)
 
-	go pollButtons(drvButtons)
-	go pollFloorSensor(drvFloors)
-	go pollObstructionSwitch(drvObstr)
-	go pollStopButton(drvStop)
+	pollCtx, stopPolling := context.WithCancel(ctx)
+	defer stopPolling()
+	go drv.pollInputs(pollCtx, drvButtons, drvFloors, drvObstr, drvStop)
 
 	for {
 		select {
@@ -38,9 +44,17 @@ func IOReader(
 
 		case a := <-drvObstr:
 			fmt.Printf("(elevio) Obstruction: %+v\n", a)
+			ObstructionChan <- a
 
+		// The stop button is used as the key switch of independent service
 		case a := <-drvStop:
 			fmt.Printf("(elevio) Stop: %+v\n", a)
+			KeySwitchChan <- a
+
+		case <-heartbeat:
+
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 }
@@ -0,0 +1,197 @@
+package eta
+
+import (
+	"../datatypes"
+	"../elevio"
+	"context"
+	"fmt"
+	"time"
+)
+
+// ETAMsg ...
+// Used for broadcasting the estimated times of arrival of the hall orders assigned to
+// the local node. The arrivals are sent as the time remaining (negative: no estimate),
+// as the clocks of the nodes may differ.
+type ETAMsg struct {
+	ID        datatypes.NodeID
+	Remaining [elevio.NumFloors][2]time.Duration
+}
+
+// Channels ...
+// Used for communication between this module and other modules
+type Channels struct {
+	LocalETAsChan  chan datatypes.HallETAsMatrix
+	RemoteETAsChan chan ETAMsg
+}
+
+// Estimates not refreshed by the node within this time are dropped
+const etaTimeout = 1 * time.Second
+
+// Time between updates of the API and the displays
+const updatePeriod = 200 * time.Millisecond
+
+// A display is only updated when the estimate changes by more than this
+// (The displays count down by themselves)
+const displayTolerance = 2 * time.Second
+
+// storedETAs ...
+// The estimates received from a single node, and when they were received
+type storedETAs struct {
+	ETAs       datatypes.HallETAsMatrix
+	ReceivedAt time.Time
+}
+
+// NewETAMsg ...
+// @return: The message broadcasting the given estimates of the local node
+func NewETAMsg(localID datatypes.NodeID, etas datatypes.HallETAsMatrix) ETAMsg {
+	msg := ETAMsg{ID: localID}
+	now := time.Now()
+
+	for floor := range etas {
+		for orderType := range etas[floor] {
+			msg.Remaining[floor][orderType] = -1
+			if etas[floor][orderType].Car == "" {
+				continue
+			}
+
+			remaining := etas[floor][orderType].Arrival.Sub(now)
+			if remaining < 0 {
+				remaining = 0
+			}
+			msg.Remaining[floor][orderType] = remaining
+		}
+	}
+
+	return msg
+}
+
+// arrivals ...
+// @return: The estimates of the message as arrival times on the local clock
+func arrivals(msg ETAMsg, receivedAt time.Time) datatypes.HallETAsMatrix {
+	var etas datatypes.HallETAsMatrix
+
+	for floor := range msg.Remaining {
+		for orderType := range msg.Remaining[floor] {
+			if msg.Remaining[floor][orderType] < 0 {
+				continue
+			}
+			etas[floor][orderType] = datatypes.HallETA{
+				Car:     msg.ID,
+				Arrival: receivedAt.Add(msg.Remaining[floor][orderType]),
+			}
+		}
+	}
+
+	return etas
+}
+
+// combineETAs ...
+// @return: The estimates of all nodes combined, keeping the earliest arrival if more
+// than one node estimates the same hall order (e.g. while an order is being reassigned)
+func combineETAs(allETAs map[datatypes.NodeID]storedETAs) datatypes.HallETAsMatrix {
+	var combined datatypes.HallETAsMatrix
+
+	for _, currETAs := range allETAs {
+		for floor := range currETAs.ETAs {
+			for orderType := range currETAs.ETAs[floor] {
+				currETA := currETAs.ETAs[floor][orderType]
+				if currETA.Car == "" {
+					continue
+				}
+
+				prevETA := combined[floor][orderType]
+				if prevETA.Car == "" || currETA.Arrival.Before(prevETA.Arrival) ||
+					(currETA.Arrival.Equal(prevETA.Arrival) && currETA.Car < prevETA.Car) {
+					combined[floor][orderType] = currETA
+				}
+			}
+		}
+	}
+
+	return combined
+}
+
+// displayChanged ...
+// @return: true if the display showing prevETA should be updated to show currETA
+func displayChanged(prevETA datatypes.HallETA, currETA datatypes.HallETA) bool {
+	if prevETA.Car != currETA.Car {
+		return true
+	}
+	if currETA.Car == "" {
+		return false
+	}
+
+	diff := currETA.Arrival.Sub(prevETA.Arrival)
+	return diff > displayTolerance || diff < -displayTolerance
+}
+
+// Handler ...
+// Keeps the estimated times of arrival of all confirmed hall orders, as broadcast by
+// the nodes assigned to them, and passes them on to the control API.
+// If displayETAs is set, the estimates are also shown on the displays at the floors.
+func Handler(
+	ctx context.Context,
+	heartbeat <-chan struct{},
+	RemoteETAsChan <-chan ETAMsg,
+	ApiETAsChan chan<- datatypes.HallETAsMatrix,
+	DisplayChan chan<- elevio.ETAAnnouncement,
+	displayETAs bool) error {
+
+	allETAs := make(map[datatypes.NodeID]storedETAs)
+	var displayedETAs datatypes.HallETAsMatrix
+
+	updateTicker := time.NewTicker(updatePeriod)
+	defer updateTicker.Stop()
+
+	fmt.Println("(eta) Initialized")
+
+	for {
+		select {
+
+		// Replace the estimates of the sending node
+		case a := <-RemoteETAsChan:
+			now := time.Now()
+			allETAs[a.ID] = storedETAs{
+				ETAs:       arrivals(a, now),
+				ReceivedAt: now,
+			}
+
+		case <-updateTicker.C:
+			// Drop the estimates of nodes that are lost, or no longer broadcasting
+			for currID, currETAs := range allETAs {
+				if time.Since(currETAs.ReceivedAt) > etaTimeout {
+					delete(allETAs, currID)
+				}
+			}
+
+			currETAs := combineETAs(allETAs)
+			ApiETAsChan <- currETAs
+
+			if !displayETAs {
+				break
+			}
+
+			for floor := range currETAs {
+				for orderType := range currETAs[floor] {
+					currETA := currETAs[floor][orderType]
+					if !displayChanged(displayedETAs[floor][orderType], currETA) {
+						continue
+					}
+
+					displayedETAs[floor][orderType] = currETA
+					DisplayChan <- elevio.ETAAnnouncement{
+						Floor:  floor,
+						Button: elevio.ButtonType(orderType),
+						Car:    string(currETA.Car),
+						ETA:    time.Until(currETA.Arrival),
+					}
+				}
+			}
+
+		case <-heartbeat:
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package fsm
+
+import (
+	"../config"
+	"../datatypes"
+	"fmt"
+	"time"
+)
+
+// faultDetector ...
+// Keeps track of the faults diagnosed on the node
+type faultDetector struct {
+	// The fault reported as the health of the node (NoFault if healthy)
+	fault datatypes.FaultType
+
+	// Times of the motor timeouts within the timeout window
+	timeouts []time.Time
+}
+
+// motorRunning ...
+// @return: true if the node has started the motor and should arrive at a floor, false otherwise
+func motorRunning(behaviour datatypes.NodeBehaviour, atRecallFloor bool) bool {
+	switch behaviour {
+	case datatypes.InitState, datatypes.MovingState, datatypes.ParkingState:
+		return true
+	case datatypes.RecallState:
+		return !atRecallFloor
+	}
+	return false
+}
+
+// arrivalFault ...
+// Checks the arrival at newFloor from prevFloor (-1: unknown) against the motor.
+// @return: The fault shown by the arrival, or NoFault if the arrival is as expected
+func arrivalFault(
+	prevFloor int,
+	newFloor int,
+	running bool,
+	currDir datatypes.NodeDir) datatypes.FaultType {
+
+	if prevFloor == -1 || newFloor == prevFloor {
+		return datatypes.NoFault
+	}
+	if !running {
+		return datatypes.ArrivedWhileStoppedFault
+	}
+	if (newFloor > prevFloor) != (currDir == datatypes.Up) {
+		return datatypes.WrongDirectionFault
+	}
+	if newFloor-prevFloor > 1 || prevFloor-newFloor > 1 {
+		return datatypes.SkippedFloorFault
+	}
+	return datatypes.NoFault
+}
+
+// timeoutFault ...
+// Registers a motor timeout, classified by the floor shown by the floor sensor (-1: between floors).
+// @return: The fault shown by the timeout, RepeatedTimeoutFault if there have been
+// MaxTimeouts timeouts within TimeoutWindow
+func timeoutFault(
+	detector *faultDetector,
+	sensorFloor int,
+	now time.Time,
+	faultsConfig config.Faults) datatypes.FaultType {
+
+	recent := []time.Time{}
+	for _, timeout := range detector.timeouts {
+		if now.Sub(timeout) < faultsConfig.TimeoutWindow.Duration {
+			recent = append(recent, timeout)
+		}
+	}
+	detector.timeouts = append(recent, now)
+
+	if len(detector.timeouts) >= faultsConfig.MaxTimeouts {
+		return datatypes.RepeatedTimeoutFault
+	}
+	if sensorFloor != -1 {
+		return datatypes.StuckSensorFault
+	}
+	return datatypes.MotorStallFault
+}
+
+// Descriptions of the faults, used when logging
+var faultDescriptions = map[datatypes.FaultType]string{
+	datatypes.MotorStallFault:          "motor stalled between floors",
+	datatypes.StuckSensorFault:         "floor sensor stuck on, or the car never left the floor",
+	datatypes.WrongDirectionFault:      "travelling in the wrong direction",
+	datatypes.SkippedFloorFault:        "skipped a floor",
+	datatypes.ArrivedWhileStoppedFault: "arrived at a floor with the motor stopped",
+	datatypes.RepeatedTimeoutFault:     "repeated motor timeouts",
+	datatypes.HardwareLostFault:        "connection to the elevator lost",
+}
+
+// registerFault ...
+// Reports the fault as the health of the node, and restarts the time until it is cleared.
+// (A repeated timeout is not replaced by a single timeout until it is cleared)
+// @return: true if the fault was registered, false if it was NoFault
+func registerFault(
+	detector *faultDetector,
+	fault datatypes.FaultType,
+	currFloor int,
+	faultTimer *time.Timer,
+	faultsConfig config.Faults) bool {
+
+	if fault == datatypes.NoFault {
+		return false
+	}
+
+	fmt.Printf("(fsm) Fault at floor %d: %s\n", currFloor, faultDescriptions[fault])
+
+	if detector.fault != datatypes.RepeatedTimeoutFault ||
+		fault == datatypes.RepeatedTimeoutFault {
+		detector.fault = fault
+	}
+	faultTimer.Reset(faultsConfig.ClearAfter.Duration)
+	return true
+}
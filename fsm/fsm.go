@@ -1,8 +1,10 @@
 package fsm
 
 import (
+	"../config"
 	"../datatypes"
 	"../elevio"
+	"context"
 	"fmt"
 	"time"
 )
@@ -12,6 +14,17 @@ import (
 type Channels struct {
 	ArrivedAtFloorChan          chan int
 	ToggleNetworkVisibilityChan chan bool
+	ParkingTargetChan           chan datatypes.ParkingTarget
+	RecallChan                  chan bool
+	ModeChan                    chan datatypes.NodeMode
+	KeySwitchChan               chan bool
+	LoadSensorChan              chan float64
+	ObstructionChan             chan bool
+	HandoverChan                chan datatypes.ConfirmedHallOrdersMatrix
+	HardwareChan                chan bool
+	ShutdownChan                chan struct{}
+	DepartureChan               chan datatypes.ConfirmedHallOrdersMatrix
+	DepartedChan                chan struct{}
 }
 
 // hasOrders ...
@@ -27,17 +40,18 @@ func hasOrders(assignedOrders datatypes.AssignedOrdersMatrix) bool {
 	return false
 }
 
-// hasOrdersAtFloor ...
-// @return: true if the node has an order at the given floor, false otherwise
-func hasOrderAtFloor(
-	assignedOrders datatypes.AssignedOrdersMatrix,
-	floor int) bool {
-	for orderType := elevio.BT_HallUp; orderType <= elevio.BT_Cab; orderType++ {
-		if assignedOrders[floor][orderType] {
-			return true
+// relinquishHallOrders ...
+// Removes all hall orders from the assigned orders, keeping the cab orders.
+// @return: The hall orders removed
+func relinquishHallOrders(assignedOrders *datatypes.AssignedOrdersMatrix) datatypes.ConfirmedHallOrdersMatrix {
+	var hallOrders datatypes.ConfirmedHallOrdersMatrix
+	for floor := range assignedOrders {
+		for _, hallType := range []elevio.ButtonType{elevio.BT_HallUp, elevio.BT_HallDown} {
+			hallOrders[floor][hallType] = assignedOrders[floor][hallType]
+			assignedOrders[floor][hallType] = false
 		}
 	}
-	return false
+	return hallOrders
 }
 
 // transmitState ...
@@ -46,12 +60,18 @@ func transmitState(
 	currState datatypes.NodeBehaviour,
 	currFloor int,
 	currDir datatypes.NodeDir,
+	mode datatypes.NodeMode,
+	load float64,
+	fault datatypes.FaultType,
 	LocalNodeStateChan chan<- datatypes.NodeState) {
 
 	currNodeState := datatypes.NodeState{
 		Behaviour: currState,
 		Floor:     currFloor,
 		Dir:       currDir,
+		Mode:      mode,
+		Load:      load,
+		Fault:     fault,
 	}
 	LocalNodeStateChan <- currNodeState
 }
@@ -108,14 +128,20 @@ func calculateDirection(
 // @return: true if there is a cab order or a hall order (in the same direction a
 // the elevator is currently moving) in the given floor, or if there
 // are no orders ahead in the direction the elevator is moving.
+// (Hall orders are bypassed if the node doesn't serve hall orders)
 func shouldStopAtFloor(
 	currFloor int,
 	numFloors int,
 	currDir datatypes.NodeDir,
-	assignedOrders datatypes.AssignedOrdersMatrix) bool {
+	assignedOrders datatypes.AssignedOrdersMatrix,
+	servesHall bool) bool {
 
 	for orderType := elevio.BT_HallUp; orderType <= elevio.BT_Cab; orderType++ {
 
+		if orderType != elevio.BT_Cab && !servesHall {
+			continue
+		}
+
 		if orderType == elevio.BT_HallUp && currDir == datatypes.Down {
 			continue
 		} else if orderType == elevio.BT_HallDown && currDir == datatypes.Up {
@@ -129,40 +155,229 @@ func shouldStopAtFloor(
 	return !ordersAhead(assignedOrders, currFloor, currDir)
 }
 
+// hallOrderInDir ...
+// @return: The hall order type of passengers travelling in the given direction
+func hallOrderInDir(currDir datatypes.NodeDir) elevio.ButtonType {
+	if currDir == datatypes.Up {
+		return elevio.BT_HallUp
+	}
+	return elevio.BT_HallDown
+}
+
+// oppositeDir ...
+// @return: The direction opposite of the given direction
+func oppositeDir(currDir datatypes.NodeDir) datatypes.NodeDir {
+	if currDir == datatypes.Up {
+		return datatypes.Down
+	}
+	return datatypes.Up
+}
+
+// hallOrdersToClear ...
+// @return: The hall order types served when stopping at the floor, and the direction
+// the node will depart in.
+// With config.ClearAll, both hall orders at the floor are served.
+// With config.ClearInDirn, only the hall order in the direction of the node is served,
+// or the one in the opposite direction if the node will turn around at the floor.
+// No hall orders are served by a node that doesn't serve hall orders (see servesHallOrders).
+func hallOrdersToClear(
+	assignedOrders datatypes.AssignedOrdersMatrix,
+	currFloor int,
+	currDir datatypes.NodeDir,
+	clearRequestType string,
+	servesHall bool) ([]elevio.ButtonType, datatypes.NodeDir) {
+
+	if !servesHall {
+		return []elevio.ButtonType{}, currDir
+	}
+
+	if clearRequestType != config.ClearInDirn {
+		return []elevio.ButtonType{elevio.BT_HallUp, elevio.BT_HallDown}, currDir
+	}
+
+	if assignedOrders[currFloor][hallOrderInDir(currDir)] {
+		return []elevio.ButtonType{hallOrderInDir(currDir)}, currDir
+	}
+
+	// Turn around if there is nothing more to do in the current direction
+	turnedDir := oppositeDir(currDir)
+	if !ordersAhead(assignedOrders, currFloor, currDir) && assignedOrders[currFloor][hallOrderInDir(turnedDir)] {
+		return []elevio.ButtonType{hallOrderInDir(turnedDir)}, turnedDir
+	}
+
+	return []elevio.ButtonType{}, currDir
+}
+
+// hasOrdersToClearAtFloor ...
+// @return: true if there are any orders that would be served by stopping at the floor,
+// false otherwise
+func hasOrdersToClearAtFloor(
+	assignedOrders datatypes.AssignedOrdersMatrix,
+	currFloor int,
+	currDir datatypes.NodeDir,
+	clearRequestType string,
+	servesHall bool) bool {
+
+	if assignedOrders[currFloor][elevio.BT_Cab] {
+		return true
+	}
+
+	hallTypes, _ := hallOrdersToClear(assignedOrders, currFloor, currDir, clearRequestType, servesHall)
+	for _, hallType := range hallTypes {
+		if assignedOrders[currFloor][hallType] {
+			return true
+		}
+	}
+	return false
+}
+
+// doorOpenTime ...
+// @return: How long the doors should be kept open at the floor. Stops serving
+// a hall order get the hall dwell time, while cab-only stops get the cab dwell time.
+func doorOpenTime(
+	assignedOrders datatypes.AssignedOrdersMatrix,
+	currFloor int,
+	hallTypes []elevio.ButtonType,
+	timings config.Timings) time.Duration {
+
+	for _, hallType := range hallTypes {
+		if assignedOrders[currFloor][hallType] {
+			return timings.DoorOpenHall.Duration
+		}
+	}
+	return timings.DoorOpenCab.Duration
+}
+
+// completeOrdersAtFloor ...
+// Informs the consensus modules that the cab orders and the given hall orders at
+// the floor are completed
+// (Passengers of destination orders going in the same directions will board)
+func completeOrdersAtFloor(
+	currFloor int,
+	hallTypes []elevio.ButtonType,
+	CompletedHallOrderChan chan<- elevio.ButtonEvent,
+	CompletedCabOrderChan chan<- int,
+	CompletedDestinationOrderChan chan<- elevio.ButtonEvent) {
+
+	for _, hallType := range hallTypes {
+		CompletedHallOrderChan <- elevio.ButtonEvent{Floor: currFloor, Button: hallType}
+		CompletedDestinationOrderChan <- elevio.ButtonEvent{Floor: currFloor, Button: hallType}
+	}
+	CompletedCabOrderChan <- currFloor
+}
+
+// changeMode ...
+// Opens the doors of an idle node switched to independent service, and lets the doors
+// close as usual when independent service is switched off.
+// @return: The new behaviour of the node
+func changeMode(
+	drv *elevio.Driver,
+	currMode datatypes.NodeMode,
+	newMode datatypes.NodeMode,
+	behaviour datatypes.NodeBehaviour,
+	doorTimer *time.Timer,
+	timings config.Timings) datatypes.NodeBehaviour {
+
+	switch newMode {
+	case datatypes.NormalMode:
+		fmt.Println("(fsm) Back in service")
+	case datatypes.OutOfServiceMode:
+		fmt.Println("(fsm) Out of service")
+	case datatypes.IndependentMode:
+		fmt.Println("(fsm) Independent service")
+	}
+
+	if newMode == datatypes.IndependentMode && behaviour == datatypes.IdleState {
+		openDoors(drv)
+		doorTimer.Reset(timings.DoorOpenCab.Duration)
+		return datatypes.DoorOpenState
+	}
+	if currMode == datatypes.IndependentMode && behaviour == datatypes.DoorOpenState {
+		doorTimer.Reset(timings.DoorOpenCab.Duration)
+	}
+	return behaviour
+}
+
+// recallDir ...
+// @return: The direction towards the recall floor from currFloor, turning around if the
+// node is moving away from the recall floor it just left
+func recallDir(
+	currFloor int,
+	recallFloor int,
+	currDir datatypes.NodeDir,
+	moving bool) datatypes.NodeDir {
+
+	if currFloor == recallFloor && moving {
+		return oppositeDir(currDir)
+	}
+	if recallFloor > currFloor {
+		return datatypes.Up
+	}
+	return datatypes.Down
+}
+
 // Wrapper functions for controlling the elevator hardware
 // -----
-func initiateMovement(currDir datatypes.NodeDir) {
+func initiateMovement(drv *elevio.Driver, currDir datatypes.NodeDir) {
 	if currDir == datatypes.Up {
-		elevio.SetMotorDirection(elevio.MD_Up)
+		drv.SetMotorDirection(elevio.MD_Up)
 	} else {
-		elevio.SetMotorDirection(elevio.MD_Down)
+		drv.SetMotorDirection(elevio.MD_Down)
 	}
 }
-func stopMovement() {
-	elevio.SetMotorDirection(elevio.MD_Stop)
+func stopMovement(drv *elevio.Driver) {
+	drv.SetMotorDirection(elevio.MD_Stop)
 }
-func openDoors() {
-	elevio.SetDoorOpenLamp(true)
+func openDoors(drv *elevio.Driver) {
+	drv.SetDoorOpenLamp(true)
 }
-func closeDoors() {
-	elevio.SetDoorOpenLamp(false)
+func closeDoors(drv *elevio.Driver) {
+	drv.SetDoorOpenLamp(false)
+}
+func announceDirection(drv *elevio.Driver, currDir datatypes.NodeDir) {
+	if currDir == datatypes.Up {
+		drv.SetDirectionIndicator(elevio.MD_Up)
+	} else {
+		drv.SetDirectionIndicator(elevio.MD_Down)
+	}
 }
 
 // StateMachine ...
-// GoRoutine acting as the Finite State Machine of a single node
+// GoRoutine acting as the Finite State Machine of a single node, controlling its car through drv
 func StateMachine(
+	ctx context.Context,
+	heartbeat <-chan struct{},
+	drv *elevio.Driver,
 	numFloors int,
 	ArrivedAtFloorChan <-chan int,
 	ToggleNetworkVisibilityChan chan<- bool,
 	LocallyAssignedOrdersChan <-chan datatypes.AssignedOrdersMatrix,
-	CompletedHallOrderChan chan<- int,
+	CompletedHallOrderChan chan<- elevio.ButtonEvent,
 	CompletedCabOrderChan chan<- int,
-	LocalNodeStateChan chan<- datatypes.NodeState) {
+	LocalNodeStateChan chan<- datatypes.NodeState,
+	CompletedDestinationOrderChan chan<- elevio.ButtonEvent,
+	timings config.Timings,
+	clearRequestType string,
+	ParkingTargetChan <-chan datatypes.ParkingTarget,
+	RecallChan <-chan bool,
+	recallFloor int,
+	ModeChan <-chan datatypes.NodeMode,
+	KeySwitchChan <-chan bool,
+	loadConfig config.CarLoad,
+	LoadSensorChan <-chan float64,
+	ObstructionChan <-chan bool,
+	CancelCabOrderChan chan<- int,
+	nuisanceConfig config.Nuisance,
+	HandoverChan chan<- datatypes.ConfirmedHallOrdersMatrix,
+	faultsConfig config.Faults,
+	HardwareChan <-chan bool,
+	ShutdownChan <-chan struct{},
+	DepartureChan chan<- datatypes.ConfirmedHallOrdersMatrix,
+	DepartedChan chan<- struct{}) error {
 
 	// Initialize variables
 	// -----
-	doorOpenTime := 3 * time.Second
-	timeoutTime := 4 * time.Second
+	timeoutTime := timings.MotorTimeout.Duration
 
 	currFloor := -1
 	currDir := datatypes.Up
@@ -172,6 +387,41 @@ func StateMachine(
 	// Start obstruction timer on init
 	obstructionTimer := time.NewTimer(timeoutTime)
 
+	// Idle nodes are parked at parkingFloor (-1: stay) after parkingDelay
+	parkingFloor := -1
+	parkingDelay := time.Duration(0)
+	idleSince := time.Now()
+	parkTimer := time.NewTimer(parkingDelay)
+
+	// During a fire recall the node returns nonstop to recallFloor and opens the doors
+	recallActive := false
+	atRecallFloor := false
+
+	// The administrative mode of the node, shared with the other nodes through the node state
+	mode := datatypes.NormalMode
+
+	// In independent service, the doors are held open after the door timer has expired
+	holdingDoors := false
+
+	// The share of the capacity of the car in use, either read from the load-weighing
+	// input or estimated from the simulated number of passengers
+	passengers := 0.0
+	load := 0.0
+
+	// Evidence of passengers using the car, for detecting nuisance cab orders
+	// (Not in independent service, where the car is controlled by an operator)
+	var nuisance nuisanceTracker
+
+	// Faults diagnosed from the floor sensor and the motor, reported as the health of the node
+	// until no new faults have been diagnosed for a while
+	var faults faultDetector
+	faultTimer := time.NewTimer(faultsConfig.ClearAfter.Duration)
+
+	// While the connection to the elevator is lost, the sensor values can't be trusted
+	// and the position of the node is unknown
+	hardwareLost := false
+	floorKnown := false
+
 	// Go offline until initialized
 	ToggleNetworkVisibilityChan <- false
 
@@ -181,8 +431,8 @@ func StateMachine(
 	// (Close doors and move to first floor in datatypes.Up direction)
 	// -----
 	behaviour := datatypes.InitState
-	closeDoors()
-	initiateMovement(currDir)
+	closeDoors(drv)
+	initiateMovement(drv, currDir)
 
 	fmt.Println("(fsm) Initialized")
 
@@ -193,34 +443,87 @@ func StateMachine(
 
 		// Possible obstruction, the elevator should have hit a floor by now
 		case <-obstructionTimer.C:
-			if behaviour != datatypes.MovingState && behaviour != datatypes.InitState {
+			if !motorRunning(behaviour, atRecallFloor) || hardwareLost {
 				break
 			}
 
+			// Tell a stalled motor from a stuck floor sensor by whether the sensor shows a floor
+			registerFault(&faults, timeoutFault(&faults, drv.GetFloor(), time.Now(), faultsConfig),
+				currFloor, faultTimer, faultsConfig)
+
 			behaviour = datatypes.InitState
-			initiateMovement(currDir)
+			initiateMovement(drv, currDir)
 			obstructionTimer.Reset(timeoutTime)
 
+			// Hand the hall orders over to the other nodes, letting them take over at once
+			// (The node rejoins with a clean state, getting new hall orders assigned once
+			// it arrives at a floor)
+			HandoverChan <- relinquishHallOrders(&assignedOrders)
+
 			// Don't show on network when obstructed
 			// (Will make the other nodes redistribute
 			// the orders of this node)
 			ToggleNetworkVisibilityChan <- false
 
+			// The node state has changed, inform the network module
+			transmitState(behaviour, currFloor, currDir, mode, load, faults.fault, LocalNodeStateChan)
+
 		// Time to close doors and transition to another state
 		case <-doorTimer.C:
-			if behaviour == datatypes.InitState {
+			// (The doors are kept open at the recall floor during a fire recall)
+			if behaviour == datatypes.InitState || behaviour == datatypes.RecallState {
 				break
 			}
 
-			closeDoors()
+			// Keep the doors open if the node is turning around with passengers
+			// waiting at the floor to travel in the new direction
+			// (They could not board while the node was going the other way)
+			if hasOrders(assignedOrders) && clearRequestType == config.ClearInDirn &&
+				servesHallOrders(mode, load, loadConfig) {
+				newDir := calculateDirection(assignedOrders, currFloor, currDir)
+				if newDir != currDir && assignedOrders[currFloor][hallOrderInDir(newDir)] {
+					currDir = newDir
+					announceDirection(drv, currDir)
+
+					hallTypes := []elevio.ButtonType{hallOrderInDir(currDir)}
+					doorTimer.Reset(doorOpenTime(assignedOrders, currFloor, hallTypes, timings))
+					if loadConfig.Source == config.LoadSimulated {
+						passengers = simulateStop(passengers, assignedOrders, currFloor, hallTypes, loadConfig)
+						load = trackLoad(&nuisance, load, passengers/float64(loadConfig.Capacity))
+					}
+					completeOrdersAtFloor(currFloor, hallTypes, CompletedHallOrderChan,
+						CompletedCabOrderChan, CompletedDestinationOrderChan)
+
+					transmitState(behaviour, currFloor, currDir, mode, load, faults.fault, LocalNodeStateChan)
+					break
+				}
+			}
+
+			// Keep the doors open in independent service until a cab button is pressed
+			holdingDoors = mode == datatypes.IndependentMode && !hasOrders(assignedOrders)
+			if holdingDoors {
+				break
+			}
+
+			closeDoors(drv)
+
+			// Cancel the cab orders if the car keeps stopping for them without any passengers
+			if nuisanceConfig.Detect && mode != datatypes.IndependentMode &&
+				trackDoorsClosed(&nuisance, nuisanceConfig) {
+				fmt.Println("(fsm) Nuisance:", nuisanceConfig.MaxEmptyStops,
+					"stops without passengers, cancelling all cab orders")
+				cancelCabOrders(&assignedOrders, CancelCabOrderChan)
+			}
 
 			// Move to datatypes.IdleState if there are no orders,
 			// change to datatypes.MovingState if there are.
 			if !hasOrders(assignedOrders) {
 				behaviour = datatypes.IdleState
+				idleSince = time.Now()
+				parkTimer.Reset(parkingDelay)
 			} else {
 				currDir = calculateDirection(assignedOrders, currFloor, currDir)
-				initiateMovement(currDir)
+				initiateMovement(drv, currDir)
 				behaviour = datatypes.MovingState
 
 				// Start obstruction timer every time the node
@@ -230,16 +533,220 @@ func StateMachine(
 			}
 
 			// The node state has changed, inform the network module
-			transmitState(behaviour, currFloor, currDir, LocalNodeStateChan)
+			transmitState(behaviour, currFloor, currDir, mode, load, faults.fault, LocalNodeStateChan)
 
 		// Receive (optimally) assigned orders for this node from the
 		// optimal order assigner
 		case a := <-LocallyAssignedOrdersChan:
 			assignedOrders = a
 
+			// Cancel the cab orders if too many are placed without any passengers
+			if !nuisanceConfig.Detect || mode == datatypes.IndependentMode {
+				break
+			}
+			if trackCabOrders(&nuisance, assignedOrders, nuisanceConfig) {
+				fmt.Println("(fsm) Nuisance: more than", nuisanceConfig.MaxCabOrders,
+					"cab orders without any load change, cancelling all cab orders")
+				cancelCabOrders(&assignedOrders, CancelCabOrderChan)
+			}
+
+		// Receive where to park when idle from the optimal order assigner
+		case a := <-ParkingTargetChan:
+			parkingFloor = a.Floor
+			parkingDelay = a.Delay
+
+			// Restart the parking delay from when the node became idle
+			// (A parking node stops at the next floor if parking is cancelled)
+			if behaviour == datatypes.IdleState {
+				parkTimer.Reset(parkingDelay - time.Since(idleSince))
+			}
+
+		// Return to the recall floor when a fire recall is activated,
+		// and resume normal operation when it is reset
+		case a := <-RecallChan:
+			if a == recallActive {
+				break
+			}
+			recallActive = a
+
+			// (An initializing node starts the recall when arriving at a floor)
+			if behaviour == datatypes.InitState {
+				break
+			}
+
+			if recallActive {
+				fmt.Println("(fsm) Fire recall, returning to floor", recallFloor)
+
+				moving := behaviour == datatypes.MovingState || behaviour == datatypes.ParkingState
+				behaviour = datatypes.RecallState
+				holdingDoors = false
+				atRecallFloor = currFloor == recallFloor && !moving
+
+				if atRecallFloor {
+					openDoors(drv)
+				} else {
+					closeDoors(drv)
+					currDir = recallDir(currFloor, recallFloor, currDir, moving)
+					initiateMovement(drv, currDir)
+					obstructionTimer.Reset(timeoutTime)
+				}
+
+			} else if behaviour == datatypes.RecallState {
+				fmt.Println("(fsm) Fire recall reset")
+
+				// Close the doors and wait for new orders, or stop at
+				// the next floor if still on the way
+				if atRecallFloor {
+					closeDoors(drv)
+					behaviour = datatypes.IdleState
+					idleSince = time.Now()
+					parkTimer.Reset(parkingDelay)
+				} else {
+					behaviour = datatypes.MovingState
+				}
+			}
+
+			// The node state has changed, inform the network module
+			transmitState(behaviour, currFloor, currDir, mode, load, faults.fault, LocalNodeStateChan)
+
+		// Change the administrative mode of the node
+		// (Taking the node out of service or into independent service makes the other
+		// nodes take over its hall orders, while it only serves its cab orders)
+		case a := <-ModeChan:
+			if a == mode {
+				break
+			}
+			behaviour = changeMode(drv, mode, a, behaviour, doorTimer, timings)
+			mode = a
+
+			// The node state has changed, inform the network module
+			transmitState(behaviour, currFloor, currDir, mode, load, faults.fault, LocalNodeStateChan)
+
+		// Toggle independent service when the key switch is turned
+		case a := <-KeySwitchChan:
+			if !a {
+				break
+			}
+
+			newMode := datatypes.IndependentMode
+			if mode == datatypes.IndependentMode {
+				newMode = datatypes.NormalMode
+			}
+			behaviour = changeMode(drv, mode, newMode, behaviour, doorTimer, timings)
+			mode = newMode
+
+			// The node state has changed, inform the network module
+			transmitState(behaviour, currFloor, currDir, mode, load, faults.fault, LocalNodeStateChan)
+
+		// Received a new reading from the load-weighing input
+		case a := <-LoadSensorChan:
+			if a == load {
+				break
+			}
+			load = trackLoad(&nuisance, load, a)
+
+			// The node state has changed, inform the network module
+			transmitState(behaviour, currFloor, currDir, mode, load, faults.fault, LocalNodeStateChan)
+
+		// Clear the fault when no new faults have been diagnosed for a while
+		case <-faultTimer.C:
+			if faults.fault == datatypes.NoFault || hardwareLost {
+				break
+			}
+
+			fmt.Println("(fsm) Fault cleared:", faultDescriptions[faults.fault])
+			faults.fault = datatypes.NoFault
+			transmitState(behaviour, currFloor, currDir, mode, load, faults.fault, LocalNodeStateChan)
+
+		// Withdraw from the hall orders while the connection to the elevator is lost,
+		// and reinitialize once it is regained
+		case a := <-HardwareChan:
+			// (a is true when connected, nothing to do if it was already known)
+			if a == !hardwareLost {
+				break
+			}
+			hardwareLost = !a
+
+			if hardwareLost {
+				fmt.Println("(fsm) Fault:", faultDescriptions[datatypes.HardwareLostFault])
+				faults.fault = datatypes.HardwareLostFault
+				behaviour = datatypes.InitState
+				floorKnown = false
+				holdingDoors = false
+				relinquishHallOrders(&assignedOrders)
+			} else {
+				fmt.Println("(fsm) Fault cleared:", faultDescriptions[datatypes.HardwareLostFault])
+				faults.fault = datatypes.NoFault
+				closeDoors(drv)
+				initiateMovement(drv, currDir)
+				obstructionTimer.Reset(timeoutTime)
+			}
+
+			// The node state has changed, inform the network module
+			transmitState(behaviour, currFloor, currDir, mode, load, faults.fault, LocalNodeStateChan)
+
+		// Stop at the nearest floor and leave the network before the node shuts down
+		// (The FSM only discards its inputs once the node has departed)
+		case <-ShutdownChan:
+			fmt.Println("(fsm) Shutting down")
+			err := depart(ctx, heartbeat, drv, motorRunning(behaviour, atRecallFloor) && !hardwareLost,
+				&assignedOrders, timeoutTime, DepartureChan, ArrivedAtFloorChan, ObstructionChan,
+				KeySwitchChan, HardwareChan)
+			if err != nil {
+				return err
+			}
+			DepartedChan <- struct{}{}
+
+			return discardInputs(ctx, heartbeat, ArrivedAtFloorChan, LocallyAssignedOrdersChan,
+				ParkingTargetChan, RecallChan, ModeChan, KeySwitchChan, LoadSensorChan, ObstructionChan,
+				HardwareChan)
+
+		// The doors being held or reopened at a stop is seen as a passenger transfer
+		case a := <-ObstructionChan:
+			if a && behaviour == datatypes.DoorOpenState {
+				trackDoorReopen(&nuisance)
+			}
+
+		// The node has been idle for long enough, park it
+		case <-parkTimer.C:
+			if behaviour != datatypes.IdleState || hasOrders(assignedOrders) ||
+				time.Since(idleSince) < parkingDelay ||
+				parkingFloor == -1 || parkingFloor == currFloor {
+				break
+			}
+
+			currDir = datatypes.Down
+			if parkingFloor > currFloor {
+				currDir = datatypes.Up
+			}
+			initiateMovement(drv, currDir)
+			behaviour = datatypes.ParkingState
+
+			// Parking nodes can be obstructed as well
+			obstructionTimer.Reset(timeoutTime)
+
+			fmt.Println("(fsm) Parking at floor", parkingFloor)
+
+			// The node state has changed, inform the network module
+			transmitState(behaviour, currFloor, currDir, mode, load, faults.fault, LocalNodeStateChan)
+
 		// Transition to correct state when arriving in new floor.
 		case a := <-ArrivedAtFloorChan:
+			// Check the floor numbers against the motor
+			prevFloor := currFloor
+			if !floorKnown {
+				prevFloor = -1
+			}
+			faultFound := registerFault(&faults,
+				arrivalFault(prevFloor, a, motorRunning(behaviour, atRecallFloor), currDir),
+				a, faultTimer, faultsConfig)
+
 			currFloor = a
+			floorKnown = true
+
+			if faultFound {
+				transmitState(behaviour, currFloor, currDir, mode, load, faults.fault, LocalNodeStateChan)
+			}
 
 			// Reset the obstruction timer when the node arrives at a floor
 			obstructionTimer.Reset(timeoutTime)
@@ -248,27 +755,81 @@ func StateMachine(
 
 			// Stop at first defined floor and go online when initialized
 			case datatypes.InitState:
-				stopMovement()
+				stopMovement(drv)
 				behaviour = datatypes.IdleState
+				idleSince = time.Now()
+				parkTimer.Reset(parkingDelay)
 				ToggleNetworkVisibilityChan <- true
 
+				// Continue a fire recall activated while initializing
+				if recallActive {
+					behaviour = datatypes.RecallState
+					atRecallFloor = currFloor == recallFloor
+
+					if atRecallFloor {
+						openDoors(drv)
+					} else {
+						currDir = recallDir(currFloor, recallFloor, currDir, false)
+						initiateMovement(drv, currDir)
+					}
+				}
+
+			// Pass all floors nonstop until arriving at the recall floor, and open the doors there
+			case datatypes.RecallState:
+				if currFloor == recallFloor {
+					stopMovement(drv)
+					openDoors(drv)
+					atRecallFloor = true
+				}
+
+			// Stop without opening the doors when arriving at the parking floor,
+			// or turn around if it has moved behind the node
+			case datatypes.ParkingState:
+				if parkingFloor == -1 || parkingFloor == currFloor {
+					stopMovement(drv)
+					behaviour = datatypes.IdleState
+					idleSince = time.Now()
+				} else if (parkingFloor > currFloor) != (currDir == datatypes.Up) {
+					currDir = oppositeDir(currDir)
+					initiateMovement(drv, currDir)
+				}
+
 			// Transition from datatypes.MovingState to datatypes.DoorOpenState if the node
 			// should stop at this floor
 			case datatypes.MovingState:
-				if shouldStopAtFloor(currFloor, numFloors, currDir, assignedOrders) {
-					stopMovement()
-					openDoors()
-					doorTimer.Reset(doorOpenTime)
+				servesHall := servesHallOrders(mode, load, loadConfig)
+				if shouldStopAtFloor(currFloor, numFloors, currDir, assignedOrders, servesHall) {
+					stopMovement(drv)
+					openDoors(drv)
+
+					// Announce the new direction if turning around at the floor
+					hallTypes, departDir := hallOrdersToClear(assignedOrders, currFloor, currDir, clearRequestType, servesHall)
+					if departDir != currDir {
+						currDir = departDir
+						announceDirection(drv, currDir)
+					}
+
+					doorTimer.Reset(doorOpenTime(assignedOrders, currFloor, hallTypes, timings))
 					behaviour = datatypes.DoorOpenState
-
-					// Tell hallConsensus to wipe all orders at floor
-					CompletedHallOrderChan <- currFloor
-					CompletedCabOrderChan <- currFloor
+					trackStop(&nuisance, assignedOrders[currFloor][elevio.BT_Cab])
+					if loadConfig.Source == config.LoadSimulated {
+						passengers = simulateStop(passengers, assignedOrders, currFloor, hallTypes, loadConfig)
+						load = trackLoad(&nuisance, load, passengers/float64(loadConfig.Capacity))
+					}
+
+					// Tell the consensus modules to wipe the served orders at floor
+					completeOrdersAtFloor(currFloor, hallTypes, CompletedHallOrderChan,
+						CompletedCabOrderChan, CompletedDestinationOrderChan)
 				}
 			}
 			// The node state has changed, inform the network module
-			transmitState(behaviour, currFloor, currDir, LocalNodeStateChan)
+			transmitState(behaviour, currFloor, currDir, mode, load, faults.fault, LocalNodeStateChan)
 
+		case <-heartbeat:
+			continue
+
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 
 		// A new message has arrived on the channels, handle the state
@@ -279,17 +840,40 @@ func StateMachine(
 			continue
 		}
 
+		// (Full cars and nodes restricted to cab orders bypass hall orders)
+		servesHall := servesHallOrders(mode, load, loadConfig)
+
 		switch behaviour {
+
+		// Parking is cancelled by any order, the node continues to the next
+		// floor and serves the orders from there
+		case datatypes.ParkingState:
+			behaviour = datatypes.MovingState
+
+			// The node state has changed, inform the network module
+			transmitState(behaviour, currFloor, currDir, mode, load, faults.fault, LocalNodeStateChan)
+
 		case datatypes.IdleState:
 
 			// The node is summoned to where it is, open doors!
-			if hasOrderAtFloor(assignedOrders, currFloor) {
-				openDoors()
-				doorTimer.Reset(doorOpenTime)
+			if hasOrdersToClearAtFloor(assignedOrders, currFloor, currDir, clearRequestType, servesHall) {
+				openDoors(drv)
 
-				// Tell hallConsensus to wipe all orders at floor
-				CompletedHallOrderChan <- currFloor
-				CompletedCabOrderChan <- currFloor
+				hallTypes, departDir := hallOrdersToClear(assignedOrders, currFloor, currDir, clearRequestType, servesHall)
+				if departDir != currDir {
+					currDir = departDir
+					announceDirection(drv, currDir)
+				}
+				doorTimer.Reset(doorOpenTime(assignedOrders, currFloor, hallTypes, timings))
+				trackStop(&nuisance, assignedOrders[currFloor][elevio.BT_Cab])
+				if loadConfig.Source == config.LoadSimulated {
+					passengers = simulateStop(passengers, assignedOrders, currFloor, hallTypes, loadConfig)
+					load = trackLoad(&nuisance, load, passengers/float64(loadConfig.Capacity))
+				}
+
+				// Tell the consensus modules to wipe the served orders at floor
+				completeOrdersAtFloor(currFloor, hallTypes, CompletedHallOrderChan,
+					CompletedCabOrderChan, CompletedDestinationOrderChan)
 				behaviour = datatypes.DoorOpenState
 
 			} else {
@@ -297,7 +881,7 @@ func StateMachine(
 				// Change dir if they're not ahead of the node.
 				currDir = calculateDirection(assignedOrders, currFloor, currDir)
 
-				initiateMovement(currDir)
+				initiateMovement(drv, currDir)
 
 				behaviour = datatypes.MovingState
 				// Start obstruction timer everytime the node starts moving
@@ -305,18 +889,24 @@ func StateMachine(
 			}
 
 			// The node state has changed, inform the network module
-			transmitState(behaviour, currFloor, currDir, LocalNodeStateChan)
+			transmitState(behaviour, currFloor, currDir, mode, load, faults.fault, LocalNodeStateChan)
 
 		case datatypes.DoorOpenState:
 
 			// Refresh door timer if summoned to the current floor, and
 			// doors are already open
-			if hasOrderAtFloor(assignedOrders, currFloor) {
-				doorTimer.Reset(doorOpenTime)
-
-				// Tell hallConsensus to wipe all orders at floor
-				CompletedHallOrderChan <- currFloor
-				CompletedCabOrderChan <- currFloor
+			if hasOrdersToClearAtFloor(assignedOrders, currFloor, currDir, clearRequestType, servesHall) {
+				hallTypes, _ := hallOrdersToClear(assignedOrders, currFloor, currDir, clearRequestType, servesHall)
+				doorTimer.Reset(doorOpenTime(assignedOrders, currFloor, hallTypes, timings))
+
+				// Tell the consensus modules to wipe the served orders at floor
+				completeOrdersAtFloor(currFloor, hallTypes, CompletedHallOrderChan,
+					CompletedCabOrderChan, CompletedDestinationOrderChan)
+
+			} else if holdingDoors {
+				// A cab button was pressed while holding the doors open, close them
+				holdingDoors = false
+				doorTimer.Reset(0)
 			}
 
 		}
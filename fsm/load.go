@@ -0,0 +1,53 @@
+package fsm
+
+import (
+	"../config"
+	"../datatypes"
+	"../elevio"
+)
+
+// servesHallOrders ...
+// @return: false if the node is in a mode restricted to its own cab orders, or if the
+// car is full, true otherwise
+func servesHallOrders(mode datatypes.NodeMode, load float64, loadConfig config.CarLoad) bool {
+	return mode == datatypes.NormalMode && load < loadConfig.FullThreshold
+}
+
+// simulateStop ...
+// Estimates the number of passengers in the car after stopping at the floor.
+// The passengers are assumed to be spread evenly across the cab orders, so a share of
+// them leaves at the floor of every cab order, while PassengersPerHallOrder passengers
+// board for every hall order served.
+// @return: The estimated number of passengers, at most the capacity of the car
+func simulateStop(
+	passengers float64,
+	assignedOrders datatypes.AssignedOrdersMatrix,
+	currFloor int,
+	hallTypes []elevio.ButtonType,
+	loadConfig config.CarLoad) float64 {
+
+	numCabOrders := 0
+	for floor := range assignedOrders {
+		if assignedOrders[floor][elevio.BT_Cab] {
+			numCabOrders++
+		}
+	}
+
+	// Nobody stays in a car without cab orders
+	if numCabOrders == 0 {
+		passengers = 0
+	} else if assignedOrders[currFloor][elevio.BT_Cab] {
+		passengers -= passengers / float64(numCabOrders)
+	}
+
+	for _, hallType := range hallTypes {
+		if assignedOrders[currFloor][hallType] {
+			passengers += loadConfig.PassengersPerHallOrder
+		}
+	}
+
+	if passengers > float64(loadConfig.Capacity) {
+		passengers = float64(loadConfig.Capacity)
+	}
+	return passengers
+}
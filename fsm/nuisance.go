@@ -0,0 +1,121 @@
+package fsm
+
+import (
+	"../config"
+	"../datatypes"
+	"../elevio"
+)
+
+// nuisanceTracker ...
+// Keeps track of the evidence of passengers using the car, used for detecting nuisance
+// cab orders: many cab orders placed without the load changing, or stops at the floors
+// of cab orders without any passenger transfer (a load change or a door reopen).
+type nuisanceTracker struct {
+	// Floors of the cab orders in the assignment, for telling new cab orders apart
+	outstanding [elevio.NumFloors]bool
+
+	// Floors of the cab orders placed since the load last changed or the car last stopped,
+	// that are still outstanding (Served and cancelled orders are no longer counted)
+	cabFloors [elevio.NumFloors]bool
+
+	// Stops in a row at the floors of cab orders without any passenger transfer
+	emptyStops int
+
+	// Whether the doors are open at the floor of a cab order, and whether a
+	// passenger transfer has been seen since they opened
+	atCabStop    bool
+	transferSeen bool
+}
+
+// trackCabOrders ...
+// Counts the floors of the outstanding cab orders placed since the load last changed
+// or the car last stopped.
+// @return: true if there are more than MaxCabOrders such floors, to be cancelled
+func trackCabOrders(
+	tracker *nuisanceTracker,
+	assignedOrders datatypes.AssignedOrdersMatrix,
+	nuisanceConfig config.Nuisance) bool {
+
+	count := 0
+	for floor := range assignedOrders {
+		cabOrder := assignedOrders[floor][elevio.BT_Cab]
+		tracker.cabFloors[floor] = cabOrder && (tracker.cabFloors[floor] || !tracker.outstanding[floor])
+		tracker.outstanding[floor] = cabOrder
+		if tracker.cabFloors[floor] {
+			count++
+		}
+	}
+	if count <= nuisanceConfig.MaxCabOrders {
+		return false
+	}
+
+	// (The orders are cancelled, and not counted again until they are placed anew)
+	tracker.cabFloors = [elevio.NumFloors]bool{}
+	return true
+}
+
+// trackLoad ...
+// Registers a change of the load as a passenger transfer.
+// @return: The new load
+func trackLoad(tracker *nuisanceTracker, prevLoad float64, currLoad float64) float64 {
+	if currLoad != prevLoad {
+		tracker.cabFloors = [elevio.NumFloors]bool{}
+		tracker.transferSeen = true
+	}
+	return currLoad
+}
+
+// trackDoorReopen ...
+// Registers the doors being held or reopened (seen as an obstruction) as a passenger transfer
+func trackDoorReopen(tracker *nuisanceTracker) {
+	tracker.transferSeen = true
+}
+
+// trackStop ...
+// Registers the doors opening at a floor, serving a cab order or not.
+// The cab orders placed before the stop are no longer counted, as passengers may board.
+func trackStop(tracker *nuisanceTracker, servesCabOrder bool) {
+	tracker.cabFloors = [elevio.NumFloors]bool{}
+	tracker.atCabStop = servesCabOrder
+	tracker.transferSeen = false
+}
+
+// trackDoorsClosed ...
+// Registers the doors closing, counting the stops at the floors of cab orders without
+// any passenger transfer.
+// @return: true if there have been MaxEmptyStops such stops in a row
+func trackDoorsClosed(tracker *nuisanceTracker, nuisanceConfig config.Nuisance) bool {
+	if !tracker.atCabStop {
+		return false
+	}
+	tracker.atCabStop = false
+
+	if tracker.transferSeen {
+		tracker.emptyStops = 0
+		return false
+	}
+
+	tracker.emptyStops++
+	if tracker.emptyStops < nuisanceConfig.MaxEmptyStops {
+		return false
+	}
+
+	tracker.emptyStops = 0
+	return true
+}
+
+// cancelCabOrders ...
+// Cancels all the cab orders of the node, both locally and through the cab order consensus
+func cancelCabOrders(
+	assignedOrders *datatypes.AssignedOrdersMatrix,
+	CancelCabOrderChan chan<- int) {
+
+	for floor := range assignedOrders {
+		if !assignedOrders[floor][elevio.BT_Cab] {
+			continue
+		}
+
+		assignedOrders[floor][elevio.BT_Cab] = false
+		CancelCabOrderChan <- floor
+	}
+}
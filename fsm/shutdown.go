@@ -0,0 +1,106 @@
+package fsm
+
+import (
+	"../datatypes"
+	"../elevio"
+	"context"
+	"fmt"
+	"time"
+)
+
+// depart ...
+// Hands the hall orders over to the other nodes, and brings a running car to a standstill
+// at the next floor, opening the doors to let the passengers out.
+// A car that hasn't arrived at a floor within timeout is stopped where it is.
+// (The inputs are still read, so that the IOReader is never blocked while waiting)
+// @return: ctx.Err() if ctx was cancelled before the car stopped, nil otherwise
+func depart(
+	ctx context.Context,
+	heartbeat <-chan struct{},
+	drv *elevio.Driver,
+	running bool,
+	assignedOrders *datatypes.AssignedOrdersMatrix,
+	timeout time.Duration,
+	DepartureChan chan<- datatypes.ConfirmedHallOrdersMatrix,
+	ArrivedAtFloorChan <-chan int,
+	ObstructionChan <-chan bool,
+	KeySwitchChan <-chan bool,
+	HardwareChan <-chan bool) error {
+
+	select {
+	case DepartureChan <- relinquishHallOrders(assignedOrders):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if !running {
+		return nil
+	}
+
+	timeoutTimer := time.NewTimer(timeout)
+	defer timeoutTimer.Stop()
+
+	for {
+		select {
+		case a := <-ArrivedAtFloorChan:
+			stopMovement(drv)
+			openDoors(drv)
+			fmt.Println("(fsm) Stopped at floor", a)
+			return nil
+
+		case <-timeoutTimer.C:
+			stopMovement(drv)
+			fmt.Println("(fsm) No floor reached, stopped between floors")
+			return nil
+
+		case a := <-HardwareChan:
+			if !a {
+				return nil
+			}
+
+		case <-ObstructionChan:
+		case <-KeySwitchChan:
+		case <-heartbeat:
+
+		case <-ctx.Done():
+			stopMovement(drv)
+			return ctx.Err()
+		}
+	}
+}
+
+// discardInputs ...
+// Reads and discards all inputs of the FSM after the node has departed, so that the
+// other modules are never blocked while the node shuts down
+// @return: ctx.Err() once ctx is cancelled
+func discardInputs(
+	ctx context.Context,
+	heartbeat <-chan struct{},
+	ArrivedAtFloorChan <-chan int,
+	LocallyAssignedOrdersChan <-chan datatypes.AssignedOrdersMatrix,
+	ParkingTargetChan <-chan datatypes.ParkingTarget,
+	RecallChan <-chan bool,
+	ModeChan <-chan datatypes.NodeMode,
+	KeySwitchChan <-chan bool,
+	LoadSensorChan <-chan float64,
+	ObstructionChan <-chan bool,
+	HardwareChan <-chan bool) error {
+
+	for {
+		select {
+		case <-ArrivedAtFloorChan:
+		case <-LocallyAssignedOrdersChan:
+		case <-ParkingTargetChan:
+		case <-RecallChan:
+		case <-ModeChan:
+		case <-KeySwitchChan:
+		case <-LoadSensorChan:
+		case <-ObstructionChan:
+		case <-HardwareChan:
+		case <-heartbeat:
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
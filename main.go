@@ -9,174 +9,739 @@
 package main
 
 import (
+	"./api"
+	"./config"
 	"./consensus"
 	"./datatypes"
 	"./elevio"
+	"./eta"
 	"./fsm"
 	"./network"
+	"./network/driver/peers"
 	"./nodestates"
 	"./orderassignment"
+	"./supervisor"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
 
-	// Set numFloors to equal the global const defined in elevio.go
-	numFloors := elevio.NumFloors
-	fmt.Println("(main) numFloors: ", numFloors)
+	// Configuration
+	// ------
+	// All settings are read from a JSON config file given with `-config=node.json`
+	// (see config/example.json). Values not given in the file keep their default values,
+	// and the flags below override the values in the file.
+	nodeConfig := config.Default()
+	configPathPtr := flag.String("config", "", "Path to the JSON config file of the node")
+	printConfigPtr := flag.Bool("print-config", false, "Print the configuration in use as JSON and exit")
 
 	// ID and Port Handling
 	// ------
 	// Pass the ID in the command line with `go run main.go -id=our_id`
-	// Pass the port number in the command line with `go run main.go -port=our_id`
+	// Pass the port number in the command line with `go run main.go -port=our_port`
+	// Run several cars in one process by passing one ID and port per car, e.g. `-id=1,2 -port=15657,15658`
+	// (Overrides Node.Cars of the config file, see overrideCars)
+	flag.String("id", "", "LocalID of the node (comma-separated: one per car)")
+	flag.String("port", "", "Port for connecting to elevator on localhost (comma-separated: one per car)")
 
-	IDptr := flag.String("id", "1", "LocalID of the node")
-	portPtr := flag.Int("port", 15657, "Port for connecting to elevator")
+	// Control API
+	// ------
+	// Pass the address of the control API with `-api=:8080` (disabled by default)
+	// (With several cars, one address per car, e.g. `-api=:8080,:8081`)
+	flag.String("api", "", "Address of the HTTP control API (empty: disabled, comma-separated: one per car)")
+
+	// Partition handling
+	// ------
+	// Pass the expected number of nodes with `-groupSize=3` (0 uses the peer history instead)
+	// Pass how long lost nodes are kept in the peer history with `-forgetAfter=1m` (0: forever)
+	// Pass the minority policy with `-minorityPolicy=cabonly` or `-minorityPolicy=all`
+	network := &nodeConfig.Network
+	flag.IntVar(&network.GroupSize, "groupSize", network.GroupSize, "Number of nodes in the group (0: use peer history)")
+	flag.DurationVar(&network.ForgetAfter.Duration, "forgetAfter", network.ForgetAfter.Duration, "Time before lost nodes are removed from the peer history (0: never)")
+	flag.StringVar(&network.MinorityPolicy, "minorityPolicy", network.MinorityPolicy, "Orders served in a minority partition (cabonly|all)")
+
+	// Peer liveness
+	// ------
+	// Pass `-phiThreshold=0` to declare peers lost after the fixed `-peerTimeout` only
+	peerConfig := &nodeConfig.Network.Peers
+	flag.DurationVar(&peerConfig.Interval.Duration, "peerInterval", peerConfig.Interval.Duration, "Time between peer heartbeats")
+	flag.DurationVar(&peerConfig.Timeout.Duration, "peerTimeout", peerConfig.Timeout.Duration, "Minimum silence before a peer is lost")
+	flag.DurationVar(&peerConfig.MaxTimeout.Duration, "peerMaxTimeout", peerConfig.MaxTimeout.Duration, "Maximum silence before a peer is lost")
+	flag.Float64Var(&peerConfig.PhiThreshold, "phiThreshold", peerConfig.PhiThreshold, "Phi at which a silent peer is lost (0: fixed timeout)")
+	flag.Float64Var(&peerConfig.SuspectPhi, "suspectPhi", peerConfig.SuspectPhi, "Phi at which a silent peer is demoted from hall orders")
+	flag.Float64Var(&peerConfig.SuspectLoss, "suspectLoss", peerConfig.SuspectLoss, "Loss rate at which a peer is demoted from hall orders")
+
+	// Node states
+	// ------
+	// Node states not refreshed within `-stateTimeout` are left out of the order assignment
+	flag.DurationVar(&network.StateTimeout.Duration, "stateTimeout", network.StateTimeout.Duration, "Time before a node state not refreshed is evicted")
+
+	// Order assignment
+	// ------
+	// Pass the path to the hall request assigner with `-assigner=path/to/hall_request_assigner`
+	// (Searched for next to the executable and in the working directory by default)
+	assignment := &nodeConfig.Assignment
+	flag.StringVar(&assignment.AssignerPath, "assigner", assignment.AssignerPath, "Path to the hall request assigner binary")
+	flag.DurationVar(&assignment.AssignerTimeout.Duration, "assignerTimeout", assignment.AssignerTimeout.Duration, "Deadline for a single run of the hall request assigner")
+	flag.IntVar(&assignment.SwitchingCost, "switchingCost", assignment.SwitchingCost, "Cost (in floors) of moving a committed hall order (0: disabled)")
+	flag.IntVar(&assignment.FreezeDistance, "freezeDistance", assignment.FreezeDistance, "Freeze hall orders this many floors ahead of a node (-1: disabled)")
+
+	// Estimated times of arrival
+	// ------
+	// Pass `-etaDisplay` to show the estimated time of arrival of each hall order on the floor displays
+	flag.BoolVar(&nodeConfig.Features.ETADisplay, "etaDisplay", nodeConfig.Features.ETADisplay, "Show the estimated times of arrival on the floor displays")
+
+	// Logging
+	// ------
+	// Pass `-log=node.log` to append the log to a file instead of printing it
+	flag.StringVar(&nodeConfig.Logging.File, "log", nodeConfig.Logging.File, "File the log is appended to (empty: standard output)")
 
 	flag.Parse()
-	localID := "node_" + (datatypes.NodeID)(*IDptr)
-	port := *portPtr
 
-	fmt.Println("(main) localID:", localID)
-	fmt.Println("(main) port:", port)
+	// The flags given are applied again after reading the config file, overriding its values
+	givenFlags := map[string]string{}
+	flag.Visit(func(f *flag.Flag) {
+		givenFlags[f.Name] = f.Value.String()
+	})
+	if *configPathPtr != "" {
+		if err := config.LoadFile(*configPathPtr, &nodeConfig); err != nil {
+			fmt.Println("(main) Invalid config file:", err)
+			os.Exit(1)
+		}
+		for name, value := range givenFlags {
+			flag.Set(name, value)
+		}
+	}
+
+	cars, err := overrideCars(nodeConfig.Node.Cars, givenFlags)
+	if err != nil {
+		fmt.Println("(main) Invalid flags:", err)
+		os.Exit(1)
+	}
+	nodeConfig.Node.Cars = cars
+
+	validationErr := config.Validate(nodeConfig)
+	if *printConfigPtr {
+		dump, _ := json.MarshalIndent(nodeConfig, "", "    ")
+		fmt.Println(string(dump))
+	}
+	if validationErr != nil {
+		fmt.Println("(main) Invalid config:", validationErr)
+		os.Exit(1)
+	}
+	if *printConfigPtr {
+		return
+	}
+
+	if nodeConfig.Logging.File != "" {
+		logFile, err := os.OpenFile(nodeConfig.Logging.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			fmt.Println("(main) Could not open the log file:", err)
+			os.Exit(1)
+		}
+		os.Stdout = logFile
+		os.Stderr = logFile
+	}
+
+	// Set numFloors to equal the global const defined in elevio.go
+	numFloors := elevio.NumFloors
+	fmt.Println("(main) numFloors: ", numFloors)
+
+	var minorityPolicy datatypes.MinorityPolicy
+	switch network.MinorityPolicy {
+	case config.MinorityCabOnly:
+		minorityPolicy = datatypes.ServeCabOnly
+	case config.MinorityAll:
+		minorityPolicy = datatypes.ServeAll
+	}
+
+	assignmentConfig := orderassignment.Config{
+		AssignerPath:     assignment.AssignerPath,
+		AssignerTimeout:  assignment.AssignerTimeout.Duration,
+		DoorOpenDuration: nodeConfig.Timings.DoorOpenHall.Duration,
+		TravelDuration:   nodeConfig.Timings.TravelTime.Duration,
+		ClearRequestType: nodeConfig.Orders.ClearRequestType,
+		SwitchingCost:    assignment.SwitchingCost,
+		FreezeDistance:   assignment.FreezeDistance,
+		Parking:          nodeConfig.Parking,
+		Traffic:          nodeConfig.Traffic,
+		Load:             nodeConfig.Load,
+	}
+
+	// Hall orders are only cancelled by double press if cancelling hall orders is enabled
+	hallCancelWindow := time.Duration(0)
+	if nodeConfig.Orders.CancelHallOrders {
+		hallCancelWindow = nodeConfig.Orders.CancelWindow.Duration
+	}
+
+	for _, car := range nodeConfig.Node.Cars {
+		fmt.Println("(main) localID:", "node_"+car.ID, "driver:", car.Driver, "api:", car.API)
+	}
+	fmt.Printf("(main) network: %+v\n", nodeConfig.Network)
+	fmt.Printf("(main) assignment: %+v\n", nodeConfig.Assignment)
+	fmt.Printf("(main) supervision: %+v\n", nodeConfig.Supervision)
+	fmt.Printf("(main) features: %+v\n", nodeConfig.Features)
+	fmt.Printf("(main) timings: %+v\n", nodeConfig.Timings)
+	fmt.Printf("(main) orders: %+v\n", nodeConfig.Orders)
+	fmt.Printf("(main) parking: %+v\n", nodeConfig.Parking)
+	fmt.Printf("(main) traffic: %+v\n", nodeConfig.Traffic)
+	fmt.Printf("(main) recall: %+v\n", nodeConfig.Recall)
+	fmt.Printf("(main) load: %+v\n", nodeConfig.Load)
+	fmt.Printf("(main) nuisance: %+v\n", nodeConfig.Nuisance)
+	fmt.Printf("(main) faults: %+v\n", nodeConfig.Faults)
+	fmt.Printf("(main) io: %+v\n", nodeConfig.IO)
+
+	// Start the network stack of the process, shared by all the nodes
+	// (Stopped once the nodes have stopped, as they broadcast through it until then)
+	// -----
+	stackCtx, stopStack := context.WithCancel(context.Background())
+	stack := startStack(stackCtx, nodeConfig.Network)
+
+	// Start a node for every car, each with its own driver connection and node ID
+	// (The nodes are attached to the same network stack, but are still separate nodes
+	// to the other nodes, as if they were run by separate processes)
+	// -----
+	settings := nodeSettings{
+		numFloors:        numFloors,
+		nodeConfig:       nodeConfig,
+		minorityPolicy:   minorityPolicy,
+		assignmentConfig: assignmentConfig,
+		hallCancelWindow: hallCancelWindow,
+	}
+	// (Stopped through ctx when shutting down)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	nodes := []fsm.Channels{}
+	supervisors := []*supervisor.Supervisor{}
+	for _, car := range nodeConfig.Node.Cars {
+		fsmChns, sv := startNode(ctx, car, stack, settings)
+		nodes = append(nodes, fsmChns)
+		supervisors = append(supervisors, sv)
+	}
+
+	fmt.Println("(main) Started all goroutines.")
+
+	// Shut down gracefully on Ctrl-C or SIGTERM (a second signal exits at once)
+	// -----
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	go func() {
+		<-signals
+		fmt.Println("(main) Forced exit")
+		os.Exit(1)
+	}()
+	shutdown(nodes, nodeConfig.Timings.MotorTimeout.Duration)
+
+	cancel()
+	for _, sv := range supervisors {
+		if names := sv.Wait(stopTimeout); len(names) != 0 {
+			fmt.Println("(main) Modules not stopped:", strings.Join(names, ", "))
+		}
+	}
+	stopStack()
+	fmt.Println("(main) Stopped")
+}
+
+// Least time the departure of the nodes is announced on the network before they stop
+// (Long enough for the other nodes to receive it despite lost packets)
+const departureAnnouncement = 250 * time.Millisecond
+
+// Time allowed for the modules of a node to return once the node has departed
+const stopTimeout = 2 * time.Second
+
+// shutdown ...
+// Lets every node stop its car at the nearest floor, hand its hall orders over to the
+// other nodes and announce its departure on the network.
+// Gives up on nodes that haven't departed within the motor timeout (and some slack).
+func shutdown(nodes []fsm.Channels, motorTimeout time.Duration) {
+	fmt.Println("(main) Shutting down")
+	started := time.Now()
+
+	for _, node := range nodes {
+		node.ShutdownChan <- struct{}{}
+	}
+
+	deadline := time.After(motorTimeout + time.Second)
+	for i, node := range nodes {
+		select {
+		case <-node.DepartedChan:
+		case <-deadline:
+			fmt.Println("(main) Gave up waiting for", len(nodes)-i, "node(s) to depart")
+			return
+		}
+	}
+
+	time.Sleep(departureAnnouncement - time.Since(started))
+}
+
+// nodeSettings ...
+// The settings shared by all the nodes run by the process
+type nodeSettings struct {
+	numFloors        int
+	nodeConfig       config.Config
+	minorityPolicy   datatypes.MinorityPolicy
+	assignmentConfig orderassignment.Config
+	hallCancelWindow time.Duration
+}
+
+// overrideCars ...
+// Overrides the cars of the config file with the comma-separated node IDs, elevator ports
+// and API addresses given on the command line. Passing -id replaces the cars, one per ID,
+// while -port and -api must give one value per car.
+// @return: The cars run by the process, or an error if the lists do not match
+func overrideCars(cars []config.Car, givenFlags map[string]string) ([]config.Car, error) {
+	cars = append([]config.Car{}, cars...)
+
+	if ids, ok := givenFlags["id"]; ok {
+		idList := strings.Split(ids, ",")
+		for len(cars) < len(idList) {
+			cars = append(cars, config.Car{Driver: "localhost:15657"})
+		}
+		cars = cars[:len(idList)]
+		for i := range idList {
+			cars[i].ID = strings.TrimSpace(idList[i])
+		}
+	}
+
+	if ports, ok := givenFlags["port"]; ok {
+		portList := strings.Split(ports, ",")
+		if len(portList) != len(cars) {
+			return nil, fmt.Errorf("-port gives %d ports for %d cars (expected one per car)", len(portList), len(cars))
+		}
+		for i := range portList {
+			port, err := strconv.Atoi(strings.TrimSpace(portList[i]))
+			if err != nil {
+				return nil, fmt.Errorf("-port: invalid port %q", portList[i])
+			}
+			cars[i].Driver = "localhost:" + strconv.Itoa(port)
+		}
+	}
+
+	if apiAddrs, ok := givenFlags["api"]; ok {
+		apiList := make([]string, len(cars))
+		if apiAddrs != "" {
+			apiList = strings.Split(apiAddrs, ",")
+		}
+		if len(apiList) != len(cars) {
+			return nil, fmt.Errorf("-api gives %d addresses for %d cars (expected one per car)", len(apiList), len(cars))
+		}
+		for i := range apiList {
+			cars[i].API = strings.TrimSpace(apiList[i])
+		}
+	}
+	return cars, nil
+}
+
+// startStack ...
+// Starts the network stack shared by the nodes run by the process, stopped when ctx is cancelled
+// @return: The network stack
+func startStack(ctx context.Context, networkConfig config.Network) *network.Stack {
+	peerConfig := networkConfig.Peers
+	return network.NewStack(ctx, networkConfig.Ports, peers.Config{
+		Interval:     peerConfig.Interval.Duration,
+		Timeout:      peerConfig.Timeout.Duration,
+		MaxTimeout:   peerConfig.MaxTimeout.Duration,
+		PhiThreshold: peerConfig.PhiThreshold,
+		SuspectPhi:   peerConfig.SuspectPhi,
+		SuspectLoss:  peerConfig.SuspectLoss,
+		WindowSize:   peerConfig.WindowSize,
+	})
+}
+
+// startNode ...
+// Starts all the modules of the node running the car, stopped when ctx is cancelled.
+// (The network module of the node is attached to the network stack of the process)
+// @return: The channels of the FSM, used for shutting the node down, and the supervisor
+// running the modules
+func startNode(ctx context.Context, car config.Car, stack *network.Stack, settings nodeSettings) (fsm.Channels, *supervisor.Supervisor) {
+	localID := "node_" + datatypes.NodeID(car.ID)
 
 	// Connect to elevator through tcp (either hardware or simulator)
 	// -----
-	elevio.Init("localhost:" + strconv.Itoa(port))
+	drv := elevio.NewDriver(car.Driver, elevio.PollConfig{
+		PollRate:      settings.nodeConfig.IO.PollRate.Duration,
+		FloorPollRate: settings.nodeConfig.IO.FloorPollRate.Duration,
+		Notify:        settings.nodeConfig.IO.Notify,
+	})
 
 	// Initialize channels
 	// -----
 	iolightsChns := elevio.LightsChannels{
-		TurnOnLightsChan:     make(chan elevio.ButtonEvent),
-		TurnOffLightsChan:    make(chan elevio.ButtonEvent),
-		FloorIndicatorChan:   make(chan int),
-		TurnOffHallLightChan: make(chan elevio.ButtonEvent),
-		TurnOnHallLightChan:  make(chan elevio.ButtonEvent),
-		TurnOffCabLightChan:  make(chan elevio.ButtonEvent),
-		TurnOnCabLightChan:   make(chan elevio.ButtonEvent),
+		TurnOnLightsChan:       make(chan elevio.ButtonEvent),
+		TurnOffLightsChan:      make(chan elevio.ButtonEvent),
+		FloorIndicatorChan:     make(chan int),
+		TurnOffHallLightChan:   make(chan elevio.ButtonEvent),
+		TurnOnHallLightChan:    make(chan elevio.ButtonEvent),
+		TurnOffCabLightChan:    make(chan elevio.ButtonEvent),
+		TurnOnCabLightChan:     make(chan elevio.ButtonEvent),
+		DestinationDisplayChan: make(chan elevio.DestinationAnnouncement, 10),
+		ETADisplayChan:         make(chan elevio.ETAAnnouncement, 10),
 	}
 	fsmChns := fsm.Channels{
 		ArrivedAtFloorChan:          make(chan int),
 		ToggleNetworkVisibilityChan: make(chan bool),
+		ParkingTargetChan:           make(chan datatypes.ParkingTarget, 2),
+		RecallChan:                  make(chan bool, 2),
+		ModeChan:                    make(chan datatypes.NodeMode),
+		KeySwitchChan:               make(chan bool),
+		LoadSensorChan:              make(chan float64),
+		ObstructionChan:             make(chan bool),
+		HandoverChan:                make(chan datatypes.ConfirmedHallOrdersMatrix),
+		HardwareChan:                make(chan bool),
+		ShutdownChan:                make(chan struct{}, 1),
+		DepartureChan:               make(chan datatypes.ConfirmedHallOrdersMatrix),
+		DepartedChan:                make(chan struct{}, 1),
 	}
 	orderassignmentChns := orderassignment.Channels{
 		LocallyAssignedOrdersChan: make(chan datatypes.AssignedOrdersMatrix, 2),
 		PeerlistUpdateChan:        make(chan []datatypes.NodeID),
+		PartitionUpdateChan:       make(chan datatypes.PartitionStatus, 2),
+		PeerHealthChan:            make(chan datatypes.PeerHealthMap, 2),
 	}
 	nodestatesChns := nodestates.Channels{
-		LocalNodeStateChan: make(chan datatypes.NodeState, 2),
-		AllNodeStatesChan:  make(chan datatypes.AllNodeStatesMap, 10),
-		NodeLostChan:       make(chan datatypes.NodeID),
-	}
-	networkChns := network.Channels{
-		LocalNodeStateChan:   make(chan datatypes.NodeState),
-		RemoteNodeStatesChan: make(chan nodestates.NodeStateMsg, 2),
+		LocalNodeStateChan:    make(chan datatypes.NodeState, 2),
+		AllNodeStatesChan:     make(chan datatypes.AllNodeStatesMap, 10),
+		NodeLostChan:          make(chan datatypes.NodeID),
+		TrafficModeChan:       make(chan datatypes.TrafficMode, 2),
+		HallOrdersChan:        make(chan datatypes.ConfirmedHallOrdersMatrix, 2),
+		DestinationOrdersChan: make(chan datatypes.ConfirmedDestinationOrdersMatrix, 2),
+		SuspectsChan:          make(chan []datatypes.NodeID, 2),
 	}
 	hallConsensusChns := consensus.HallOrderChannels{
-		CompletedOrderChan:  make(chan int),
+		CompletedOrderChan:  make(chan elevio.ButtonEvent, 4),
 		NewOrderChan:        make(chan elevio.ButtonEvent),
 		ConfirmedOrdersChan: make(chan datatypes.ConfirmedHallOrdersMatrix, 2),
 		LocalOrdersChan:     make(chan datatypes.HallOrdersMatrix, 2),
 		RemoteOrdersChan:    make(chan datatypes.HallOrdersMatrix, 10),
 		PeerlistUpdateChan:  make(chan []datatypes.NodeID),
+		PartitionUpdateChan: make(chan datatypes.PartitionStatus, 2),
+		RecallChan:          make(chan bool, 2),
+		CancelOrderChan:     make(chan elevio.ButtonEvent),
 	}
 	cabConsensusChns := consensus.CabOrderChannels{
 		CompletedOrderChan:  make(chan int),
 		NewOrderChan:        make(chan int),
+		BoardingOrderChan:   make(chan int, elevio.NumFloors),
 		ConfirmedOrdersChan: make(chan datatypes.ConfirmedCabOrdersMap, 2),
 		LocalOrdersChan:     make(chan datatypes.CabOrdersMap, 2),
 		RemoteOrdersChan:    make(chan datatypes.CabOrdersMap, 10),
 		PeerlistUpdateChan:  make(chan []datatypes.NodeID),
 		LostPeerChan:        make(chan datatypes.NodeID),
+		RecallChan:          make(chan bool, 2),
+		CancelOrderChan:     make(chan int, elevio.NumFloors),
+	}
+	destinationConsensusChns := consensus.DestinationOrderChannels{
+		NewOrderChan:        make(chan elevio.DestinationEvent),
+		CompletedOrderChan:  make(chan elevio.ButtonEvent, 2),
+		ConfirmedOrdersChan: make(chan datatypes.ConfirmedDestinationOrdersMatrix, 2),
+		AssignmentChan:      make(chan datatypes.DestinationAssignmentMatrix, 2),
+		LocalOrdersChan:     make(chan datatypes.DestinationOrdersMatrix, 2),
+		RemoteOrdersChan:    make(chan datatypes.DestinationOrdersMatrix, 10),
+		PeerlistUpdateChan:  make(chan []datatypes.NodeID),
+		PartitionUpdateChan: make(chan datatypes.PartitionStatus, 2),
+		RecallChan:          make(chan bool, 2),
+	}
+	recallConsensusChns := consensus.RecallChannels{
+		CommandChan:         make(chan bool),
+		LocalRecallChan:     make(chan datatypes.Req, 2),
+		RemoteRecallChan:    make(chan datatypes.Req, 10),
+		PeerlistUpdateChan:  make(chan []datatypes.NodeID),
+		PartitionUpdateChan: make(chan datatypes.PartitionStatus, 2),
+	}
+	apiChns := api.Channels{
+		DestinationAnnouncementChan: make(chan elevio.DestinationAnnouncement, 10),
+		RecallChan:                  make(chan bool, 2),
+		AllNodeStatesChan:           make(chan datatypes.AllNodeStatesMap, 10),
+		ETAsChan:                    make(chan datatypes.HallETAsMatrix, 2),
+		ModuleHealthChan:            make(chan datatypes.ModuleHealthMap, 2),
+		ReassignmentsChan:           make(chan datatypes.ReassignmentsMatrix, 2),
+	}
+	etaChns := eta.Channels{
+		LocalETAsChan:  make(chan datatypes.HallETAsMatrix, 2),
+		RemoteETAsChan: make(chan eta.ETAMsg, 10),
+	}
+	networkChns := network.Channels{
+		FsmToggleNetworkVisibilityChan: fsmChns.ToggleNetworkVisibilityChan,
+		FsmHandoverChan:                fsmChns.HandoverChan,
+		FsmDepartureChan:               fsmChns.DepartureChan,
+		LocalNodeStateChan:             make(chan datatypes.NodeState),
+		RemoteNodeStatesChan:           make(chan nodestates.NodeStateMsg, 2),
+		NodeLostChan:                   nodestatesChns.NodeLostChan,
+		PeerlistUpdateAssignerChan:     orderassignmentChns.PeerlistUpdateChan,
+		PartitionUpdateAssignerChan:    orderassignmentChns.PartitionUpdateChan,
+		PeerHealthAssignerChan:         orderassignmentChns.PeerHealthChan,
+		LocalHallOrdersChan:            hallConsensusChns.LocalOrdersChan,
+		RemoteHallOrdersChan:           hallConsensusChns.RemoteOrdersChan,
+		PeerlistUpdateHallChan:         hallConsensusChns.PeerlistUpdateChan,
+		PartitionUpdateHallChan:        hallConsensusChns.PartitionUpdateChan,
+		LocalCabOrdersChan:             cabConsensusChns.LocalOrdersChan,
+		RemoteCabOrdersChan:            cabConsensusChns.RemoteOrdersChan,
+		PeerlistUpdateCabChan:          cabConsensusChns.PeerlistUpdateChan,
+		LostPeerCabChan:                cabConsensusChns.LostPeerChan,
+		LocalDestinationOrdersChan:     destinationConsensusChns.LocalOrdersChan,
+		RemoteDestinationOrdersChan:    destinationConsensusChns.RemoteOrdersChan,
+		PeerlistUpdateDestinationChan:  destinationConsensusChns.PeerlistUpdateChan,
+		PartitionUpdateDestinationChan: destinationConsensusChns.PartitionUpdateChan,
+		LocalRecallChan:                recallConsensusChns.LocalRecallChan,
+		RemoteRecallChan:               recallConsensusChns.RemoteRecallChan,
+		PeerlistUpdateRecallChan:       recallConsensusChns.PeerlistUpdateChan,
+		PartitionUpdateRecallChan:      recallConsensusChns.PartitionUpdateChan,
+		LocalETAsChan:                  etaChns.LocalETAsChan,
+		RemoteETAsChan:                 etaChns.RemoteETAsChan,
 	}
 	// Note: Buffer are added to some of the channels to avoid issues with circular communication
 	// and with many nodes transmitting on the network simultaneously.
 
 	// Start modules
 	// -----
-	go elevio.IOReader(
-		hallConsensusChns.NewOrderChan,
-		cabConsensusChns.NewOrderChan,
-		fsmChns.ArrivedAtFloorChan,
-		iolightsChns.FloorIndicatorChan)
-
-	go elevio.LightHandler(
-		numFloors,
-		iolightsChns.TurnOffHallLightChan,
-		iolightsChns.TurnOnHallLightChan,
-		iolightsChns.TurnOffCabLightChan,
-		iolightsChns.TurnOnCabLightChan,
-		iolightsChns.FloorIndicatorChan)
-
-	go fsm.StateMachine(
-		numFloors,
-		fsmChns.ArrivedAtFloorChan,
-		fsmChns.ToggleNetworkVisibilityChan,
-		orderassignmentChns.LocallyAssignedOrdersChan,
-		hallConsensusChns.CompletedOrderChan,
-		cabConsensusChns.CompletedOrderChan,
-		nodestatesChns.LocalNodeStateChan)
-
-	go nodestates.Handler(
-		localID,
-		nodestatesChns.LocalNodeStateChan,
-		nodestatesChns.AllNodeStatesChan,
-		nodestatesChns.NodeLostChan,
-		networkChns.LocalNodeStateChan,
-		networkChns.RemoteNodeStatesChan)
-
-	go orderassignment.OptimalAssigner(
-		localID,
-		numFloors,
-		orderassignmentChns.PeerlistUpdateChan,
-		orderassignmentChns.LocallyAssignedOrdersChan,
-		hallConsensusChns.ConfirmedOrdersChan,
-		cabConsensusChns.ConfirmedOrdersChan,
-		nodestatesChns.AllNodeStatesChan)
-
-	go network.Module(
-		localID,
-		fsmChns.ToggleNetworkVisibilityChan,
-		networkChns.LocalNodeStateChan,
-		networkChns.RemoteNodeStatesChan,
-		nodestatesChns.NodeLostChan,
-		orderassignmentChns.PeerlistUpdateChan,
-		hallConsensusChns.LocalOrdersChan,
-		hallConsensusChns.RemoteOrdersChan,
-		hallConsensusChns.PeerlistUpdateChan,
-		cabConsensusChns.LocalOrdersChan,
-		cabConsensusChns.RemoteOrdersChan,
-		cabConsensusChns.PeerlistUpdateChan,
-		cabConsensusChns.LostPeerChan)
-
-	go consensus.HallOrdersModule(
-		localID,
-		hallConsensusChns.NewOrderChan,
-		hallConsensusChns.ConfirmedOrdersChan,
-		hallConsensusChns.CompletedOrderChan,
-		iolightsChns.TurnOffHallLightChan,
-		iolightsChns.TurnOnHallLightChan,
-		hallConsensusChns.LocalOrdersChan,
-		hallConsensusChns.RemoteOrdersChan,
-		hallConsensusChns.PeerlistUpdateChan)
-
-	go consensus.CabOrdersModule(
-		localID,
-		cabConsensusChns.NewOrderChan,
-		cabConsensusChns.ConfirmedOrdersChan,
-		cabConsensusChns.CompletedOrderChan,
-		iolightsChns.TurnOffCabLightChan,
-		iolightsChns.TurnOnCabLightChan,
-		cabConsensusChns.LocalOrdersChan,
-		cabConsensusChns.RemoteOrdersChan,
-		cabConsensusChns.PeerlistUpdateChan,
-		cabConsensusChns.LostPeerChan)
+	// Every module is run by the supervisor of the node, which restarts the modules that fail
+	// and reports the health of the modules to the control API
+	sv := supervisor.New(ctx, localID, settings.nodeConfig.Supervision, apiChns.ModuleHealthChan)
 
-	fmt.Println("(main) Started all goroutines.")
+	// (Reconnects to the elevator whenever the connection is lost)
+	sv.Start(ctx, "connection", func(ctx context.Context, heartbeat <-chan struct{}) error {
+		return drv.ConnectionHandler(ctx, heartbeat, fsmChns.HardwareChan)
+	})
+
+	sv.Start(ctx, "ioreader", func(ctx context.Context, heartbeat <-chan struct{}) error {
+		return elevio.IOReader(
+			ctx,
+			heartbeat,
+			drv,
+			hallConsensusChns.NewOrderChan,
+			cabConsensusChns.NewOrderChan,
+			fsmChns.ArrivedAtFloorChan,
+			iolightsChns.FloorIndicatorChan,
+			fsmChns.KeySwitchChan,
+			fsmChns.ObstructionChan)
+	})
 
-	for {
-		select {}
+	// (The load-weighing input is only polled when used)
+	if settings.nodeConfig.Load.Source == config.LoadSensor {
+		sv.Start(ctx, "loadreader", func(ctx context.Context, heartbeat <-chan struct{}) error {
+			return elevio.LoadReader(ctx, heartbeat, drv, fsmChns.LoadSensorChan)
+		})
 	}
+
+	sv.Start(ctx, "lights", func(ctx context.Context, heartbeat <-chan struct{}) error {
+		return elevio.LightHandler(
+			ctx,
+			heartbeat,
+			drv,
+			settings.numFloors,
+			iolightsChns.TurnOffHallLightChan,
+			iolightsChns.TurnOnHallLightChan,
+			iolightsChns.TurnOffCabLightChan,
+			iolightsChns.TurnOnCabLightChan,
+			iolightsChns.FloorIndicatorChan,
+			iolightsChns.DestinationDisplayChan,
+			iolightsChns.ETADisplayChan)
+	})
+
+	sv.Start(ctx, "fsm", func(ctx context.Context, heartbeat <-chan struct{}) error {
+		return fsm.StateMachine(
+			ctx,
+			heartbeat,
+			drv,
+			settings.numFloors,
+			fsmChns.ArrivedAtFloorChan,
+			fsmChns.ToggleNetworkVisibilityChan,
+			orderassignmentChns.LocallyAssignedOrdersChan,
+			hallConsensusChns.CompletedOrderChan,
+			cabConsensusChns.CompletedOrderChan,
+			nodestatesChns.LocalNodeStateChan,
+			destinationConsensusChns.CompletedOrderChan,
+			settings.nodeConfig.Timings,
+			settings.nodeConfig.Orders.ClearRequestType,
+			fsmChns.ParkingTargetChan,
+			fsmChns.RecallChan,
+			settings.nodeConfig.Recall.Floor,
+			fsmChns.ModeChan,
+			fsmChns.KeySwitchChan,
+			settings.nodeConfig.Load,
+			fsmChns.LoadSensorChan,
+			fsmChns.ObstructionChan,
+			cabConsensusChns.CancelOrderChan,
+			settings.nodeConfig.Nuisance,
+			fsmChns.HandoverChan,
+			settings.nodeConfig.Faults,
+			fsmChns.HardwareChan,
+			fsmChns.ShutdownChan,
+			fsmChns.DepartureChan,
+			fsmChns.DepartedChan)
+	})
+
+	sv.Start(ctx, "nodestates", func(ctx context.Context, heartbeat <-chan struct{}) error {
+		return nodestates.Handler(
+			ctx,
+			heartbeat,
+			localID,
+			nodestatesChns.LocalNodeStateChan,
+			nodestatesChns.AllNodeStatesChan,
+			nodestatesChns.NodeLostChan,
+			networkChns.LocalNodeStateChan,
+			networkChns.RemoteNodeStatesChan,
+			settings.nodeConfig.Network.StateTimeout.Duration,
+			nodestatesChns.TrafficModeChan,
+			nodestatesChns.HallOrdersChan,
+			nodestatesChns.DestinationOrdersChan,
+			nodestatesChns.SuspectsChan,
+			apiChns.AllNodeStatesChan)
+	})
+
+	sv.Start(ctx, "optimalassigner", func(ctx context.Context, heartbeat <-chan struct{}) error {
+		return orderassignment.OptimalAssigner(
+			ctx,
+			heartbeat,
+			localID,
+			settings.numFloors,
+			orderassignmentChns.PeerlistUpdateChan,
+			orderassignmentChns.LocallyAssignedOrdersChan,
+			hallConsensusChns.ConfirmedOrdersChan,
+			cabConsensusChns.ConfirmedOrdersChan,
+			nodestatesChns.AllNodeStatesChan,
+			destinationConsensusChns.ConfirmedOrdersChan,
+			destinationConsensusChns.AssignmentChan,
+			fsmChns.ParkingTargetChan,
+			nodestatesChns.TrafficModeChan,
+			etaChns.LocalETAsChan,
+			settings.minorityPolicy,
+			orderassignmentChns.PartitionUpdateChan,
+			orderassignmentChns.PeerHealthChan,
+			nodestatesChns.HallOrdersChan,
+			nodestatesChns.DestinationOrdersChan,
+			nodestatesChns.SuspectsChan,
+			apiChns.ReassignmentsChan,
+			settings.assignmentConfig)
+	})
+
+	sv.Start(ctx, "network", func(ctx context.Context, heartbeat <-chan struct{}) error {
+		return network.Module(
+			ctx,
+			heartbeat,
+			localID,
+			stack,
+			networkChns,
+			settings.nodeConfig.Network.GroupSize,
+			settings.nodeConfig.Network.ForgetAfter.Duration)
+	})
+
+	sv.Start(ctx, "eta", func(ctx context.Context, heartbeat <-chan struct{}) error {
+		return eta.Handler(
+			ctx,
+			heartbeat,
+			etaChns.RemoteETAsChan,
+			apiChns.ETAsChan,
+			iolightsChns.ETADisplayChan,
+			settings.nodeConfig.Features.ETADisplay)
+	})
+
+	sv.Start(ctx, "consensus:hallorders", func(ctx context.Context, heartbeat <-chan struct{}) error {
+		return consensus.HallOrdersModule(
+			ctx,
+			heartbeat,
+			localID,
+			hallConsensusChns.NewOrderChan,
+			hallConsensusChns.ConfirmedOrdersChan,
+			hallConsensusChns.CompletedOrderChan,
+			iolightsChns.TurnOffHallLightChan,
+			iolightsChns.TurnOnHallLightChan,
+			hallConsensusChns.LocalOrdersChan,
+			hallConsensusChns.RemoteOrdersChan,
+			hallConsensusChns.PeerlistUpdateChan,
+			settings.minorityPolicy,
+			hallConsensusChns.PartitionUpdateChan,
+			hallConsensusChns.RecallChan,
+			hallConsensusChns.CancelOrderChan,
+			settings.hallCancelWindow)
+	})
+
+	sv.Start(ctx, "consensus:caborders", func(ctx context.Context, heartbeat <-chan struct{}) error {
+		return consensus.CabOrdersModule(
+			ctx,
+			heartbeat,
+			localID,
+			cabConsensusChns.NewOrderChan,
+			cabConsensusChns.BoardingOrderChan,
+			cabConsensusChns.ConfirmedOrdersChan,
+			cabConsensusChns.CompletedOrderChan,
+			iolightsChns.TurnOffCabLightChan,
+			iolightsChns.TurnOnCabLightChan,
+			cabConsensusChns.LocalOrdersChan,
+			cabConsensusChns.RemoteOrdersChan,
+			cabConsensusChns.PeerlistUpdateChan,
+			cabConsensusChns.LostPeerChan,
+			cabConsensusChns.RecallChan,
+			cabConsensusChns.CancelOrderChan,
+			settings.nodeConfig.Orders.CancelWindow.Duration)
+	})
+
+	sv.Start(ctx, "consensus:destinationorders", func(ctx context.Context, heartbeat <-chan struct{}) error {
+		return consensus.DestinationOrdersModule(
+			ctx,
+			heartbeat,
+			localID,
+			destinationConsensusChns.NewOrderChan,
+			destinationConsensusChns.ConfirmedOrdersChan,
+			destinationConsensusChns.CompletedOrderChan,
+			destinationConsensusChns.AssignmentChan,
+			cabConsensusChns.BoardingOrderChan,
+			iolightsChns.DestinationDisplayChan,
+			apiChns.DestinationAnnouncementChan,
+			destinationConsensusChns.LocalOrdersChan,
+			destinationConsensusChns.RemoteOrdersChan,
+			destinationConsensusChns.PeerlistUpdateChan,
+			settings.minorityPolicy,
+			destinationConsensusChns.PartitionUpdateChan,
+			destinationConsensusChns.RecallChan)
+	})
+
+	sv.Start(ctx, "consensus:recall", func(ctx context.Context, heartbeat <-chan struct{}) error {
+		return consensus.RecallModule(
+			ctx,
+			heartbeat,
+			localID,
+			recallConsensusChns.CommandChan,
+			recallConsensusChns.LocalRecallChan,
+			recallConsensusChns.RemoteRecallChan,
+			recallConsensusChns.PeerlistUpdateChan,
+			recallConsensusChns.PartitionUpdateChan,
+			fsmChns.RecallChan,
+			hallConsensusChns.RecallChan,
+			cabConsensusChns.RecallChan,
+			destinationConsensusChns.RecallChan,
+			apiChns.RecallChan)
+	})
+
+	sv.Start(ctx, "api", func(ctx context.Context, heartbeat <-chan struct{}) error {
+		return api.Server(
+			ctx,
+			heartbeat,
+			car.API,
+			localID,
+			destinationConsensusChns.NewOrderChan,
+			apiChns.DestinationAnnouncementChan,
+			recallConsensusChns.CommandChan,
+			apiChns.RecallChan,
+			fsmChns.ModeChan,
+			apiChns.AllNodeStatesChan,
+			apiChns.ETAsChan,
+			cabConsensusChns.CancelOrderChan,
+			hallConsensusChns.CancelOrderChan,
+			settings.nodeConfig.Orders.CancelHallOrders,
+			apiChns.ModuleHealthChan,
+			apiChns.ReassignmentsChan)
+	})
+
+	return fsmChns, sv
 }
@@ -2,6 +2,7 @@ package bcast
 
 import (
 	"../conn"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -11,8 +12,8 @@ import (
 
 // Transmitter ...
 // Encodes received values from `chans` into type-tagged JSON, then broadcasts
-// it on `port`
-func Transmitter(port int, chans ...interface{}) {
+// it on `port` until `ctx` is cancelled
+func Transmitter(ctx context.Context, port int, chans ...interface{}) {
 	checkArgs(chans...)
 
 	n := 0
@@ -20,7 +21,8 @@ func Transmitter(port int, chans ...interface{}) {
 		n++
 	}
 
-	selectCases := make([]reflect.SelectCase, n)
+	// (The last case is the cancellation of ctx)
+	selectCases := make([]reflect.SelectCase, n+1)
 	typeNames := make([]string, n)
 	for i, ch := range chans {
 		selectCases[i] = reflect.SelectCase{
@@ -29,11 +31,19 @@ func Transmitter(port int, chans ...interface{}) {
 		}
 		typeNames[i] = reflect.TypeOf(ch).Elem().String()
 	}
+	selectCases[n] = reflect.SelectCase{
+		Dir:  reflect.SelectRecv,
+		Chan: reflect.ValueOf(ctx.Done()),
+	}
 
 	conn := conn.DialBroadcastUDP(port)
+	defer conn.Close()
 	addr, _ := net.ResolveUDPAddr("udp4", fmt.Sprintf("255.255.255.255:%d", port))
 	for {
 		chosen, value, _ := reflect.Select(selectCases)
+		if chosen == n {
+			return
+		}
 		buf, _ := json.Marshal(value.Interface())
 		conn.WriteTo([]byte(typeNames[chosen]+string(buf)), addr)
 	}
@@ -41,16 +51,29 @@ func Transmitter(port int, chans ...interface{}) {
 
 // Receiver ...
 // Matches type-tagged JSON received on `port` to element types of `chans`, then
-// sends the decoded value on the corresponding channel
-func Receiver(port int, chans ...interface{}) {
+// sends the decoded value on the corresponding channel, until `ctx` is cancelled
+func Receiver(ctx context.Context, port int, chans ...interface{}) {
 	checkArgs(chans...)
 
 	// Buffer size needs to be increased for many nodes and more floors.
 	// (Or else it overflows, causing the whole node network to freeze)
 	var buf [1024*2]byte
 	conn := conn.DialBroadcastUDP(port)
+
+	// Closing the connection stops the blocking read
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
 	for {
-		n, _, _ := conn.ReadFrom(buf[0:])
+		n, _, err := conn.ReadFrom(buf[0:])
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			continue
+		}
 		for _, ch := range chans {
 			T := reflect.TypeOf(ch).Elem()
 			typeName := T.String()
@@ -62,6 +85,9 @@ func Receiver(port int, chans ...interface{}) {
 					Dir:  reflect.SelectSend,
 					Chan: reflect.ValueOf(ch),
 					Send: reflect.Indirect(v),
+				}, {
+					Dir:  reflect.SelectRecv,
+					Chan: reflect.ValueOf(ctx.Done()),
 				}})
 			}
 		}
@@ -2,7 +2,9 @@ package peers
 
 import (
 	"../conn"
+	"context"
 	"fmt"
+	"math"
 	"net"
 	"sort"
 	"time"
@@ -14,74 +16,270 @@ type PeerUpdate struct {
 	Lost  []string
 }
 
-const interval = 15 * time.Millisecond
-const timeout = 200 * time.Millisecond
+// Health ...
+// Liveness statistics of a single peer, based on the arrival times of its heartbeats.
+type Health struct {
+	// Suspicion level (phi accrual), grows the longer the peer has been silent
+	// compared to its usual heartbeat arrival times
+	Phi float64
 
-func Transmitter(port int, id string, transmitEnable <-chan bool) {
+	// Estimated fraction of heartbeats lost (between 0 and 1)
+	LossRate float64
+
+	// Standard deviation of the heartbeat inter-arrival times
+	Jitter time.Duration
+
+	// The peer is marginal and should be demoted, but is not yet declared lost
+	Suspect bool
+}
+
+// Config ...
+// Configuration of the heartbeats and of the failure detection.
+type Config struct {
+	// Time between heartbeats
+	Interval time.Duration
+
+	// A peer is never declared lost before being silent for Timeout,
+	// and always declared lost after being silent for MaxTimeout
+	Timeout    time.Duration
+	MaxTimeout time.Duration
+
+	// A peer silent for more than Timeout is declared lost when its phi exceeds
+	// PhiThreshold. (Set to 0 to only use the fixed Timeout)
+	PhiThreshold float64
+
+	// A peer silent for more than half of Timeout is marked as suspect when its
+	// phi exceeds SuspectPhi, and any peer is marked as suspect when its loss
+	// rate exceeds SuspectLoss
+	SuspectPhi  float64
+	SuspectLoss float64
+
+	// Number of inter-arrival times used to estimate the arrival distribution
+	WindowSize int
+}
+
+// Health is reported to other modules with this period
+const healthReportPeriod = 500 * time.Millisecond
+
+// Weight of the newest sample in the moving average of the loss rate
+const lossRateWeight = 0.05
+
+// Heartbeat history of a single peer
+type arrivalHistory struct {
+	lastSeen  time.Time
+	intervals []time.Duration
+	lossRate  float64
+	suspect   bool
+}
+
+// addArrival ...
+// Registers a new heartbeat from the peer
+func addArrival(h *arrivalHistory, now time.Time, config Config) {
+	gap := now.Sub(h.lastSeen)
+	h.lastSeen = now
+
+	h.intervals = append(h.intervals, gap)
+	if len(h.intervals) > config.WindowSize {
+		h.intervals = h.intervals[len(h.intervals)-config.WindowSize:]
+	}
+
+	// Every interval passed without a heartbeat counts as a lost heartbeat
+	missed := math.Max(0, math.Round(float64(gap)/float64(config.Interval))-1)
+	h.lossRate = (1-lossRateWeight)*h.lossRate + lossRateWeight*missed/(missed+1)
+}
+
+// arrivalStats ...
+// @return: Mean and standard deviation of the inter-arrival times of the peer, as measured.
+// (Without any history, the peer is assumed to send perfectly timed heartbeats)
+func arrivalStats(h arrivalHistory, config Config) (float64, float64) {
+	if len(h.intervals) == 0 {
+		return float64(config.Interval), 0
+	}
+
+	mean := 0.0
+	for _, v := range h.intervals {
+		mean += float64(v)
+	}
+	mean /= float64(len(h.intervals))
+
+	variance := 0.0
+	for _, v := range h.intervals {
+		variance += (float64(v) - mean) * (float64(v) - mean)
+	}
+	variance /= float64(len(h.intervals))
+
+	return mean, math.Sqrt(variance)
+}
+
+// phi ...
+// @return: The phi accrual suspicion level of the peer, that is -log10 of the
+// probability of a heartbeat arriving later than the current silence
+// (assuming normally distributed inter-arrival times)
+// The standard deviation used is never smaller than a quarter of the interval, making
+// sure that a few perfectly timed heartbeats won't make the detection oversensitive.
+func phi(h arrivalHistory, now time.Time, config Config) float64 {
+	mean, stdDev := arrivalStats(h, config)
+	stdDev = math.Max(stdDev, float64(config.Interval)/4)
+	silence := float64(now.Sub(h.lastSeen))
+
+	pLater := 0.5 * math.Erfc((silence-mean)/(stdDev*math.Sqrt2))
+	if pLater < 1e-300 {
+		return 300
+	}
+	return -math.Log10(pLater)
+}
+
+// isLost ...
+// @return: true if the peer should be declared lost
+func isLost(h arrivalHistory, now time.Time, config Config) bool {
+	silence := now.Sub(h.lastSeen)
+
+	if silence <= config.Timeout {
+		return false
+	}
+	if config.PhiThreshold <= 0 || silence > config.MaxTimeout {
+		return true
+	}
+	return phi(h, now, config) > config.PhiThreshold
+}
+
+// calcHealth ...
+// @return: The current health of the peer
+func calcHealth(h arrivalHistory, now time.Time, config Config) Health {
+	_, stdDev := arrivalStats(h, config)
+	currPhi := phi(h, now, config)
+
+	silent := config.SuspectPhi > 0 && currPhi > config.SuspectPhi &&
+		now.Sub(h.lastSeen) > config.Timeout/2
+	lossy := config.SuspectLoss > 0 && h.lossRate > config.SuspectLoss
+
+	return Health{
+		Phi:      currPhi,
+		LossRate: h.lossRate,
+		Jitter:   time.Duration(stdDev),
+		Suspect:  silent || lossy,
+	}
+}
+
+// TransmitEnable ...
+// Starts or stops the heartbeats of one of the peers sent by a transmitter
+type TransmitEnable struct {
+	ID     string
+	Enable bool
+}
+
+// Transmitter ...
+// Sends the heartbeats of every enabled peer on `port`, until `ctx` is cancelled.
+// (The peers run by one process share a transmitter, and none are enabled at first)
+func Transmitter(ctx context.Context, port int, interval time.Duration, transmitEnable <-chan TransmitEnable) {
 
 	conn := conn.DialBroadcastUDP(port)
+	defer conn.Close()
 	addr, _ := net.ResolveUDPAddr("udp4", fmt.Sprintf("255.255.255.255:%d", port))
 
-	enable := true
+	enabled := make(map[string]bool)
 	for {
 		select {
-		case enable = <-transmitEnable:
+		case a := <-transmitEnable:
+			if a.Enable {
+				enabled[a.ID] = true
+			} else {
+				delete(enabled, a.ID)
+			}
 		case <-time.After(interval):
+		case <-ctx.Done():
+			return
 		}
-		if enable {
+		for id := range enabled {
 			conn.WriteTo([]byte(id), addr)
 		}
 	}
 }
 
-func Receiver(port int, peerUpdateCh chan<- PeerUpdate) {
+// Receiver ...
+// Keeps track of the peers on the network. Changes in the set of peers are sent
+// on peerUpdateCh, while the health of all peers is sent periodically on healthCh.
+// (Health reports are dropped if the receiving module is busy)
+// Stops when ctx is cancelled.
+func Receiver(ctx context.Context, port int, config Config, peerUpdateCh chan<- PeerUpdate, healthCh chan<- map[string]Health) {
 
 	var buf [1024]byte
 	var p PeerUpdate
-	lastSeen := make(map[string]time.Time)
+	history := make(map[string]*arrivalHistory)
+	lastHealthReport := time.Now()
 
 	conn := conn.DialBroadcastUDP(port)
+	defer conn.Close()
 
 	for {
+		if ctx.Err() != nil {
+			return
+		}
 		updated := false
 
-		conn.SetReadDeadline(time.Now().Add(interval))
+		conn.SetReadDeadline(time.Now().Add(config.Interval))
 		n, _, _ := conn.ReadFrom(buf[0:])
 
 		id := string(buf[:n])
+		now := time.Now()
 
 		// Adding new connection
 		p.New = ""
 		if id != "" {
-			if _, idExists := lastSeen[id]; !idExists {
+			if h, idExists := history[id]; idExists {
+				addArrival(h, now, config)
+			} else {
 				p.New = id
 				updated = true
+				history[id] = &arrivalHistory{lastSeen: now}
 			}
-
-			lastSeen[id] = time.Now()
 		}
 
 		// Removing dead connection
 		p.Lost = make([]string, 0)
-		for k, v := range lastSeen {
-			if time.Now().Sub(v) > timeout {
+		for k, h := range history {
+			if isLost(*h, now, config) {
 				updated = true
 				p.Lost = append(p.Lost, k)
-				delete(lastSeen, k)
+				delete(history, k)
 			}
 		}
 
 		// Sending update
 		if updated {
-			p.Peers = make([]string, 0, len(lastSeen))
+			p.Peers = make([]string, 0, len(history))
 
-			for k, _ := range lastSeen {
+			for k := range history {
 				p.Peers = append(p.Peers, k)
 			}
 
 			sort.Strings(p.Peers)
 			sort.Strings(p.Lost)
-			peerUpdateCh <- p
+			select {
+			case peerUpdateCh <- p:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		// Report health periodically, and immediately when a peer becomes
+		// (or stops being) suspect
+		suspectChanged := false
+		health := make(map[string]Health)
+		for k, h := range history {
+			health[k] = calcHealth(*h, now, config)
+			if health[k].Suspect != h.suspect {
+				h.suspect = health[k].Suspect
+				suspectChanged = true
+			}
+		}
+
+		if suspectChanged || updated || now.Sub(lastHealthReport) > healthReportPeriod {
+			lastHealthReport = now
+			select {
+			case healthCh <- health:
+			default:
+			}
 		}
 	}
 }
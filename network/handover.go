@@ -0,0 +1,73 @@
+package network
+
+import (
+	"../consensus"
+	"../datatypes"
+	"strconv"
+	"time"
+)
+
+// HandoverMsg ...
+// Broadcast by an obstructed node while it is offline, announcing the hall orders it
+// relinquishes. The other nodes leave it out of their peerlist at once, instead of
+// waiting for the peer timeout.
+// A node shutting down broadcasts a departing handover, which is final.
+type HandoverMsg struct {
+	ID         datatypes.NodeID
+	HallOrders datatypes.ConfirmedHallOrdersMatrix
+	Departing  bool
+}
+
+// A node is left out of the peerlist until this long after its last handover message
+// (Letting it rejoin when it recovers before being lost by the peer driver)
+const handoverTimeout = 250 * time.Millisecond
+
+// handover ...
+// A node left out of the peerlist while handing over its orders
+type handover struct {
+	// The node rejoins the peerlist after this time, unless it is still handing over
+	until time.Time
+
+	// The node is shutting down, and is kept out of the peerlist until the peer driver
+	// has lost it
+	departing bool
+}
+
+// buildPeerlist ...
+// @return: The peers seen by the UDP network driver, without the nodes handing over
+// their orders, and always including the local node
+func buildPeerlist(
+	driverPeers []string,
+	handovers map[datatypes.NodeID]handover,
+	localID datatypes.NodeID) []datatypes.NodeID {
+
+	peerlist := []datatypes.NodeID{}
+	for _, currID := range driverPeers {
+		if _, handingOver := handovers[datatypes.NodeID(currID)]; handingOver {
+			continue
+		}
+		peerlist = append(peerlist, (datatypes.NodeID)(currID))
+	}
+
+	// Make sure that the current node is always in peerlist
+	// (will get removed from driverPeers by the driver when there is no network connection)
+	if !consensus.ContainsID(peerlist, localID) {
+		peerlist = append(peerlist, localID)
+	}
+	return peerlist
+}
+
+// hallOrderList ...
+// @return: The hall orders as a list of "floor:direction" strings, for logging
+func hallOrderList(hallOrders datatypes.ConfirmedHallOrdersMatrix) []string {
+	list := []string{}
+	for floor := range hallOrders {
+		if hallOrders[floor][0] {
+			list = append(list, strconv.Itoa(floor)+":up")
+		}
+		if hallOrders[floor][1] {
+			list = append(list, strconv.Itoa(floor)+":down")
+		}
+	}
+	return list
+}
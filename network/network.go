@@ -3,9 +3,9 @@ package network
 import (
 	"../consensus"
 	"../datatypes"
+	"../eta"
 	"../nodestates"
-	"./driver/bcast"
-	"./driver/peers"
+	"context"
 	"fmt"
 	"time"
 )
@@ -13,10 +13,100 @@ import (
 // Channels ...
 // Channels used for communication between the network module and
 // other modules.
+// (Named after the module at the other end, as the network module connects to most of them)
 type Channels struct {
+	// FSM
+	FsmToggleNetworkVisibilityChan chan bool
+	FsmHandoverChan                chan datatypes.ConfirmedHallOrdersMatrix
+	FsmDepartureChan               chan datatypes.ConfirmedHallOrdersMatrix
+
+	// Node states
 	LocalNodeStateChan   chan datatypes.NodeState
 	RemoteNodeStatesChan chan nodestates.NodeStateMsg
-	LocalHallOrdersChan  chan [][]datatypes.Req
+	NodeLostChan         chan datatypes.NodeID
+
+	// Order assignment
+	PeerlistUpdateAssignerChan  chan []datatypes.NodeID
+	PartitionUpdateAssignerChan chan datatypes.PartitionStatus
+	PeerHealthAssignerChan      chan datatypes.PeerHealthMap
+
+	// Hall order consensus
+	LocalHallOrdersChan     chan datatypes.HallOrdersMatrix
+	RemoteHallOrdersChan    chan datatypes.HallOrdersMatrix
+	PeerlistUpdateHallChan  chan []datatypes.NodeID
+	PartitionUpdateHallChan chan datatypes.PartitionStatus
+
+	// Cab order consensus
+	LocalCabOrdersChan    chan datatypes.CabOrdersMap
+	RemoteCabOrdersChan   chan datatypes.CabOrdersMap
+	PeerlistUpdateCabChan chan []datatypes.NodeID
+	LostPeerCabChan       chan datatypes.NodeID
+
+	// Destination order consensus
+	LocalDestinationOrdersChan     chan datatypes.DestinationOrdersMatrix
+	RemoteDestinationOrdersChan    chan datatypes.DestinationOrdersMatrix
+	PeerlistUpdateDestinationChan  chan []datatypes.NodeID
+	PartitionUpdateDestinationChan chan datatypes.PartitionStatus
+
+	// Fire recall consensus
+	LocalRecallChan           chan datatypes.Req
+	RemoteRecallChan          chan datatypes.Req
+	PeerlistUpdateRecallChan  chan []datatypes.NodeID
+	PartitionUpdateRecallChan chan datatypes.PartitionStatus
+
+	// Estimated times of arrival
+	LocalETAsChan  chan datatypes.HallETAsMatrix
+	RemoteETAsChan chan eta.ETAMsg
+}
+
+// sendNodeLost ...
+// Tells the modules that a node is lost from the network
+// @return: false if ctx was cancelled before all modules were told
+func sendNodeLost(ctx context.Context, ID datatypes.NodeID, NodeLostChans ...chan<- datatypes.NodeID) bool {
+	for _, NodeLostChan := range NodeLostChans {
+		select {
+		case NodeLostChan <- ID:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// sendPeerlist ...
+// Updates the peerlist of the modules
+// @return: false if ctx was cancelled before all modules were updated
+func sendPeerlist(
+	ctx context.Context,
+	peerlist []datatypes.NodeID,
+	PeerlistUpdateChans ...chan<- []datatypes.NodeID) bool {
+
+	for _, PeerlistUpdateChan := range PeerlistUpdateChans {
+		select {
+		case PeerlistUpdateChan <- peerlist:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// sendPartitionStatus ...
+// Updates the partition status of the modules
+// @return: false if ctx was cancelled before all modules were updated
+func sendPartitionStatus(
+	ctx context.Context,
+	partitionStatus datatypes.PartitionStatus,
+	PartitionUpdateChans ...chan<- datatypes.PartitionStatus) bool {
+
+	for _, PartitionUpdateChan := range PartitionUpdateChans {
+		select {
+		case PartitionUpdateChan <- partitionStatus:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
 }
 
 // Module ...
@@ -25,60 +115,59 @@ type Channels struct {
 // Information being transmitted and received from network
 // are passed through TX and RX channels, respectively.
 // (This module utilizes an UDP network driver, which mostly has been copied
-// from the project description.)
+// from the project description. The driver is run by the Stack shared by the nodes
+// of the process)
+// When the FSM departs, the departure is announced until ctx is cancelled.
+// (The node is detached from the stack whenever the module returns, and the events sent to
+// the other modules are abandoned when ctx is cancelled, as the modules might have stopped)
 func Module(
+	ctx context.Context,
+	heartbeat <-chan struct{},
 	localID datatypes.NodeID,
-	FsmToggleNetworkVisibilityChan <-chan bool,
-	LocalNodeStateChan <-chan datatypes.NodeState,
-	RemoteNodeStatesChan chan<- nodestates.NodeStateMsg,
-	NodeLostChan chan<- datatypes.NodeID,
-	PeerlistUpdateAssignerChan chan<- []datatypes.NodeID,
-	LocalHallOrdersChan <-chan datatypes.HallOrdersMatrix,
-	RemoteHallOrdersChan chan<- datatypes.HallOrdersMatrix,
-	PeerlistUpdateHallChan chan<- []datatypes.NodeID,
-	LocalCabOrdersChan <-chan datatypes.CabOrdersMap,
-	RemoteCabOrdersChan chan<- datatypes.CabOrdersMap,
-	PeerlistUpdateCabChan chan<- []datatypes.NodeID,
-	LostPeerCabChan chan<- datatypes.NodeID) {
-
-	// Configure Peer List
-	// -----
-	peerUpdateChan := make(chan peers.PeerUpdate, 1)
-	peerTxEnable := make(chan bool) // Used to signal that the node is unavailable
-	go peers.Transmitter(15519, string(localID), peerTxEnable)
-	go peers.Receiver(15519, peerUpdateChan)
-
-	// Setup channels and modules for sending and receiving nodestates.NodeStateMsg
-	// -----
-	localStateTx := make(chan nodestates.NodeStateMsg)
-	remoteStateRx := make(chan nodestates.NodeStateMsg, 10)
-	go bcast.Transmitter(15510, localStateTx)
-	go bcast.Receiver(15510, remoteStateRx)
-
-	// Setup channels and modules for sending and receiving localHallOrder matrices
-	// -----
-	localHallOrdersTx := make(chan consensus.LocalHallOrdersMsg)
-	remoteHallOrdersRx := make(chan consensus.LocalHallOrdersMsg, 10)
-	go bcast.Transmitter(15511, localHallOrdersTx)
-	go bcast.Receiver(15511, remoteHallOrdersRx)
+	stack *Stack,
+	chns Channels,
+	groupSize int,
+	forgetAfter time.Duration) error {
 
-	// Setup channels and modules for sending and receiving localCabOrder maps
+	// Receive the network traffic of the local node through the network stack of the process
 	// -----
-	localCabOrdersTx := make(chan consensus.LocalCabOrdersMsg)
-	remoteCabOrdersRx := make(chan consensus.LocalCabOrdersMsg, 10)
-	go bcast.Transmitter(15512, localCabOrdersTx)
-	go bcast.Receiver(15512, remoteCabOrdersRx)
+	link := stack.attach(localID)
+	defer stack.detach(link)
 
 	// Initialize variables
 	// -----
 	peerlist := []datatypes.NodeID{localID}
+	knownNodes := knownNodesMap{localID: time.Now()}
+	wasMajority := true
+
+	// The peers seen by the UDP network driver, and the nodes handing over their
+	// orders (these are left out of peerlist)
+	driverPeers := []string{}
+	handovers := make(map[datatypes.NodeID]handover)
+	peersChanged := false
+
+	// The hall orders handed over by the local node while it is obstructed, or when departing
+	handingOver := false
+	departing := false
+	var localHandover HandoverMsg
 
 	bcastPeriod := 50 * time.Millisecond
 	bcastTimer := time.NewTimer(bcastPeriod)
+	defer bcastTimer.Stop()
+	forgetTicker := time.NewTicker(time.Second)
+	defer forgetTicker.Stop()
 
 	localNodeState := datatypes.NodeState{}
+
+	// Node states are stamped with the boot ID of the node and a sequence number,
+	// letting the receivers reject node states arriving out of order
+	stateBootID := nodestates.NewBootID()
+	var stateSeq uint64
 	var localHallOrders datatypes.HallOrdersMatrix
 	var localCabOrders datatypes.CabOrdersMap
+	var localDestinationOrders datatypes.DestinationOrdersMatrix
+	var localRecall datatypes.Req
+	var localETAs datatypes.HallETAsMatrix
 
 	fmt.Println("(network) Initialized")
 
@@ -89,69 +178,216 @@ func Module(
 		select {
 
 		// Received any changes related to the connected Peers from the UDP driver
-		case a := <-peerUpdateChan:
+		case a := <-link.peerUpdateRx:
 			// Inform NodeStatesHandler and consensusModules that one ore more nodes are lost from the network
 			for _, currID := range a.Lost {
-				NodeLostChan <- (datatypes.NodeID)(currID)
-				LostPeerCabChan <- (datatypes.NodeID)(currID)
+				if !sendNodeLost(ctx, (datatypes.NodeID)(currID), chns.NodeLostChan, chns.LostPeerCabChan) {
+					return ctx.Err()
+				}
 			}
 
 			// Replace the previous peerlist with the updated one from the UDP network driver
-			peerlist = []datatypes.NodeID{}
-			for _, currID := range a.Peers {
-				peerlist = append(peerlist, (datatypes.NodeID)(currID))
+			driverPeers = a.Peers
+			peersChanged = true
+
+		// Received the health of all visible peers from the UDP driver
+		// (Dropped if the assigner is busy, which might be sending its estimates to the network
+		// module at the same time. The next report follows within the report period)
+		case a := <-link.peerHealthRx:
+			peerHealth := make(datatypes.PeerHealthMap)
+			for currID, currHealth := range a {
+				peerHealth[(datatypes.NodeID)(currID)] = datatypes.PeerHealth{
+					Phi:      currHealth.Phi,
+					LossRate: currHealth.LossRate,
+					Jitter:   currHealth.Jitter,
+					Suspect:  currHealth.Suspect,
+				}
+			}
+			select {
+			case chns.PeerHealthAssignerChan <- peerHealth:
+			default:
 			}
 
-			// Make sure that the current node is always in peerlist
-			// (will get removed from a.Peers by the driver when there is no network connection)
-			if !consensus.ContainsID(peerlist, localID) {
-				peerlist = append(peerlist, localID)
+		// Let FSM toggle network visibility (due to obstructions)
+		case a := <-chns.FsmToggleNetworkVisibilityChan:
+			stack.setVisible(localID, a)
+
+			// Stop handing over when the node is back online
+			if a {
+				handingOver = false
 			}
 
-			PeerlistUpdateHallChan <- peerlist
-			PeerlistUpdateCabChan <- peerlist
-			PeerlistUpdateAssignerChan <- peerlist
+		// Hand the hall orders of the obstructed local node over to the other nodes
+		case a := <-chns.FsmHandoverChan:
+			if !handingOver {
+				fmt.Println("(network) Obstructed, handing over hall orders:", hallOrderList(a))
+			}
+			handingOver = true
+			localHandover = HandoverMsg{
+				ID:         localID,
+				HallOrders: a,
+			}
+			stack.handoverTx <- localHandover
 
-		// Let FSM toggle network visibility (due to obstructions)
-		case a := <-FsmToggleNetworkVisibilityChan:
-			peerTxEnable <- a
+		// Hand the hall orders of the departing local node over to the other nodes, and stop
+		// the heartbeats, so that the other nodes remove the node at once
+		case a := <-chns.FsmDepartureChan:
+			fmt.Println("(network) Departing, handing over hall orders:", hallOrderList(a))
+			stack.setVisible(localID, false)
+			departing = true
+			localHandover = HandoverMsg{
+				ID:         localID,
+				HallOrders: a,
+				Departing:  true,
+			}
+			stack.handoverTx <- localHandover
+
+		// Leave nodes handing over their orders out of peerlist at once
+		// (Their orders are reassigned as if they were lost)
+		case a := <-link.handoverRx:
+			if a.ID == localID {
+				break
+			}
+
+			prev, announced := handovers[a.ID]
+			switch {
+			case a.Departing:
+				// (The peer driver always loses the node within MaxTimeout)
+				handovers[a.ID] = handover{until: time.Now().Add(stack.peerConfig.MaxTimeout), departing: true}
+			case !prev.departing:
+				handovers[a.ID] = handover{until: time.Now().Add(handoverTimeout)}
+			}
+
+			visible := consensus.ContainsID(peerlist, a.ID)
+			if a.Departing && !prev.departing {
+				fmt.Println("(network)", a.ID, "departed, handing over hall orders:", hallOrderList(a.HallOrders))
+
+				// The group shrinks, so that the remaining nodes keep the majority
+				delete(knownNodes, a.ID)
+				peersChanged = true
+			} else if !announced && visible {
+				fmt.Println("(network) Handover from", a.ID, "of hall orders:", hallOrderList(a.HallOrders))
+			}
+
+			if !announced && visible {
+				if !sendNodeLost(ctx, a.ID, chns.NodeLostChan, chns.LostPeerCabChan) {
+					return ctx.Err()
+				}
+				peersChanged = true
+			}
 
 		// Transmit local state
-		case a := <-LocalNodeStateChan:
+		case a := <-chns.LocalNodeStateChan:
 			localNodeState = a
 
 		// Receive remote node states
-		case a := <-remoteStateRx:
+		// (Messages received from the network are dropped if the receiving module is busy,
+		// as if lost on the network. Blocking could deadlock the network module with the
+		// modules sending their local data to it, and the data is rebroadcast shortly anyway)
+		case a := <-link.stateRx:
 			// Send all remoteNodeStates to nodestates, including the one with the localID
-			RemoteNodeStatesChan <- a
+			select {
+			case chns.RemoteNodeStatesChan <- a:
+			default:
+			}
 
 		// Update the network module copy of localHallOrders
-		case a := <-LocalHallOrdersChan:
+		case a := <-chns.LocalHallOrdersChan:
 			localHallOrders = a
 
 		// Send all remoteOrders to consensus module, including the one with the localID
 		// (Orders can only be confirmed by comparing local and remote cab orders information)
-		case a := <-remoteHallOrdersRx:
-			RemoteHallOrdersChan <- a.HallOrders
+		case a := <-link.hallOrdersRx:
+			select {
+			case chns.RemoteHallOrdersChan <- a.HallOrders:
+			default:
+			}
 
 		// Update the network module copy of localCabOrders
-		case a := <-LocalCabOrdersChan:
+		case a := <-chns.LocalCabOrdersChan:
 			localCabOrders = a
 
 		// Send all remoteOrders to consensus module, including the one with the localID
 		// (Orders can only be confirmed by comparing local and remote cab orders information)
-		case a := <-remoteCabOrdersRx:
-			RemoteCabOrdersChan <- a.CabOrders
+		case a := <-link.cabOrdersRx:
+			select {
+			case chns.RemoteCabOrdersChan <- a.CabOrders:
+			default:
+			}
+
+		// Update the network module copy of localDestinationOrders
+		case a := <-chns.LocalDestinationOrdersChan:
+			localDestinationOrders = a
+
+		// Send all remoteOrders to consensus module, including the one with the localID
+		case a := <-link.destinationOrdersRx:
+			select {
+			case chns.RemoteDestinationOrdersChan <- a.DestinationOrders:
+			default:
+			}
+
+		// Update the network module copy of localRecall
+		case a := <-chns.LocalRecallChan:
+			localRecall = a
+
+		// Send all remote recalls to consensus module, including the one with the localID
+		case a := <-link.recallRx:
+			select {
+			case chns.RemoteRecallChan <- a.Recall:
+			default:
+			}
+
+		// Update the network module copy of localETAs
+		case a := <-chns.LocalETAsChan:
+			localETAs = a
+
+		// Send all remote estimates to the ETA handler, including the one with the localID
+		case a := <-link.etasRx:
+			select {
+			case chns.RemoteETAsChan <- a:
+			default:
+			}
+
+		// Forget the nodes that have been gone for longer than forgetAfter
+		case <-forgetTicker.C:
+			updateKnownNodes(knownNodes, peerlist, time.Now())
+			if forgetNodes(knownNodes, forgetAfter, time.Now()) {
+				fmt.Println("(network) Forgot the nodes not seen within", forgetAfter)
+				peersChanged = true
+			}
+
+		case <-heartbeat:
+
+		case <-ctx.Done():
+			fmt.Println("(network) Stopped")
+			return ctx.Err()
 
 		// Broadcast periodically
 		case <-bcastTimer.C:
 			bcastTimer.Reset(bcastPeriod)
 
+			// Let nodes that have stopped handing over rejoin peerlist
+			for currID, currHandover := range handovers {
+				if time.Now().After(currHandover.until) {
+					delete(handovers, currID)
+					peersChanged = true
+				}
+			}
+
+			// Only announce the departure of a departing node
+			if departing {
+				stack.handoverTx <- localHandover
+				break
+			}
+
 			// Initialize messages to send on network
 			// ------
+			stateSeq++
 			localNodeStateMsg := nodestates.NodeStateMsg{
-				ID:    localID,
-				State: localNodeState,
+				ID:     localID,
+				State:  localNodeState,
+				BootID: stateBootID,
+				Seq:    stateSeq,
 			}
 			localCabOrdersMsg := consensus.LocalCabOrdersMsg{
 				// This ID is actually never used, but is included for consistency on network
@@ -163,24 +399,87 @@ func Module(
 				ID:         localID,
 				HallOrders: localHallOrders,
 			}
+			localDestinationOrdersMsg := consensus.LocalDestinationOrdersMsg{
+				// This ID is actually never used, but is included for consistency on network
+				ID:                localID,
+				DestinationOrders: localDestinationOrders,
+			}
+			localRecallMsg := consensus.LocalRecallMsg{
+				// This ID is actually never used, but is included for consistency on network
+				ID:     localID,
+				Recall: localRecall,
+			}
+			// (The estimates are sent as the time remaining, see eta.NewETAMsg)
+			localETAsMsg := eta.NewETAMsg(localID, localETAs)
 
 			// Send localCabOrders and localNodeState directly to remote channels if the node is
 			// alone in peerlist.
 			// (Orders can only be confirmed by comparing local and remote cab orders information,
 			// and nodeStates are only updated when received remotely)
 			if consensus.ContainsID(peerlist, localID) && len(peerlist) == 1 {
-				RemoteCabOrdersChan <- localCabOrders
-				RemoteNodeStatesChan <- localNodeStateMsg
-				// (Hall orders is not sent because they won't be accepted when there are no other nodes on the network)
+				// (Dropped if the receiving module is busy, like the messages from the network)
+				select {
+				case chns.RemoteCabOrdersChan <- localCabOrders:
+				default:
+				}
+				select {
+				case chns.RemoteNodeStatesChan <- localNodeStateMsg:
+				default:
+				}
+
+				// (A fire recall must be possible to activate on a node alone as well)
+				select {
+				case chns.RemoteRecallChan <- localRecall:
+				default:
+				}
+				select {
+				case chns.RemoteETAsChan <- localETAsMsg:
+				default:
+				}
+				// (Hall orders and destination orders are not sent because they won't be accepted
+				// when there are no other nodes on the network)
 				break
 			}
 
 			// Broadcast information if there are other nodes on the network
 			// --------
-			localStateTx <- localNodeStateMsg
-			localHallOrdersTx <- localHallOrdersMsg
-			localCabOrdersTx <- localCabOrdersMsg
+			if handingOver {
+				stack.handoverTx <- localHandover
+			}
+			stack.stateTx <- localNodeStateMsg
+			stack.hallOrdersTx <- localHallOrdersMsg
+			stack.cabOrdersTx <- localCabOrdersMsg
+			stack.destinationOrdersTx <- localDestinationOrdersMsg
+			stack.recallTx <- localRecallMsg
+			stack.etasTx <- localETAsMsg
+
+		}
 
+		// Update the other modules when the peers or the nodes handing over have changed
+		if peersChanged {
+			peersChanged = false
+
+			peerlist = buildPeerlist(driverPeers, handovers, localID)
+
+			if !sendPeerlist(ctx, peerlist, chns.PeerlistUpdateHallChan, chns.PeerlistUpdateCabChan,
+				chns.PeerlistUpdateAssignerChan, chns.PeerlistUpdateDestinationChan, chns.PeerlistUpdateRecallChan) {
+				return ctx.Err()
+			}
+
+			// Decide whether this side of a possible partition owns the hall orders
+			updateKnownNodes(knownNodes, peerlist, time.Now())
+			partitionStatus := calcPartitionStatus(peerlist, knownNodeIDs(knownNodes), groupSize)
+
+			if partitionStatus.Majority != wasMajority {
+				fmt.Printf("(network) Partition changed, majority: %v, peers: %v, known: %v\n",
+					partitionStatus.Majority, partitionStatus.Peers, partitionStatus.KnownNodes)
+			}
+			wasMajority = partitionStatus.Majority
+
+			if !sendPartitionStatus(ctx, partitionStatus, chns.PartitionUpdateHallChan, chns.PartitionUpdateAssignerChan,
+				chns.PartitionUpdateDestinationChan, chns.PartitionUpdateRecallChan) {
+				return ctx.Err()
+			}
 		}
 	}
 }
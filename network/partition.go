@@ -0,0 +1,92 @@
+package network
+
+import (
+	"../consensus"
+	"../datatypes"
+	"sort"
+	"time"
+)
+
+// knownNodesMap ...
+// The peer history: when each node seen on the network was last seen
+type knownNodesMap map[datatypes.NodeID]time.Time
+
+// updateKnownNodes ...
+// Records that all the nodes currently in peerlist were seen at now
+func updateKnownNodes(knownNodes knownNodesMap, peerlist []datatypes.NodeID, now time.Time) {
+	for _, currID := range peerlist {
+		knownNodes[currID] = now
+	}
+}
+
+// forgetNodes ...
+// Removes the nodes not seen within forgetAfter from the peer history (0: never).
+// A lost node is indistinguishable from a node on the other side of a partition, so the
+// nodes are kept long enough to ride out a partition, but a node that has crashed for
+// good is eventually forgotten, letting the remaining nodes regain the majority.
+// @return: true if any nodes were forgotten
+func forgetNodes(knownNodes knownNodesMap, forgetAfter time.Duration, now time.Time) bool {
+	if forgetAfter <= 0 {
+		return false
+	}
+
+	forgotten := false
+	for currID, lastSeen := range knownNodes {
+		if now.Sub(lastSeen) > forgetAfter {
+			delete(knownNodes, currID)
+			forgotten = true
+		}
+	}
+	return forgotten
+}
+
+// knownNodeIDs ...
+// @return: The IDs of the nodes in the peer history, sorted
+func knownNodeIDs(knownNodes knownNodesMap) []datatypes.NodeID {
+	IDs := []datatypes.NodeID{}
+	for currID := range knownNodes {
+		IDs = append(IDs, currID)
+	}
+	sort.Slice(IDs, func(i, j int) bool { return IDs[i] < IDs[j] })
+	return IDs
+}
+
+// hasQuorum ...
+// @return: true if peerlist holds a strict majority of the group, false otherwise.
+// The group size is given by groupSize if set, and by the peer history (knownNodes, sorted) otherwise.
+// An even split is won by the partition containing the lowest known NodeID, making
+// sure that exactly one side of the partition owns the hall orders.
+func hasQuorum(peerlist []datatypes.NodeID, knownNodes []datatypes.NodeID, groupSize int) bool {
+	if groupSize <= 0 {
+		groupSize = len(knownNodes)
+	}
+
+	visible := len(consensus.UniqueIDSlice(peerlist))
+
+	if 2*visible > groupSize {
+		return true
+	}
+	if 2*visible == groupSize && len(knownNodes) > 0 {
+		return consensus.ContainsID(peerlist, knownNodes[0])
+	}
+	return false
+}
+
+// calcPartitionStatus ...
+// @return: The partition status of the node given the current peerlist
+func calcPartitionStatus(
+	peerlist []datatypes.NodeID,
+	knownNodes []datatypes.NodeID,
+	groupSize int) datatypes.PartitionStatus {
+
+	peers := make([]datatypes.NodeID, len(peerlist))
+	copy(peers, peerlist)
+	known := make([]datatypes.NodeID, len(knownNodes))
+	copy(known, knownNodes)
+
+	return datatypes.PartitionStatus{
+		Majority:   hasQuorum(peerlist, knownNodes, groupSize),
+		Peers:      peers,
+		KnownNodes: known,
+	}
+}
@@ -0,0 +1,154 @@
+package network
+
+import (
+	"../consensus"
+	"../datatypes"
+	"../elevio"
+	"testing"
+	"time"
+)
+
+func TestQuorumEvenSplit(t *testing.T) {
+	knownNodes := []datatypes.NodeID{"node_1", "node_2", "node_3", "node_4"}
+
+	tests := []struct {
+		peerlist []datatypes.NodeID
+		majority bool
+	}{
+		{[]datatypes.NodeID{"node_1", "node_2"}, true},
+		{[]datatypes.NodeID{"node_3", "node_4"}, false},
+		{[]datatypes.NodeID{"node_1", "node_4"}, true},
+		{[]datatypes.NodeID{"node_2", "node_3"}, false},
+		{[]datatypes.NodeID{"node_2", "node_3", "node_4"}, true},
+		{[]datatypes.NodeID{"node_1"}, false},
+	}
+
+	for _, test := range tests {
+		if majority := hasQuorum(test.peerlist, knownNodes, 0); majority != test.majority {
+			t.Errorf("hasQuorum(%v) = %v, want %v", test.peerlist, majority, test.majority)
+		}
+	}
+
+	// Exactly one side of every even split owns the hall orders
+	for _, side := range [][2][]datatypes.NodeID{
+		{{"node_1", "node_2"}, {"node_3", "node_4"}},
+		{{"node_1", "node_3"}, {"node_2", "node_4"}},
+		{{"node_1", "node_4"}, {"node_2", "node_3"}},
+	} {
+		if hasQuorum(side[0], knownNodes, 0) == hasQuorum(side[1], knownNodes, 0) {
+			t.Errorf("split %v / %v: both or neither side has the majority", side[0], side[1])
+		}
+	}
+}
+
+func TestQuorumGroupSize(t *testing.T) {
+	knownNodes := []datatypes.NodeID{"node_1", "node_2"}
+
+	// The group size overrides the peer history
+	if hasQuorum([]datatypes.NodeID{"node_1", "node_2"}, knownNodes, 5) {
+		t.Error("2 of 5 nodes should not have the majority")
+	}
+	if !hasQuorum([]datatypes.NodeID{"node_1", "node_2", "node_3"}, knownNodes, 5) {
+		t.Error("3 of 5 nodes should have the majority")
+	}
+}
+
+func TestQuorumAfterCrash(t *testing.T) {
+	start := time.Now()
+	forgetAfter := time.Minute
+
+	knownNodes := knownNodesMap{}
+	updateKnownNodes(knownNodes, []datatypes.NodeID{"node_1", "node_2"}, start)
+
+	// node_1 crashes, leaving node_2 in an even split it doesn't win
+	survivors := []datatypes.NodeID{"node_2"}
+	updateKnownNodes(knownNodes, survivors, start.Add(time.Second))
+	if forgetNodes(knownNodes, forgetAfter, start.Add(time.Second)) {
+		t.Fatal("node_1 was forgotten before forgetAfter")
+	}
+	if hasQuorum(survivors, knownNodeIDs(knownNodes), 0) {
+		t.Fatal("node_2 has the majority right after node_1 crashed")
+	}
+
+	// Once node_1 is forgotten, node_2 regains the majority
+	now := start.Add(forgetAfter + 2*time.Second)
+	updateKnownNodes(knownNodes, survivors, now)
+	if !forgetNodes(knownNodes, forgetAfter, now) {
+		t.Fatal("node_1 was not forgotten after forgetAfter")
+	}
+	if IDs := knownNodeIDs(knownNodes); len(IDs) != 1 || IDs[0] != "node_2" {
+		t.Fatalf("known nodes = %v, want [node_2]", IDs)
+	}
+	if !hasQuorum(survivors, knownNodeIDs(knownNodes), 0) {
+		t.Error("node_2 has no majority after node_1 was forgotten")
+	}
+
+	// node_1 rejoining is known again
+	updateKnownNodes(knownNodes, []datatypes.NodeID{"node_1", "node_2"}, now)
+	if IDs := knownNodeIDs(knownNodes); len(IDs) != 2 {
+		t.Errorf("known nodes = %v, want [node_1 node_2]", IDs)
+	}
+}
+
+func TestNeverForget(t *testing.T) {
+	start := time.Now()
+	knownNodes := knownNodesMap{}
+	updateKnownNodes(knownNodes, []datatypes.NodeID{"node_1", "node_2"}, start)
+
+	if forgetNodes(knownNodes, 0, start.Add(24*time.Hour)) || len(knownNodes) != 2 {
+		t.Errorf("nodes forgotten with forgetAfter 0: %v", knownNodeIDs(knownNodes))
+	}
+}
+
+// confirmed ...
+// @return: A hall order confirmed by the given nodes
+func confirmed(IDs ...datatypes.NodeID) datatypes.Req {
+	return datatypes.Req{State: datatypes.Confirmed, AckBy: IDs}
+}
+
+func TestHallOrdersMergedWhenHealing(t *testing.T) {
+	allNodes := []datatypes.NodeID{"node_1", "node_2", "node_3"}
+	up := int(elevio.BT_HallUp)
+
+	// Before the partition, all nodes agree: an order at floor 1, and none at floor 2
+	var before datatypes.HallOrdersMatrix
+	before[1][up] = confirmed(allNodes...)
+	before[2][up] = datatypes.Req{State: datatypes.Inactive}
+
+	majority := before
+	minority := before
+
+	// node_3 is cut off, and loses the majority
+	minorityPeers := []datatypes.NodeID{"node_3"}
+	if calcPartitionStatus(minorityPeers, allNodes, 0).Majority {
+		t.Fatal("node_3 alone has the majority")
+	}
+	if !calcPartitionStatus([]datatypes.NodeID{"node_1", "node_2"}, allNodes, 0).Majority {
+		t.Fatal("node_1 and node_2 don't have the majority")
+	}
+	consensus.ForgetInactiveHallOrders(&minority)
+
+	// The majority serves the order at floor 1, and confirms a new order at floor 2
+	majority[1][up] = datatypes.Req{State: datatypes.Inactive}
+	majority[2][up] = confirmed("node_1", "node_2")
+
+	// The partition heals, and the nodes merge their orders
+	newInactive, newConfirmed := consensus.MergeHallOrders(&minority, majority, "node_3", allNodes)
+	consensus.MergeHallOrders(&majority, minority, "node_1", allNodes)
+
+	// The order served by the majority is served once
+	if minority[1][up].State != datatypes.Inactive || !newInactive[1][up] {
+		t.Errorf("served order at floor 1 is %v in the minority, want Inactive", minority[1][up].State)
+	}
+	if majority[1][up].State != datatypes.Inactive {
+		t.Errorf("served order at floor 1 is %v in the majority, want Inactive", majority[1][up].State)
+	}
+
+	// The order confirmed by the majority is adopted by the minority, and not lost
+	if minority[2][up].State != datatypes.Confirmed || !newConfirmed[2][up] {
+		t.Errorf("new order at floor 2 is %v in the minority, want Confirmed", minority[2][up].State)
+	}
+	if majority[2][up].State != datatypes.Confirmed {
+		t.Errorf("new order at floor 2 is %v in the majority, want Confirmed", majority[2][up].State)
+	}
+}
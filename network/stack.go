@@ -0,0 +1,280 @@
+package network
+
+import (
+	"../config"
+	"../consensus"
+	"../datatypes"
+	"../eta"
+	"../nodestates"
+	"./driver/bcast"
+	"./driver/peers"
+	"context"
+	"fmt"
+)
+
+// Stack ...
+// The UDP network driver of the process, shared by all the nodes run by the process.
+// Every port has a single broadcast transmitter and receiver, and the heartbeats of the
+// local nodes are sent by a single peer transmitter. Everything received is delivered to
+// each local node attached to the stack, so the local nodes still see each other as
+// separate nodes on the network.
+type Stack struct {
+	peerConfig peers.Config
+
+	// Shared by the local nodes for broadcasting
+	peerTxEnable        chan peers.TransmitEnable
+	stateTx             chan nodestates.NodeStateMsg
+	hallOrdersTx        chan consensus.LocalHallOrdersMsg
+	cabOrdersTx         chan consensus.LocalCabOrdersMsg
+	destinationOrdersTx chan consensus.LocalDestinationOrdersMsg
+	recallTx            chan consensus.LocalRecallMsg
+	etasTx              chan eta.ETAMsg
+	handoverTx          chan HandoverMsg
+
+	attachChan chan *stackLink
+}
+
+// stackLink ...
+// The network traffic received by a single local node
+// (Also used for the traffic received from the UDP network driver, before it is routed)
+type stackLink struct {
+	ID datatypes.NodeID
+
+	// Closed when the node is detached from the stack
+	done chan struct{}
+
+	peerUpdateRx        chan peers.PeerUpdate
+	peerHealthRx        chan map[string]peers.Health
+	stateRx             chan nodestates.NodeStateMsg
+	hallOrdersRx        chan consensus.LocalHallOrdersMsg
+	cabOrdersRx         chan consensus.LocalCabOrdersMsg
+	destinationOrdersRx chan consensus.LocalDestinationOrdersMsg
+	recallRx            chan consensus.LocalRecallMsg
+	etasRx              chan eta.ETAMsg
+	handoverRx          chan HandoverMsg
+}
+
+// newStackLink ...
+// @return: A link without any traffic received yet
+func newStackLink(ID datatypes.NodeID) *stackLink {
+	return &stackLink{
+		ID:                  ID,
+		done:                make(chan struct{}),
+		peerUpdateRx:        make(chan peers.PeerUpdate, 1),
+		peerHealthRx:        make(chan map[string]peers.Health, 1),
+		stateRx:             make(chan nodestates.NodeStateMsg, 10),
+		hallOrdersRx:        make(chan consensus.LocalHallOrdersMsg, 10),
+		cabOrdersRx:         make(chan consensus.LocalCabOrdersMsg, 10),
+		destinationOrdersRx: make(chan consensus.LocalDestinationOrdersMsg, 10),
+		recallRx:            make(chan consensus.LocalRecallMsg, 10),
+		etasRx:              make(chan eta.ETAMsg, 10),
+		handoverRx:          make(chan HandoverMsg, 10),
+	}
+}
+
+// NewStack ...
+// Starts the UDP network driver of the process on the ports, stopped when ctx is cancelled.
+// (ctx must outlive the network modules attached to the stack, as they broadcast through it)
+// @return: The stack, which the network module of every local node is attached to
+func NewStack(ctx context.Context, ports config.Ports, peerConfig peers.Config) *Stack {
+	s := &Stack{
+		peerConfig:          peerConfig,
+		peerTxEnable:        make(chan peers.TransmitEnable),
+		stateTx:             make(chan nodestates.NodeStateMsg),
+		hallOrdersTx:        make(chan consensus.LocalHallOrdersMsg),
+		cabOrdersTx:         make(chan consensus.LocalCabOrdersMsg),
+		destinationOrdersTx: make(chan consensus.LocalDestinationOrdersMsg),
+		recallTx:            make(chan consensus.LocalRecallMsg),
+		etasTx:              make(chan eta.ETAMsg),
+		handoverTx:          make(chan HandoverMsg),
+		attachChan:          make(chan *stackLink),
+	}
+	rx := newStackLink("")
+
+	go peers.Transmitter(ctx, ports.Peers, peerConfig.Interval, s.peerTxEnable)
+	go peers.Receiver(ctx, ports.Peers, peerConfig, rx.peerUpdateRx, rx.peerHealthRx)
+
+	go bcast.Transmitter(ctx, ports.States, s.stateTx)
+	go bcast.Receiver(ctx, ports.States, rx.stateRx)
+
+	go bcast.Transmitter(ctx, ports.HallOrders, s.hallOrdersTx)
+	go bcast.Receiver(ctx, ports.HallOrders, rx.hallOrdersRx)
+
+	go bcast.Transmitter(ctx, ports.CabOrders, s.cabOrdersTx)
+	go bcast.Receiver(ctx, ports.CabOrders, rx.cabOrdersRx)
+
+	go bcast.Transmitter(ctx, ports.DestinationOrders, s.destinationOrdersTx)
+	go bcast.Receiver(ctx, ports.DestinationOrders, rx.destinationOrdersRx)
+
+	go bcast.Transmitter(ctx, ports.Recall, s.recallTx)
+	go bcast.Receiver(ctx, ports.Recall, rx.recallRx)
+
+	go bcast.Transmitter(ctx, ports.ETAs, s.etasTx)
+	go bcast.Receiver(ctx, ports.ETAs, rx.etasRx)
+
+	go bcast.Transmitter(ctx, ports.Handover, s.handoverTx)
+	go bcast.Receiver(ctx, ports.Handover, rx.handoverRx)
+
+	go s.route(ctx, rx)
+
+	return s
+}
+
+// attach ...
+// Attaches a local node to the stack, and starts its heartbeats
+// @return: The link the node receives the network traffic on
+func (s *Stack) attach(localID datatypes.NodeID) *stackLink {
+	link := newStackLink(localID)
+	s.attachChan <- link
+	s.setVisible(localID, true)
+	return link
+}
+
+// detach ...
+// Stops the heartbeats of a local node, and the traffic delivered to it
+func (s *Stack) detach(link *stackLink) {
+	s.setVisible(link.ID, false)
+	close(link.done)
+}
+
+// setVisible ...
+// Starts or stops the heartbeats of a local node
+func (s *Stack) setVisible(localID datatypes.NodeID, visible bool) {
+	s.peerTxEnable <- peers.TransmitEnable{ID: string(localID), Enable: visible}
+}
+
+// route ...
+// Delivers the traffic received from the network to every local node attached to the stack.
+// Changes in the peers are always delivered, as they are only reported once. The other
+// messages are dropped for the nodes that are busy, as if lost on the network.
+// (Never blocks on a single node, which would stop the traffic to the other local nodes)
+func (s *Stack) route(ctx context.Context, rx *stackLink) {
+	links := make(map[*stackLink]bool)
+	driverPeers := []string{}
+
+	for {
+		// Forget the nodes that have been detached
+		for link := range links {
+			select {
+			case <-link.done:
+				delete(links, link)
+			default:
+			}
+		}
+
+		select {
+		case link := <-s.attachChan:
+			// (The node starts out with the peers currently seen by the driver)
+			links[link] = true
+			link.peerUpdateRx <- peers.PeerUpdate{Peers: driverPeers, Lost: []string{}}
+
+		case a := <-rx.peerUpdateRx:
+			driverPeers = a.Peers
+			for link := range links {
+				deliverPeerUpdate(link, a)
+			}
+
+		case a := <-rx.peerHealthRx:
+			for link := range links {
+				select {
+				case link.peerHealthRx <- a:
+				default:
+				}
+			}
+
+		case a := <-rx.stateRx:
+			for link := range links {
+				select {
+				case link.stateRx <- a:
+				default:
+				}
+			}
+
+		case a := <-rx.hallOrdersRx:
+			for link := range links {
+				select {
+				case link.hallOrdersRx <- a:
+				default:
+				}
+			}
+
+		case a := <-rx.cabOrdersRx:
+			for link := range links {
+				select {
+				case link.cabOrdersRx <- a:
+				default:
+				}
+			}
+
+		case a := <-rx.destinationOrdersRx:
+			for link := range links {
+				select {
+				case link.destinationOrdersRx <- a:
+				default:
+				}
+			}
+
+		case a := <-rx.recallRx:
+			for link := range links {
+				select {
+				case link.recallRx <- a:
+				default:
+				}
+			}
+
+		case a := <-rx.etasRx:
+			for link := range links {
+				select {
+				case link.etasRx <- a:
+				default:
+				}
+			}
+
+		case a := <-rx.handoverRx:
+			for link := range links {
+				select {
+				case link.handoverRx <- a:
+				default:
+				}
+			}
+
+		case <-ctx.Done():
+			fmt.Println("(network) Stack stopped")
+			return
+		}
+	}
+}
+
+// deliverPeerUpdate ...
+// Delivers a change in the peers to a local node without blocking. The update replaces the
+// one the node hasn't received yet, if any, keeping the peers lost in both.
+func deliverPeerUpdate(link *stackLink, update peers.PeerUpdate) {
+	select {
+	case link.peerUpdateRx <- update:
+		return
+	default:
+	}
+
+	select {
+	case prev := <-link.peerUpdateRx:
+		update = mergePeerUpdates(prev, update)
+	default:
+	}
+
+	// (Only the stack sends on the channel, which has room for the update after being emptied)
+	link.peerUpdateRx <- update
+}
+
+// mergePeerUpdates ...
+// @return: A single update with the changes of both updates
+func mergePeerUpdates(older peers.PeerUpdate, newer peers.PeerUpdate) peers.PeerUpdate {
+	merged := peers.PeerUpdate{
+		Peers: newer.Peers,
+		New:   newer.New,
+		Lost:  append(append([]string{}, older.Lost...), newer.Lost...),
+	}
+	if merged.New == "" {
+		merged.New = older.New
+	}
+	return merged
+}
@@ -0,0 +1,54 @@
+package network
+
+import (
+	"./driver/peers"
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// A local node that is busy must neither stop the traffic to the other local nodes,
+// nor miss any of the peers lost in the meantime
+func TestStackBusyNode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := &Stack{attachChan: make(chan *stackLink)}
+	rx := newStackLink("")
+	go s.route(ctx, rx)
+
+	busy := newStackLink("node_1")
+	idle := newStackLink("node_2")
+	s.attachChan <- busy
+	s.attachChan <- idle
+	<-idle.peerUpdateRx
+
+	updates := []peers.PeerUpdate{
+		{Peers: []string{"node_1", "node_2", "node_3"}, New: "node_3", Lost: []string{}},
+		{Peers: []string{"node_1", "node_2"}, Lost: []string{"node_3"}},
+		{Peers: []string{"node_1"}, Lost: []string{"node_2"}},
+	}
+	for _, update := range updates {
+		rx.peerUpdateRx <- update
+		select {
+		case received := <-idle.peerUpdateRx:
+			if !reflect.DeepEqual(received, update) {
+				t.Errorf("idle node received %v, want %v", received, update)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("idle node blocked by the busy node")
+		}
+	}
+
+	// (The busy node never received the initial update, which is merged as well)
+	received := <-busy.peerUpdateRx
+	want := peers.PeerUpdate{
+		Peers: []string{"node_1"},
+		New:   "node_3",
+		Lost:  []string{"node_3", "node_2"},
+	}
+	if !reflect.DeepEqual(received, want) {
+		t.Errorf("busy node received %v, want %v", received, want)
+	}
+}
@@ -2,71 +2,245 @@ package nodestates
 
 import (
 	"../datatypes"
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
 )
 
 // NodeStateMsg ...
-// Used for broadcasting the local node state and for receiving remote node states
+// Used for broadcasting the local node state and for receiving remote node states.
+// BootID identifies a single run of the sending node (drawn at random when it starts),
+// and Seq is incremented by the sender for every message within the same run.
 type NodeStateMsg struct {
-	ID    datatypes.NodeID
-	State datatypes.NodeState
+	ID     datatypes.NodeID
+	State  datatypes.NodeState
+	BootID uint64
+	Seq    uint64
+}
+
+// NewBootID ...
+// @return: A random ID for a new run of the local node
+// (Random rather than the start time, as the clocks of the nodes can't be trusted)
+func NewBootID() uint64 {
+	return rand.Uint64()
 }
 
 // Channels ...
 // Used for communication between this module and other modules
 type Channels struct {
-	LocalNodeStateChan chan datatypes.NodeState
-	AllNodeStatesChan  chan datatypes.AllNodeStatesMap
-	NodeLostChan       chan datatypes.NodeID
+	LocalNodeStateChan    chan datatypes.NodeState
+	AllNodeStatesChan     chan datatypes.AllNodeStatesMap
+	NodeLostChan          chan datatypes.NodeID
+	TrafficModeChan       chan datatypes.TrafficMode
+	HallOrdersChan        chan datatypes.ConfirmedHallOrdersMatrix
+	DestinationOrdersChan chan datatypes.ConfirmedDestinationOrdersMatrix
+	SuspectsChan          chan []datatypes.NodeID
+}
+
+// storedNodeState ...
+// A node state together with the information needed to tell whether it is
+// outdated or stale
+type storedNodeState struct {
+	State      datatypes.NodeState
+	ReceivedAt time.Time
+}
+
+// msgVersion ...
+// The boot ID and newest sequence number received from a single node, along with
+// the boot IDs of its earlier runs
+type msgVersion struct {
+	BootID  uint64
+	Seq     uint64
+	retired map[uint64]bool
+}
+
+// isNewer ...
+// @return: true if the message is newer than the newest message received from the
+// same node, false if it is arriving out of order, is a duplicate or comes from an earlier run.
+// (A node restarting gets a new boot ID, replacing the old one, and its sequence numbers start over)
+func isNewer(msg NodeStateMsg, latest msgVersion) bool {
+	if msg.BootID != latest.BootID {
+		return !latest.retired[msg.BootID]
+	}
+	return msg.Seq > latest.Seq
+}
+
+// nextVersion ...
+// @return: The version of a node after receiving a newer message from it,
+// retiring the boot ID of its earlier run if the node has restarted
+func nextVersion(msg NodeStateMsg, latest msgVersion, known bool) msgVersion {
+	retired := latest.retired
+	if retired == nil {
+		retired = make(map[uint64]bool)
+	}
+	if known && msg.BootID != latest.BootID {
+		retired[latest.BootID] = true
+	}
+
+	return msgVersion{BootID: msg.BootID, Seq: msg.Seq, retired: retired}
 }
 
 // deepcopyNodeStates ...
-// @return: A pointer to a deep copied map of allNodeStates
-func deepcopyNodeStates(m datatypes.AllNodeStatesMap) datatypes.AllNodeStatesMap {
+// @return: A pointer to a deep copied map of allNodeStates, not including the
+// states that have not been refreshed within stateTimeout
+func deepcopyNodeStates(
+	m map[datatypes.NodeID]storedNodeState,
+	stateTimeout time.Duration) datatypes.AllNodeStatesMap {
+
 	cpy := make(datatypes.AllNodeStatesMap)
 
 	for currID := range m {
-		temp := datatypes.NodeState{
-			Behaviour: m[currID].Behaviour,
-			Floor:     m[currID].Floor,
-			Dir:       m[currID].Dir,
+		if time.Since(m[currID].ReceivedAt) > stateTimeout {
+			continue
 		}
-		cpy[currID] = temp
+		cpy[currID] = m[currID].State
 	}
 
 	return cpy
 }
 
+// sendNodeStates ...
+// Sends a copy of allNodeStates (see deepcopyNodeStates) on every given channel
+func sendNodeStates(
+	allNodeStates map[datatypes.NodeID]storedNodeState,
+	stateTimeout time.Duration,
+	AllNodeStatesChans ...chan<- datatypes.AllNodeStatesMap) {
+
+	for _, AllNodeStatesChan := range AllNodeStatesChans {
+		AllNodeStatesChan <- deepcopyNodeStates(allNodeStates, stateTimeout)
+	}
+}
+
 // Handler ...
 // The nodestates handler keeps an updated state on all nodes currently in the system
 // (that is, nodes that are in peerlist).
 // Lost nodes will be deleted from the collection of states, and new nodes will
 // be added to the collection of states immediately.
+// States arriving out of order are rejected, and states that have not been refreshed
+// within stateTimeout are evicted before they reach the other modules.
+// The local traffic mode and the hall and destination orders the local node is committed to
+// are added to the local node state before it is broadcast.
+// All node states are sent to the optimal assigner and to the control API.
 func Handler(
+	ctx context.Context,
+	heartbeat <-chan struct{},
 	localID datatypes.NodeID,
 	FsmLocalNodeStateChan <-chan datatypes.NodeState,
 	NetworkAllNodeStatesChan chan<- datatypes.AllNodeStatesMap,
 	NodeLost <-chan datatypes.NodeID,
 	NetworkLocalNodeStateChan chan<- datatypes.NodeState,
-	RemoteNodeStatesChan <-chan NodeStateMsg) {
+	RemoteNodeStatesChan <-chan NodeStateMsg,
+	stateTimeout time.Duration,
+	TrafficModeChan <-chan datatypes.TrafficMode,
+	HallOrdersChan <-chan datatypes.ConfirmedHallOrdersMatrix,
+	DestinationOrdersChan <-chan datatypes.ConfirmedDestinationOrdersMatrix,
+	SuspectsChan <-chan []datatypes.NodeID,
+	ApiAllNodeStatesChan chan<- datatypes.AllNodeStatesMap) error {
+
+	allNodeStates := make(map[datatypes.NodeID]storedNodeState)
 
-	var allNodeStates = make(datatypes.AllNodeStatesMap)
+	// The newest message version is kept for lost nodes as well, making sure that
+	// delayed messages from a lost node won't add it back again
+	latestVersions := make(map[datatypes.NodeID]msgVersion)
+
+	evictionTicker := time.NewTicker(stateTimeout / 2)
+	defer evictionTicker.Stop()
+
+	// The latest local state from the FSM, resent when the traffic mode, the
+	// committed orders or the suspect peers change
+	var localState datatypes.NodeState
+	hasLocalState := false
+	localMode := datatypes.NormalTraffic
+	var localHallOrders datatypes.ConfirmedHallOrdersMatrix
+	var localDestinationOrders datatypes.ConfirmedDestinationOrdersMatrix
+	var localSuspects []datatypes.NodeID
 
 	for {
 		select {
 
 		// Send received localState from FSM to the network module
 		case a := <-FsmLocalNodeStateChan:
-			NetworkLocalNodeStateChan <- a
+			localState = a
+			localState.Traffic = localMode
+			localState.HallOrders = localHallOrders
+			localState.DestinationOrders = localDestinationOrders
+			localState.Suspects = localSuspects
+			hasLocalState = true
+			NetworkLocalNodeStateChan <- localState
+
+		// Broadcast the new local traffic mode with the local state
+		case a := <-TrafficModeChan:
+			localMode = a
+			if hasLocalState {
+				localState.Traffic = localMode
+				NetworkLocalNodeStateChan <- localState
+			}
+
+		// Broadcast the orders committed to with the local state
+		case a := <-HallOrdersChan:
+			localHallOrders = a
+			if hasLocalState {
+				localState.HallOrders = localHallOrders
+				NetworkLocalNodeStateChan <- localState
+			}
+
+		case a := <-DestinationOrdersChan:
+			localDestinationOrders = a
+			if hasLocalState {
+				localState.DestinationOrders = localDestinationOrders
+				NetworkLocalNodeStateChan <- localState
+			}
+
+		// Broadcast the suspect peers with the local state
+		case a := <-SuspectsChan:
+			localSuspects = a
+			if hasLocalState {
+				localState.Suspects = localSuspects
+				NetworkLocalNodeStateChan <- localState
+			}
 
 		// Update allNodeStates with the received node state, and
 		// update the network module
 		case a := <-RemoteNodeStatesChan:
-			allNodeStates[a.ID] = a.State
-			NetworkAllNodeStatesChan <- deepcopyNodeStates(allNodeStates)
+			latest, known := latestVersions[a.ID]
+			if known && !isNewer(a, latest) {
+				break
+			}
+
+			latestVersions[a.ID] = nextVersion(a, latest, known)
+			allNodeStates[a.ID] = storedNodeState{
+				State:      a.State,
+				ReceivedAt: time.Now(),
+			}
+			sendNodeStates(allNodeStates, stateTimeout, NetworkAllNodeStatesChan, ApiAllNodeStatesChan)
 
 		// Remove lost nodes from allNodeStates
 		case a := <-NodeLost:
-			delete(allNodeStates, a)
+			if _, ok := allNodeStates[a]; ok {
+				delete(allNodeStates, a)
+				sendNodeStates(allNodeStates, stateTimeout, NetworkAllNodeStatesChan, ApiAllNodeStatesChan)
+			}
+
+		// Evict nodes that have not refreshed their state within stateTimeout
+		case <-evictionTicker.C:
+			evicted := false
+			for currID, currState := range allNodeStates {
+				if time.Since(currState.ReceivedAt) > stateTimeout {
+					fmt.Println("(nodestates) Evicted stale state of", currID)
+					delete(allNodeStates, currID)
+					evicted = true
+				}
+			}
+
+			if evicted {
+				sendNodeStates(allNodeStates, stateTimeout, NetworkAllNodeStatesChan, ApiAllNodeStatesChan)
+			}
+
+		case <-heartbeat:
+
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 
 	}
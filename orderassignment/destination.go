@@ -0,0 +1,178 @@
+package orderassignment
+
+import (
+	"../consensus"
+	"../datatypes"
+	"../elevio"
+	"sort"
+)
+
+// Extra cost (in floors) of a destination order making a car stop at a destination floor
+// it doesn't stop at already, grouping the passengers going to the same floor into the same car
+const destinationStopCost = 2
+
+// destinationDir ...
+// @return: The hall order type a passenger going from origin to destination would press
+func destinationDir(origin int, destination int) elevio.ButtonType {
+	if destination > origin {
+		return elevio.BT_HallUp
+	}
+	return elevio.BT_HallDown
+}
+
+// committedDestinationOwners ...
+// @return: The node committed to every destination order, as broadcast in the node states.
+// (The lowest ID is used if several nodes claim the same order, see committedOwners)
+func committedDestinationOwners(currAllNodeStates datatypes.AllNodeStatesMap) datatypes.DestinationAssignmentMatrix {
+	var owners datatypes.DestinationAssignmentMatrix
+
+	for currID, currState := range currAllNodeStates {
+		for origin := range owners {
+			for destination := range owners[origin] {
+				if !currState.DestinationOrders[origin][destination] {
+					continue
+				}
+				if owners[origin][destination] == "" || currID < owners[origin][destination] {
+					owners[origin][destination] = currID
+				}
+			}
+		}
+	}
+
+	return owners
+}
+
+// destinationCost ...
+// @return: The cost (in floors) of letting the node pick up the passengers of a destination
+// order, given the floors the node already stops at
+func destinationCost(
+	nodeState datatypes.NodeState,
+	stops [elevio.NumFloors]bool,
+	origin int,
+	destination int) int {
+
+	cost := fallbackCost(nodeState, origin)
+	if !stops[destination] {
+		cost += destinationStopCost
+	}
+	return cost
+}
+
+// addDestinationOrder ...
+// Gives a destination order to the node, which stops at the origin floor to pick up the passengers
+// and at the destination floor to drop them off
+func addDestinationOrder(
+	assignedOrders map[string]datatypes.AssignedOrdersMatrix,
+	assignment *datatypes.DestinationAssignmentMatrix,
+	stops map[datatypes.NodeID][elevio.NumFloors]bool,
+	origin int,
+	destination int,
+	ID datatypes.NodeID) {
+
+	(*assignment)[origin][destination] = ID
+
+	currAssignedOrders := assignedOrders[string(ID)]
+	currAssignedOrders[origin][destinationDir(origin, destination)] = true
+	assignedOrders[string(ID)] = currAssignedOrders
+
+	currStops := stops[ID]
+	currStops[destination] = true
+	stops[ID] = currStops
+}
+
+// assignDestinationOrders ...
+// Assigns every confirmed destination order (a group of passengers with the same origin and
+// destination) to a car, which is given a hall order at the origin floor in the direction of
+// the destination, so that it stops for the passengers.
+// An order already committed to a node is kept by that node while it is available, as the
+// passengers have been told which car to board. Every other order is given to the car with
+// the lowest fallbackCost at the origin floor, where cars already stopping at the destination
+// floor (for cab orders or other destination orders) are preferred.
+// (Orders and ties are handled in a fixed order, making sure that all nodes that have seen
+// the same node states arrive at the same assignment)
+// @return: The assigned orders including the destination orders, and the car to board
+// for every destination order
+func assignDestinationOrders(
+	assignedOrders map[string]datatypes.AssignedOrdersMatrix,
+	currDestinationOrders datatypes.ConfirmedDestinationOrdersMatrix,
+	currAllNodeStates datatypes.AllNodeStatesMap,
+	peerlist []datatypes.NodeID) (map[string]datatypes.AssignedOrdersMatrix, datatypes.DestinationAssignmentMatrix) {
+
+	var assignment datatypes.DestinationAssignmentMatrix
+
+	// Only nodes with a known state can be assigned orders
+	candidates := []datatypes.NodeID{}
+	for _, currID := range peerlist {
+		if _, hasState := currAllNodeStates[currID]; hasState {
+			candidates = append(candidates, currID)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i] < candidates[j] })
+	if len(candidates) == 0 {
+		return assignedOrders, assignment
+	}
+
+	if assignedOrders == nil {
+		assignedOrders = make(map[string]datatypes.AssignedOrdersMatrix)
+	}
+
+	// The floors every car stops at for its cab orders
+	stops := make(map[datatypes.NodeID][elevio.NumFloors]bool)
+	for _, currID := range candidates {
+		var currStops [elevio.NumFloors]bool
+		for floor := range currStops {
+			currStops[floor] = assignedOrders[string(currID)][floor][elevio.BT_Cab]
+		}
+		stops[currID] = currStops
+	}
+
+	// Keep the orders with the nodes committed to them
+	committed := committedDestinationOwners(currAllNodeStates)
+	for origin := range currDestinationOrders {
+		for destination, isOrder := range currDestinationOrders[origin] {
+			owner := committed[origin][destination]
+			if isOrder && owner != "" && consensus.ContainsID(candidates, owner) {
+				addDestinationOrder(assignedOrders, &assignment, stops, origin, destination, owner)
+			}
+		}
+	}
+
+	// Give each remaining order to the cheapest car
+	for origin := range currDestinationOrders {
+		for destination, isOrder := range currDestinationOrders[origin] {
+			if !isOrder || assignment[origin][destination] != "" {
+				continue
+			}
+
+			bestID := candidates[0]
+			bestCost := destinationCost(currAllNodeStates[bestID], stops[bestID], origin, destination)
+			for _, currID := range candidates[1:] {
+				currCost := destinationCost(currAllNodeStates[currID], stops[currID], origin, destination)
+				if currCost < bestCost {
+					bestID = currID
+					bestCost = currCost
+				}
+			}
+			addDestinationOrder(assignedOrders, &assignment, stops, origin, destination, bestID)
+		}
+	}
+
+	return assignedOrders, assignment
+}
+
+// committedDestinationOrders ...
+// @return: The destination orders assigned to the node with the given ID
+func committedDestinationOrders(
+	assignment datatypes.DestinationAssignmentMatrix,
+	ID datatypes.NodeID) datatypes.ConfirmedDestinationOrdersMatrix {
+
+	var destinationOrders datatypes.ConfirmedDestinationOrdersMatrix
+
+	for origin := range assignment {
+		for destination := range assignment[origin] {
+			destinationOrders[origin][destination] = assignment[origin][destination] == ID
+		}
+	}
+
+	return destinationOrders
+}
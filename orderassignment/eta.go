@@ -0,0 +1,151 @@
+package orderassignment
+
+import (
+	"../config"
+	"../datatypes"
+	"../elevio"
+	"time"
+)
+
+// Upper bound on the number of steps simulated for a single node
+// (A node serves all its orders within two sweeps of the building, stopping at
+// most twice at every floor)
+const maxSimulatedSteps = 5 * elevio.NumFloors
+
+// dirStep ...
+// @return: The change of floor when moving a single floor in the direction dir
+func dirStep(dir datatypes.NodeDir) int {
+	if dir == datatypes.Down {
+		return -1
+	}
+	return 1
+}
+
+// hasAssignedOrders ...
+// @return: true if there are any orders left, false otherwise
+func hasAssignedOrders(orders datatypes.AssignedOrdersMatrix) bool {
+	for floor := range orders {
+		for orderType := range orders[floor] {
+			if orders[floor][orderType] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasOrdersBeyond ...
+// @return: true if there are any orders beyond floor in the direction dir, false otherwise
+func hasOrdersBeyond(orders datatypes.AssignedOrdersMatrix, floor int, dir datatypes.NodeDir) bool {
+	for currFloor := floor + dirStep(dir); currFloor >= 0 && currFloor < len(orders); currFloor += dirStep(dir) {
+		for orderType := range orders[currFloor] {
+			if orders[currFloor][orderType] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// servedAtFloor ...
+// @return: The orders served by a node stopping at the floor while going in the direction dir.
+// (Follows the clear request types of the FSM and the hall request assigner)
+func servedAtFloor(
+	orders datatypes.AssignedOrdersMatrix,
+	floor int,
+	dir datatypes.NodeDir,
+	clearRequestType string) [3]bool {
+
+	served := orders[floor]
+	if clearRequestType == config.ClearAll {
+		return served
+	}
+
+	var hallInDir, hallOpposite elevio.ButtonType = elevio.BT_HallUp, elevio.BT_HallDown
+	if dir == datatypes.Down {
+		hallInDir, hallOpposite = elevio.BT_HallDown, elevio.BT_HallUp
+	}
+
+	// The hall order in the opposite direction is only served when turning around
+	if orders[floor][hallInDir] || hasOrdersBeyond(orders, floor, dir) {
+		served[hallOpposite] = false
+	}
+	return served
+}
+
+// hallETAs ...
+// Simulates the node serving its assigned orders, the same way the hall request
+// assigner does, starting from the current state of the node at the time now.
+// @return: The estimated time of arrival of the node at each of its assigned hall orders
+func hallETAs(
+	currID datatypes.NodeID,
+	nodeState datatypes.NodeState,
+	assignedOrders datatypes.AssignedOrdersMatrix,
+	now time.Time,
+	config Config) datatypes.HallETAsMatrix {
+
+	var etas datatypes.HallETAsMatrix
+
+	orders := assignedOrders
+	floor := nodeState.Floor
+	dir := nodeState.Dir
+	elapsed := time.Duration(0)
+
+	if floor < 0 || floor >= elevio.NumFloors {
+		return etas
+	}
+
+	// Finish the current action of the node first
+	switch nodeState.Behaviour {
+
+	// (Nodes initializing or recalled are not serving any hall orders)
+	case datatypes.InitState, datatypes.RecallState:
+		return etas
+
+	case datatypes.DoorOpenState:
+		elapsed += config.DoorOpenDuration / 2
+
+	case datatypes.MovingState, datatypes.ParkingState:
+		nextFloor := floor + dirStep(dir)
+		if nextFloor >= 0 && nextFloor < elevio.NumFloors {
+			floor = nextFloor
+			elapsed += config.TravelDuration / 2
+		}
+	}
+
+	for step := 0; step < maxSimulatedSteps && hasAssignedOrders(orders); step++ {
+		served := servedAtFloor(orders, floor, dir, config.ClearRequestType)
+
+		if served[elevio.BT_HallUp] || served[elevio.BT_HallDown] || served[elevio.BT_Cab] {
+			for _, hallType := range []elevio.ButtonType{elevio.BT_HallUp, elevio.BT_HallDown} {
+				if served[hallType] {
+					etas[floor][hallType] = datatypes.HallETA{
+						Car:     currID,
+						Arrival: now.Add(elapsed),
+					}
+				}
+			}
+			for orderType := range served {
+				orders[floor][orderType] = orders[floor][orderType] && !served[orderType]
+			}
+			elapsed += config.DoorOpenDuration
+			continue
+		}
+
+		// Turn around if there are no orders ahead
+		// (The remaining orders at the floor are served after turning around)
+		if !hasOrdersBeyond(orders, floor, dir) {
+			if dir == datatypes.Up {
+				dir = datatypes.Down
+			} else {
+				dir = datatypes.Up
+			}
+			continue
+		}
+
+		floor += dirStep(dir)
+		elapsed += config.TravelDuration
+	}
+
+	return etas
+}
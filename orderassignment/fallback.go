@@ -0,0 +1,90 @@
+package orderassignment
+
+import (
+	"../datatypes"
+	"../elevio"
+	"sort"
+)
+
+// Extra cost (in floors) of assigning a hall order to a node that is not idle
+const busyPenalty = 2
+
+// fallbackCost ...
+// @return: A rough cost (in floors) of letting the node serve the hall order at the given floor.
+// Idle nodes are preferred, and moving nodes are only cheap if the order is ahead of them.
+func fallbackCost(nodeState datatypes.NodeState, floor int) int {
+	distance := floor - nodeState.Floor
+	if distance < 0 {
+		distance = -distance
+	}
+
+	switch nodeState.Behaviour {
+
+	// (A parking node is regarded as idle, as parking is cancelled by any order)
+	case datatypes.IdleState, datatypes.ParkingState:
+		return distance
+
+	case datatypes.MovingState:
+		ahead := (nodeState.Dir == datatypes.Up && floor > nodeState.Floor) ||
+			(nodeState.Dir == datatypes.Down && floor < nodeState.Floor)
+		if ahead {
+			return distance + busyPenalty
+		}
+		// The node has to turn around, covering the distance twice
+		return 2*elevio.NumFloors - distance + busyPenalty
+	}
+
+	return distance + busyPenalty
+}
+
+// fallbackAssignment ...
+// Built-in heuristic used when the hall request assigner is unavailable.
+// Every hall order is given to the node with the lowest fallbackCost (the nearest
+// idle node, if any), while every node keeps its own cab orders.
+// (Ties are broken by NodeID, making sure that all nodes arrive at the same assignment)
+// @return: The assigned orders of all the nodes, in the same format as the optimizer output
+func fallbackAssignment(
+	currHallOrders datatypes.ConfirmedHallOrdersMatrix,
+	currAllCabOrders datatypes.ConfirmedCabOrdersMap,
+	currAllNodeStates datatypes.AllNodeStatesMap,
+	peerlist []datatypes.NodeID) map[string]datatypes.AssignedOrdersMatrix {
+
+	assignedOrders := make(map[string]datatypes.AssignedOrdersMatrix)
+
+	// Only nodes with a known state can be assigned orders
+	candidates := []datatypes.NodeID{}
+	for _, currID := range peerlist {
+		if _, hasState := currAllNodeStates[currID]; hasState {
+			candidates = append(candidates, currID)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i] < candidates[j] })
+
+	// Every node keeps its own cab orders
+	for _, currID := range candidates {
+		assignedOrders[string(currID)] = cabOrdersAssignment(currAllCabOrders[currID])
+	}
+
+	// Give each hall order to the cheapest node
+	for floor := range currHallOrders {
+		for orderType := range currHallOrders[floor] {
+			if !currHallOrders[floor][orderType] || len(candidates) == 0 {
+				continue
+			}
+
+			bestID := candidates[0]
+			for _, currID := range candidates[1:] {
+				if fallbackCost(currAllNodeStates[currID], floor) <
+					fallbackCost(currAllNodeStates[bestID], floor) {
+					bestID = currID
+				}
+			}
+
+			currAssignedOrders := assignedOrders[string(bestID)]
+			currAssignedOrders[floor][orderType] = true
+			assignedOrders[string(bestID)] = currAssignedOrders
+		}
+	}
+
+	return assignedOrders
+}
@@ -1,14 +1,21 @@
 package orderassignment
 
 import (
+	"../config"
+	"../consensus"
 	"../datatypes"
 	"../elevio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
+	"time"
 )
 
 // Channels ...
@@ -16,13 +23,16 @@ import (
 type Channels struct {
 	LocallyAssignedOrdersChan chan datatypes.AssignedOrdersMatrix
 	PeerlistUpdateChan        chan []datatypes.NodeID
+	PartitionUpdateChan       chan datatypes.PartitionStatus
+	PeerHealthChan            chan datatypes.PeerHealthMap
 }
 
 type singleNodeStateJSON struct {
-	Behaviour   string `json:"behaviour"`
-	Floor       int    `json:"floor"`
-	Direction   string `json:"direction"`
-	CabRequests []bool `json:"cabRequests"`
+	Behaviour   string  `json:"behaviour"`
+	Floor       int     `json:"floor"`
+	Direction   string  `json:"direction"`
+	CabRequests []bool  `json:"cabRequests"`
+	Load        float64 `json:"load"`
 }
 
 type optimizationInputJSON struct {
@@ -44,10 +54,15 @@ func encodeJSON(
 		currBehaviour := ""
 		currDirection := ""
 
+		// Leave out nodes without a (fresh) state, as their position is unknown
+		currNodeState, hasState := currAllNodeStates[currID]
+		if !hasState {
+			continue
+		}
+
 		// Initialize cabOrders to false if not yet defined
 		// (The order distribution will quickly converge towards
 		// the correct distribution, so this is not a problem)
-		currNodeState := currAllNodeStates[currID]
 		currCabOrders := currAllCabOrders[currID]
 		if currCabOrders == nil {
 			currCabOrders = make(datatypes.ConfirmedCabOrdersList, elevio.NumFloors)
@@ -59,7 +74,8 @@ func encodeJSON(
 			currBehaviour = "idle"
 			currDirection = "stop"
 
-		case datatypes.MovingState:
+		// (A parking node is moving, even though it has no orders)
+		case datatypes.MovingState, datatypes.ParkingState:
 			currBehaviour = "moving"
 
 			switch currNodeState.Dir {
@@ -79,6 +95,7 @@ func encodeJSON(
 			Floor:       currNodeState.Floor,
 			Direction:   currDirection,
 			CabRequests: currCabOrders,
+			Load:        currNodeState.Load,
 		}
 	}
 
@@ -92,62 +109,301 @@ func encodeJSON(
 	return currOptimizationInputJSON
 }
 
+// suspectPeers ...
+// @return: Sorted list of all the peers suspected by the local node, never including the local node
+func suspectPeers(peerHealth datatypes.PeerHealthMap, localID datatypes.NodeID) []datatypes.NodeID {
+	suspects := []datatypes.NodeID{}
+	for currID, currHealth := range peerHealth {
+		if currHealth.Suspect && currID != localID {
+			suspects = append(suspects, currID)
+		}
+	}
+	sort.Slice(suspects, func(i, j int) bool { return suspects[i] < suspects[j] })
+	return suspects
+}
+
+// agreedSuspects ...
+// @return: The peers suspected by all the other peers with a known node state, when these
+// are a majority of the peers. (Two nodes suspecting each other can't tell which of them is
+// marginal, and are never demoted, making sure that some peer is always left to assign orders to)
+func agreedSuspects(
+	peerlist []datatypes.NodeID,
+	currAllNodeStates map[datatypes.NodeID]datatypes.NodeState) []datatypes.NodeID {
+
+	agreed := []datatypes.NodeID{}
+	for _, suspectID := range peerlist {
+		votes := 0
+		suspected := true
+
+		for _, currID := range peerlist {
+			currState, hasState := currAllNodeStates[currID]
+			if currID == suspectID || !hasState {
+				continue
+			}
+			votes++
+			if !consensus.ContainsID(currState.Suspects, suspectID) {
+				suspected = false
+				break
+			}
+		}
+
+		if 2*votes > len(peerlist) && suspected {
+			agreed = append(agreed, suspectID)
+		}
+	}
+	return agreed
+}
+
+// unavailablePeers ...
+// @return: Sorted list of the nodes that can't be assigned any orders due to their behaviour
+// (Nodes returning to the recall floor during a fire recall)
+func unavailablePeers(currAllNodeStates datatypes.AllNodeStatesMap) []datatypes.NodeID {
+	unavailable := []datatypes.NodeID{}
+	for currID, currState := range currAllNodeStates {
+		if currState.Behaviour == datatypes.RecallState {
+			unavailable = append(unavailable, currID)
+		}
+	}
+	sort.Slice(unavailable, func(i, j int) bool { return unavailable[i] < unavailable[j] })
+	return unavailable
+}
+
+// cabOnlyPeers ...
+// @return: Sorted list of the nodes that only serve their own cab orders due to their mode
+// (Nodes out of service or in independent service), because their car is full
+// (load at or above fullThreshold), or because a fault has been diagnosed on them
+func cabOnlyPeers(currAllNodeStates datatypes.AllNodeStatesMap, fullThreshold float64) []datatypes.NodeID {
+	cabOnly := []datatypes.NodeID{}
+	for currID, currState := range currAllNodeStates {
+		if currState.Behaviour == datatypes.RecallState {
+			continue
+		}
+		if currState.Mode != datatypes.NormalMode || currState.Load >= fullThreshold ||
+			currState.Fault != datatypes.NoFault {
+			cabOnly = append(cabOnly, currID)
+		}
+	}
+	sort.Slice(cabOnly, func(i, j int) bool { return cabOnly[i] < cabOnly[j] })
+	return cabOnly
+}
+
+// cabOrdersAssignment ...
+// @return: The cab orders of a node as assigned orders, without any hall orders
+func cabOrdersAssignment(cabOrders datatypes.ConfirmedCabOrdersList) datatypes.AssignedOrdersMatrix {
+	var assignedOrders datatypes.AssignedOrdersMatrix
+	for floor, isOrder := range cabOrders {
+		if floor < len(assignedOrders) {
+			assignedOrders[floor][elevio.BT_Cab] = isOrder
+		}
+	}
+	return assignedOrders
+}
+
+// excludeIDs ...
+// @return: A copy of peerlist without the NodeIDs in excluded
+func excludeIDs(peerlist []datatypes.NodeID, excluded []datatypes.NodeID) []datatypes.NodeID {
+	remaining := []datatypes.NodeID{}
+	for _, currID := range peerlist {
+		if !consensus.ContainsID(excluded, currID) {
+			remaining = append(remaining, currID)
+		}
+	}
+	return remaining
+}
+
+// Config ...
+// Configuration of the order assignment.
+type Config struct {
+	// Path to the hall request assigner binary.
+	// (Searched for next to the executable and in the working directory if empty)
+	AssignerPath string
+
+	// Deadline for a single run of the hall request assigner
+	AssignerTimeout time.Duration
+
+	// Timings of the elevators, used when simulating the nodes serving the orders
+	// (Should equal the timings used by the FSM)
+	DoorOpenDuration time.Duration
+	TravelDuration   time.Duration
+
+	// Which hall orders are served when stopping at a floor ("all" or "inDirn")
+	// (Should equal the clear request type used by the FSM)
+	ClearRequestType string
+
+	// Cost (in floors) of moving a hall order already committed to a node to
+	// another node (0 disables the switching cost)
+	SwitchingCost int
+
+	// Hall orders are never moved from a node within this many floors of serving
+	// them (-1 disables freezing, 0 freezes orders at the next floor of the node)
+	FreezeDistance int
+
+	// Where idle nodes are parked
+	Parking config.Parking
+
+	// How the traffic mode is scheduled and detected
+	Traffic config.Traffic
+
+	// Load of the elevators, full nodes are not assigned any hall orders
+	Load config.CarLoad
+}
+
+// Location of the hall request assigner, relative to the project root
+const assignerName = "orderassignment/hall_request_assigner"
+
+// locateAssigner ...
+// @return: Path to the hall request assigner binary, or an error if it can't be found.
+// An explicitly given path is always used, otherwise the binary is looked for relative
+// to the executable first and then relative to the current working directory.
+func locateAssigner(assignerPath string) (string, error) {
+	candidates := []string{}
+
+	if assignerPath != "" {
+		candidates = append(candidates, assignerPath)
+	} else {
+		if exe, err := os.Executable(); err == nil {
+			candidates = append(candidates, filepath.Join(filepath.Dir(exe), assignerName))
+		}
+		if dir, err := os.Getwd(); err == nil {
+			candidates = append(candidates, filepath.Join(dir, assignerName))
+		}
+	}
+
+	for _, candidate := range candidates {
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("hall request assigner not found (tried %v)", candidates)
+}
+
 // runOptimizer ...
-// Runs the optimization script with the given JSON data
+// Runs the optimization script with the given JSON data, passing it on stdin.
+// The script is killed if it hasn't finished within the timeout.
 // @return: JSON object with optimal distribution of orders between
 // all nodes in the system.
-func runOptimizer(currOptimizationInputJSON []byte) []byte {
+func runOptimizer(
+	ctx context.Context,
+	assignerPath string,
+	config Config,
+	currOptimizationInputJSON []byte) ([]byte, error) {
 
-	// Get current working directory
-	dir, err := os.Getwd()
+	ctx, cancel := context.WithTimeout(ctx, config.AssignerTimeout)
+	defer cancel()
 
-	if err != nil {
-		log.Fatal(err)
-	}
+	cmd := exec.CommandContext(ctx, assignerPath,
+		"--includeCab", "--clearRequestType", config.ClearRequestType,
+		"--doorOpenDuration", strconv.FormatInt(config.DoorOpenDuration.Milliseconds(), 10),
+		"--travelDuration", strconv.FormatInt(config.TravelDuration.Milliseconds(), 10))
 
-	scriptName := "/orderassignment/hall_request_assigner"
-	params := "--includeCab --clearRequestType all"
-	input := " --input '" + string(currOptimizationInputJSON) + "'"
+	// (The script reads a single line from stdin)
+	cmd.Stdin = bytes.NewReader(append(currOptimizationInputJSON, '\n'))
 
-	// Run external script with JSON data
-	cmd := exec.Command("sh", "-c",
-		dir+scriptName+" "+params+" "+input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
 
 	outJSON, err := cmd.Output()
 
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("hall request assigner timed out after %v", config.AssignerTimeout)
+	}
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("hall request assigner failed: %v %s", err, stderr.String())
 	}
 
-	return outJSON
+	return outJSON, nil
 }
 
 // OptimalAssigner ...
 // Will calculate and assign confirmed orders to the current node each time new state data or
 // new confirmed orders enters the system.
-// The new calculated orders are sent to the fsm.
+// The new calculated orders are sent to the fsm, and the estimated times of arrival
+// of the local node at its hall orders are broadcast by the network module.
 // The optimal distribution of orders are calculated using an external script, utilizing the state
 // information on each node in addition to all the confirmed orders in the system.
 func OptimalAssigner(
+	ctx context.Context,
+	heartbeat <-chan struct{},
 	localID datatypes.NodeID,
 	numFloors int,
 	PeerlistUpdateChan <-chan []datatypes.NodeID,
 	LocallyAssignedOrdersChan chan<- datatypes.AssignedOrdersMatrix,
 	ConfirmedHallOrdersChan <-chan datatypes.ConfirmedHallOrdersMatrix,
 	ConfirmedCabOrdersChan <-chan datatypes.ConfirmedCabOrdersMap,
-	AllNodeStatesChan <-chan datatypes.AllNodeStatesMap) {
+	AllNodeStatesChan <-chan datatypes.AllNodeStatesMap,
+	ConfirmedDestinationOrdersChan <-chan datatypes.ConfirmedDestinationOrdersMatrix,
+	DestinationAssignmentChan chan<- datatypes.DestinationAssignmentMatrix,
+	ParkingTargetChan chan<- datatypes.ParkingTarget,
+	TrafficModeChan chan<- datatypes.TrafficMode,
+	ETAsChan chan<- datatypes.HallETAsMatrix,
+	minorityPolicy datatypes.MinorityPolicy,
+	PartitionUpdateChan <-chan datatypes.PartitionStatus,
+	PeerHealthChan <-chan datatypes.PeerHealthMap,
+	CommittedHallOrdersChan chan<- datatypes.ConfirmedHallOrdersMatrix,
+	CommittedDestinationOrdersChan chan<- datatypes.ConfirmedDestinationOrdersMatrix,
+	SuspectsChan chan<- []datatypes.NodeID,
+	ReassignmentsChan chan<- datatypes.ReassignmentsMatrix,
+	config Config) error {
 
 	// Initialize variables
 	//-------
 
 	var currHallOrders datatypes.ConfirmedHallOrdersMatrix
 	var currAllCabOrders datatypes.ConfirmedCabOrdersMap
+	var currDestinationOrders datatypes.ConfirmedDestinationOrdersMatrix
 	var peerlist []datatypes.NodeID
+	inMajority := true
+
+	// The peers suspected by the local node are broadcast with the local node state
+	// (Sent whenever the receiver is ready, the channel is nil while there is nothing new to send)
+	suspects := []datatypes.NodeID{}
+	var sendSuspects chan<- []datatypes.NodeID
 
 	optimize := false
 	currAllNodeStates := make(map[datatypes.NodeID]datatypes.NodeState)
 	var currOptimizationInputJSON []byte
-	var optimalAssignedOrders map[string]datatypes.AssignedOrdersMatrix
+
+	// Used for keeping hall and destination orders with the nodes already committed to them.
+	// The orders committed to are broadcast with the local node state, and the
+	// reassignments are shown by the control API. (Sent whenever the receivers are ready,
+	// the channels are nil while there is nothing new to send)
+	var localHallOrders datatypes.ConfirmedHallOrdersMatrix
+	var localDestinationOrders datatypes.ConfirmedDestinationOrdersMatrix
+	var reassignments datatypes.ReassignmentsMatrix
+	var prevHallOwners hallOwnersMatrix
+	var sendCommittedHallOrders chan<- datatypes.ConfirmedHallOrdersMatrix
+	var sendCommittedDestinationOrders chan<- datatypes.ConfirmedDestinationOrdersMatrix
+	var sendReassignments chan<- datatypes.ReassignmentsMatrix
+
+	// Used for updating the FSM and the destination consensus without blocking, as both
+	// send completed orders back through the consensus modules. (Only the latest
+	// assignment is sent, the channels are nil while there is nothing new to send)
+	var locallyAssignedOrders datatypes.AssignedOrdersMatrix
+	var boardingAssignment datatypes.DestinationAssignmentMatrix
+	var sendLocallyAssignedOrders chan<- datatypes.AssignedOrdersMatrix
+	var sendDestinationAssignment chan<- datatypes.DestinationAssignmentMatrix
+
+	// Used for parking idle nodes and detecting the traffic mode
+	var hallOrderHistory []hallOrderEvent
+	historyAge := config.Parking.History.Duration
+	if config.Traffic.Window.Duration > historyAge {
+		historyAge = config.Traffic.Window.Duration
+	}
+	prevParkingTarget := datatypes.ParkingTarget{Floor: -1}
+
+	// The local traffic mode is broadcast with the node state, while the group
+	// follows the traffic mode of the lowest peer
+	localMode := datatypes.NormalTraffic
+	groupMode := datatypes.NormalTraffic
+	trafficTicker := time.NewTicker(time.Second)
+	defer trafficTicker.Stop()
+
+	// The built-in heuristic is used whenever the optimizer is unavailable
+	assignerPath, err := locateAssigner(config.AssignerPath)
+	if err != nil {
+		fmt.Println("(optimalassigner)", err, "- using fallback heuristic")
+	}
 
 	fmt.Println("(optimalassigner) Initialized")
 
@@ -162,6 +418,24 @@ func OptimalAssigner(
 			peerlist = a
 			optimize = true
 
+		// Broadcast the peers that become (or stop being) suspect
+		// (The assignment changes once the other nodes agree)
+		case a := <-PeerHealthChan:
+			currSuspects := suspectPeers(a, localID)
+			if !reflect.DeepEqual(currSuspects, suspects) {
+				suspects = currSuspects
+				sendSuspects = SuspectsChan
+			}
+
+		case sendSuspects <- suspects:
+			sendSuspects = nil
+
+		case a := <-PartitionUpdateChan:
+			if a.Majority != inMajority {
+				inMajority = a.Majority
+				optimize = true
+			}
+
 		// Optimize each time allNodeStates are updated
 		case a := <-AllNodeStatesChan:
 
@@ -173,6 +447,16 @@ func OptimalAssigner(
 			currAllNodeStates = a
 			optimize = true
 
+		// Update the local traffic mode as the time of day and the hall orders change
+		case <-trafficTicker.C:
+			currMode := localTrafficMode(time.Now(), hallOrderHistory,
+				config.Traffic, config.Parking.LobbyFloor)
+			if currMode != localMode {
+				localMode = currMode
+				fmt.Println("(optimalassigner) Local traffic mode:", trafficModeName(localMode))
+				TrafficModeChan <- localMode
+			}
+
 		// Receive new confirmedOrders from hallConsensus
 		// Optimize if the new order is not already in the system
 		case a := <-ConfirmedHallOrdersChan:
@@ -182,6 +466,7 @@ func OptimalAssigner(
 				break
 			}
 
+			hallOrderHistory = recordHallOrders(hallOrderHistory, currHallOrders, a, historyAge)
 			currHallOrders = a
 			optimize = true
 
@@ -196,6 +481,35 @@ func OptimalAssigner(
 			currAllCabOrders = a
 			optimize = true
 
+		// Receive new confirmedOrders from destinationConsensus
+		case a := <-ConfirmedDestinationOrdersChan:
+			if a == currDestinationOrders {
+				break
+			}
+
+			currDestinationOrders = a
+			optimize = true
+
+		case sendCommittedHallOrders <- localHallOrders:
+			sendCommittedHallOrders = nil
+
+		case sendCommittedDestinationOrders <- localDestinationOrders:
+			sendCommittedDestinationOrders = nil
+
+		case sendReassignments <- reassignments:
+			sendReassignments = nil
+
+		case sendLocallyAssignedOrders <- locallyAssignedOrders:
+			sendLocallyAssignedOrders = nil
+
+		case sendDestinationAssignment <- boardingAssignment:
+			sendDestinationAssignment = nil
+
+		case <-heartbeat:
+
+		case <-ctx.Done():
+			return ctx.Err()
+
 		default:
 		}
 
@@ -207,14 +521,119 @@ func OptimalAssigner(
 			// Encode information as JSON, pass it to the optimizer script,
 			// and finally extract the optimal orders for the current node
 
-			currOptimizationInputJSON = encodeJSON(currHallOrders,
-				currAllCabOrders, currAllNodeStates, peerlist)
-			outJSON := runOptimizer(currOptimizationInputJSON)
-			json.Unmarshal(outJSON, &optimalAssignedOrders)
+			// Only assign cab orders when restricted to cab orders in a
+			// minority partition, the majority partition owns all hall and destination orders.
+			hallOrdersToAssign := currHallOrders
+			destinationOrdersToAssign := currDestinationOrders
+			if !inMajority && minorityPolicy == datatypes.ServeCabOnly {
+				hallOrdersToAssign = datatypes.ConfirmedHallOrdersMatrix{}
+				destinationOrdersToAssign = datatypes.ConfirmedDestinationOrdersMatrix{}
+			}
+
+			// Demote the peers suspected by all the other nodes by leaving them out of the optimization
+			// (Their hall orders will be taken over by healthy peers before
+			// the suspect peers are declared lost. All nodes demote the same peers,
+			// as they agree on the broadcast node states).
+			// Nodes unavailable due to their behaviour, mode, load or faults are left out as well.
+			cabOnly := cabOnlyPeers(currAllNodeStates, config.Load.FullThreshold)
+			assignablePeers := excludeIDs(excludeIDs(excludeIDs(peerlist, agreedSuspects(peerlist, currAllNodeStates)),
+				unavailablePeers(currAllNodeStates)), cabOnly)
+
+			currOptimizationInputJSON = encodeJSON(hallOrdersToAssign,
+				currAllCabOrders, currAllNodeStates, assignablePeers)
+			var optimalAssignedOrders map[string]datatypes.AssignedOrdersMatrix
+			err := fmt.Errorf("hall request assigner not available")
+
+			if assignerPath != "" {
+				var outJSON []byte
+				outJSON, err = runOptimizer(ctx, assignerPath, config, currOptimizationInputJSON)
+				if err == nil {
+					err = json.Unmarshal(outJSON, &optimalAssignedOrders)
+				}
+			}
+
+			// Fall back to the built-in heuristic if the optimizer failed
+			if err != nil {
+				if assignerPath != "" {
+					fmt.Println("(optimalassigner)", err, "- using fallback heuristic")
+				}
+				optimalAssignedOrders = fallbackAssignment(hallOrdersToAssign,
+					currAllCabOrders, currAllNodeStates, assignablePeers)
+			}
+
+			// Keep hall orders with the nodes already committed to them
+			optimalAssignedOrders = stabilizeAssignment(optimalAssignedOrders,
+				currAllNodeStates, assignablePeers, config)
+
+			prevReassignments := reassignments
+			updateReassignments(&reassignments, &prevHallOwners, hallOwners(optimalAssignedOrders),
+				hallOrdersToAssign)
+			if reassignments != prevReassignments {
+				sendReassignments = ReassignmentsChan
+			}
+
+			// Broadcast the hall orders the local node is now committed to
+			// (Not including the stops for destination orders, which are committed to separately)
+			committedHall := committedHallOrders(optimalAssignedOrders[string(localID)])
+			if committedHall != localHallOrders {
+				localHallOrders = committedHall
+				sendCommittedHallOrders = CommittedHallOrdersChan
+			}
+
+			// Assign the destination orders, grouping the passengers by their destinations.
+			// (The hall request assigner has no notion of destinations, so they are assigned
+			// on top of its assignment)
+			optimalAssignedOrders, destinationAssignment := assignDestinationOrders(optimalAssignedOrders,
+				destinationOrdersToAssign, currAllNodeStates, assignablePeers)
+			committedDestination := committedDestinationOrders(destinationAssignment, localID)
+			if committedDestination != localDestinationOrders {
+				localDestinationOrders = committedDestination
+				sendCommittedDestinationOrders = CommittedDestinationOrdersChan
+			}
+
+			// Nodes restricted by their mode only serve their own cab orders
+			if optimalAssignedOrders == nil {
+				optimalAssignedOrders = make(map[string]datatypes.AssignedOrdersMatrix)
+			}
+			for _, currID := range cabOnly {
+				if consensus.ContainsID(peerlist, currID) {
+					optimalAssignedOrders[string(currID)] = cabOrdersAssignment(currAllCabOrders[currID])
+				}
+			}
+
+			// Tell the destination consensus which car to board for each destination order
+			boardingAssignment = destinationAssignment
+			sendDestinationAssignment = DestinationAssignmentChan
+
+			// Follow the traffic mode of the group
+			currGroupMode := groupTrafficMode(peerlist, currAllNodeStates, localMode)
+			if currGroupMode != groupMode {
+				groupMode = currGroupMode
+				fmt.Println("(optimalassigner) Traffic mode:", trafficModeName(groupMode))
+			}
+
+			// Tell the FSM where to park if the local node is idle
+			currParkingTarget := parkingTarget(localID,
+				idleNodes(optimalAssignedOrders, currAllNodeStates, assignablePeers),
+				hallOrderHistory, config.Parking, groupMode)
+			if currParkingTarget != prevParkingTarget {
+				prevParkingTarget = currParkingTarget
+				ParkingTargetChan <- currParkingTarget
+			}
+
 			currLocallyAssignedOrders := optimalAssignedOrders[string(localID)]
 
+			// Estimate when the local node arrives at its hall orders
+			// (A node without a state has no estimates)
+			var currETAs datatypes.HallETAsMatrix
+			if localState, hasState := currAllNodeStates[localID]; hasState {
+				currETAs = hallETAs(localID, localState, currLocallyAssignedOrders, time.Now(), config)
+			}
+			ETAsChan <- currETAs
+
 			// Update the FSM with the new assigned orders
-			LocallyAssignedOrdersChan <- currLocallyAssignedOrders
+			locallyAssignedOrders = currLocallyAssignedOrders
+			sendLocallyAssignedOrders = LocallyAssignedOrdersChan
 		}
 	}
 }
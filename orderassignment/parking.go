@@ -0,0 +1,166 @@
+package orderassignment
+
+import (
+	"../config"
+	"../consensus"
+	"../datatypes"
+	"../elevio"
+	"sort"
+	"time"
+)
+
+// hallOrderEvent ...
+// A hall order confirmed at the given floor and time, used by the ParkBusiest policy
+// and the traffic mode detection
+type hallOrderEvent struct {
+	Floor  int
+	Button elevio.ButtonType
+	Time   time.Time
+}
+
+// recordHallOrders ...
+// @return: The hall order history extended with all the hall orders that are confirmed
+// in currHallOrders but not in prevHallOrders, and without the orders older than maxAge.
+func recordHallOrders(
+	history []hallOrderEvent,
+	prevHallOrders datatypes.ConfirmedHallOrdersMatrix,
+	currHallOrders datatypes.ConfirmedHallOrdersMatrix,
+	maxAge time.Duration) []hallOrderEvent {
+
+	now := time.Now()
+
+	for floor := range currHallOrders {
+		for orderType := range currHallOrders[floor] {
+			if currHallOrders[floor][orderType] && !prevHallOrders[floor][orderType] {
+				history = append(history, hallOrderEvent{
+					Floor:  floor,
+					Button: elevio.ButtonType(orderType),
+					Time:   now,
+				})
+			}
+		}
+	}
+
+	// (The history is sorted by time)
+	for len(history) > 0 && now.Sub(history[0].Time) > maxAge {
+		history = history[1:]
+	}
+
+	return history
+}
+
+// idleNodes ...
+// @return: Sorted list of the nodes without any assigned orders that are able to park
+func idleNodes(
+	assignedOrders map[string]datatypes.AssignedOrdersMatrix,
+	currAllNodeStates datatypes.AllNodeStatesMap,
+	peerlist []datatypes.NodeID) []datatypes.NodeID {
+
+	idle := []datatypes.NodeID{}
+
+	for _, currID := range peerlist {
+		currState, hasState := currAllNodeStates[currID]
+		if !hasState || currState.Behaviour == datatypes.InitState {
+			continue
+		}
+
+		hasOrders := false
+		for _, floorOrders := range assignedOrders[string(currID)] {
+			hasOrders = hasOrders || floorOrders[elevio.BT_HallUp] ||
+				floorOrders[elevio.BT_HallDown] || floorOrders[elevio.BT_Cab]
+		}
+
+		if !hasOrders {
+			idle = append(idle, currID)
+		}
+	}
+
+	sort.Slice(idle, func(i, j int) bool { return idle[i] < idle[j] })
+	return idle
+}
+
+// busiestFloors ...
+// @return: All floors sorted by the number of hall orders in the history, busiest first
+// (Ties are broken by the lowest floor)
+func busiestFloors(history []hallOrderEvent) []int {
+	var counts [elevio.NumFloors]int
+	for _, event := range history {
+		counts[event.Floor]++
+	}
+
+	floors := make([]int, elevio.NumFloors)
+	for floor := range floors {
+		floors[floor] = floor
+	}
+	sort.SliceStable(floors, func(i, j int) bool { return counts[floors[i]] > counts[floors[j]] })
+
+	return floors
+}
+
+// parkingTarget ...
+// @return: Where the local node should park if it is idle (see parkingFloor).
+// During peak traffic, idle nodes are parked immediately at the lobby (up-peak)
+// or at the top floor (down-peak), regardless of the parking policy.
+func parkingTarget(
+	localID datatypes.NodeID,
+	idle []datatypes.NodeID,
+	history []hallOrderEvent,
+	parking config.Parking,
+	trafficMode datatypes.TrafficMode) datatypes.ParkingTarget {
+
+	if !consensus.ContainsID(idle, localID) {
+		return datatypes.ParkingTarget{Floor: -1, Delay: parking.Delay.Duration}
+	}
+
+	switch trafficMode {
+	case datatypes.UpPeakTraffic:
+		return datatypes.ParkingTarget{Floor: parking.LobbyFloor, Delay: 0}
+	case datatypes.DownPeakTraffic:
+		return datatypes.ParkingTarget{Floor: elevio.NumFloors - 1, Delay: 0}
+	}
+
+	return datatypes.ParkingTarget{
+		Floor: parkingFloor(localID, idle, history, parking),
+		Delay: parking.Delay.Duration,
+	}
+}
+
+// parkingFloor ...
+// @return: The floor the local node should park at if it is idle, or -1 if it should
+// stay where it is.
+// The idle nodes are sorted by ID, giving each node its own zone or busy floor.
+func parkingFloor(
+	localID datatypes.NodeID,
+	idle []datatypes.NodeID,
+	history []hallOrderEvent,
+	parking config.Parking) int {
+
+	index := -1
+	for i, currID := range idle {
+		if currID == localID {
+			index = i
+		}
+	}
+	if index == -1 {
+		return -1
+	}
+
+	switch parking.Policy {
+
+	case config.ParkLobby:
+		return parking.LobbyFloor
+
+	// Split the floors into one zone per idle node, and park in the middle of the zone
+	case config.ParkZones:
+		return (2*index + 1) * elevio.NumFloors / (2 * len(idle))
+
+	// Park at the busiest floors, the busiest floor getting the first idle node
+	case config.ParkBusiest:
+		if len(history) == 0 {
+			return -1
+		}
+		return busiestFloors(history)[index%elevio.NumFloors]
+	}
+
+	return -1
+}
@@ -0,0 +1,187 @@
+package orderassignment
+
+import (
+	"../consensus"
+	"../datatypes"
+	"../elevio"
+	"fmt"
+)
+
+// hallOwnersMatrix ...
+// Holds the node currently assigned to each hall order ("" if unassigned)
+type hallOwnersMatrix [elevio.NumFloors][2]datatypes.NodeID
+
+// hallOwners ...
+// @return: The owner of every hall order in the given assignment
+func hallOwners(assignedOrders map[string]datatypes.AssignedOrdersMatrix) hallOwnersMatrix {
+	var owners hallOwnersMatrix
+
+	for currID, currAssignedOrders := range assignedOrders {
+		for floor := range owners {
+			for orderType := range owners[floor] {
+				if currAssignedOrders[floor][orderType] {
+					owners[floor][orderType] = datatypes.NodeID(currID)
+				}
+			}
+		}
+	}
+
+	return owners
+}
+
+// committedOwners ...
+// @return: The node committed to every hall order, as broadcast in the node states.
+// (While an order is being moved, both nodes may claim it for a moment, and the
+// lowest ID is used, so that all nodes agree)
+func committedOwners(currAllNodeStates datatypes.AllNodeStatesMap) hallOwnersMatrix {
+	var owners hallOwnersMatrix
+
+	for currID, currState := range currAllNodeStates {
+		for floor := range owners {
+			for orderType := range owners[floor] {
+				if !currState.HallOrders[floor][orderType] {
+					continue
+				}
+				if owners[floor][orderType] == "" || currID < owners[floor][orderType] {
+					owners[floor][orderType] = currID
+				}
+			}
+		}
+	}
+
+	return owners
+}
+
+// committedHallOrders ...
+// @return: The hall orders in the assignment of a single node
+func committedHallOrders(assignedOrders datatypes.AssignedOrdersMatrix) datatypes.ConfirmedHallOrdersMatrix {
+	var hallOrders datatypes.ConfirmedHallOrdersMatrix
+
+	for floor := range hallOrders {
+		for orderType := range hallOrders[floor] {
+			hallOrders[floor][orderType] = assignedOrders[floor][orderType]
+		}
+	}
+
+	return hallOrders
+}
+
+// isFrozen ...
+// @return: true if the node is about to serve the hall order, that is within freezeDistance
+// floors of it while moving towards it, or standing at its floor.
+// (A moving node at distance 0 has the order as its next floor, and is decelerating)
+func isFrozen(nodeState datatypes.NodeState, floor int, freezeDistance int) bool {
+	if freezeDistance < 0 {
+		return false
+	}
+
+	switch nodeState.Behaviour {
+
+	case datatypes.IdleState, datatypes.DoorOpenState:
+		return nodeState.Floor == floor
+
+	case datatypes.MovingState:
+		if nodeState.Dir == datatypes.Up && floor > nodeState.Floor {
+			return floor-nodeState.Floor-1 <= freezeDistance
+		}
+		if nodeState.Dir == datatypes.Down && floor < nodeState.Floor {
+			return nodeState.Floor-floor-1 <= freezeDistance
+		}
+	}
+
+	return false
+}
+
+// stabilizeAssignment ...
+// Avoids hall orders bouncing between nodes as the node states flicker.
+// A hall order already committed to a node (see committedOwners) is kept by that node
+// if it is frozen (see isFrozen), or if moving it wouldn't save more than the switching cost.
+// (The committed hall orders are part of the node states, so all nodes that have seen
+// the same node states arrive at the same stabilized assignment)
+// @return: The stabilized assignment
+func stabilizeAssignment(
+	assignedOrders map[string]datatypes.AssignedOrdersMatrix,
+	currAllNodeStates datatypes.AllNodeStatesMap,
+	peerlist []datatypes.NodeID,
+	config Config) map[string]datatypes.AssignedOrdersMatrix {
+
+	prevOwners := committedOwners(currAllNodeStates)
+	newOwners := hallOwners(assignedOrders)
+
+	for floor := range newOwners {
+		for orderType := range newOwners[floor] {
+			prevID := prevOwners[floor][orderType]
+			newID := newOwners[floor][orderType]
+
+			if prevID == "" || newID == "" || prevID == newID {
+				continue
+			}
+
+			// The previous owner can only keep the order if it is still available
+			prevState, prevHasState := currAllNodeStates[prevID]
+			newState := currAllNodeStates[newID]
+			if !prevHasState || !consensus.ContainsID(peerlist, prevID) {
+				continue
+			}
+
+			keep := isFrozen(prevState, floor, config.FreezeDistance)
+			if config.SwitchingCost > 0 {
+				keep = keep || fallbackCost(prevState, floor) <= fallbackCost(newState, floor)+config.SwitchingCost
+			}
+
+			if !keep {
+				continue
+			}
+
+			// Move the order back to the previous owner
+			newAssignedOrders := assignedOrders[string(newID)]
+			newAssignedOrders[floor][orderType] = false
+			assignedOrders[string(newID)] = newAssignedOrders
+
+			prevAssignedOrders := assignedOrders[string(prevID)]
+			prevAssignedOrders[floor][orderType] = true
+			assignedOrders[string(prevID)] = prevAssignedOrders
+		}
+	}
+
+	return assignedOrders
+}
+
+// updateReassignments ...
+// Counts the reassignments of every confirmed hall order, and logs the count
+// when the order is no longer confirmed.
+// An order is only counted as reassigned when it is assigned to another node than the one
+// it was last assigned to by the local node. (Not against the committed owners in the node
+// states, which lag behind, and would count the same move on every reoptimization)
+func updateReassignments(
+	reassignments *datatypes.ReassignmentsMatrix,
+	prevOwners *hallOwnersMatrix,
+	newOwners hallOwnersMatrix,
+	currHallOrders datatypes.ConfirmedHallOrdersMatrix) {
+
+	for floor := range reassignments {
+		for orderType := range reassignments[floor] {
+
+			if !currHallOrders[floor][orderType] {
+				if (*reassignments)[floor][orderType] > 0 {
+					fmt.Printf("(optimalassigner) Hall order at floor %d (type %d) was reassigned %d times\n",
+						floor, orderType, (*reassignments)[floor][orderType])
+				}
+				(*reassignments)[floor][orderType] = 0
+				(*prevOwners)[floor][orderType] = ""
+				continue
+			}
+
+			// (An order left unassigned for a moment keeps its previous owner)
+			prevID := (*prevOwners)[floor][orderType]
+			newID := newOwners[floor][orderType]
+			if newID == "" {
+				continue
+			}
+			if prevID != "" && newID != prevID {
+				(*reassignments)[floor][orderType]++
+			}
+			(*prevOwners)[floor][orderType] = newID
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package orderassignment
+
+import (
+	"../config"
+	"../datatypes"
+	"../elevio"
+	"sort"
+	"time"
+)
+
+// Traffic modes by their name in the config file
+var trafficModes = map[string]datatypes.TrafficMode{
+	config.TrafficNormal:   datatypes.NormalTraffic,
+	config.TrafficUpPeak:   datatypes.UpPeakTraffic,
+	config.TrafficDownPeak: datatypes.DownPeakTraffic,
+}
+
+// trafficModeName ...
+// @return: The name of the traffic mode in the config file
+func trafficModeName(mode datatypes.TrafficMode) string {
+	for name, currMode := range trafficModes {
+		if currMode == mode {
+			return name
+		}
+	}
+	return config.TrafficNormal
+}
+
+// minuteOfDay ...
+// @return: Number of minutes since midnight
+func minuteOfDay(t time.Time) int {
+	return t.Hour()*60 + t.Minute()
+}
+
+// scheduledTrafficMode ...
+// @return: The traffic mode of the first period in the schedule containing now, and
+// whether there was such a period
+func scheduledTrafficMode(now time.Time, schedule []config.TrafficPeriod) (datatypes.TrafficMode, bool) {
+	currMinute := minuteOfDay(now)
+
+	for _, period := range schedule {
+		// (The periods are validated when the config file is loaded)
+		start, _ := time.Parse(config.TimeOfDayLayout, period.Start)
+		end, _ := time.Parse(config.TimeOfDayLayout, period.End)
+		startMinute, endMinute := minuteOfDay(start), minuteOfDay(end)
+
+		inPeriod := startMinute <= currMinute && currMinute < endMinute
+		if endMinute < startMinute {
+			// The period lasts over midnight
+			inPeriod = currMinute >= startMinute || currMinute < endMinute
+		}
+
+		if inPeriod {
+			return trafficModes[period.Mode], true
+		}
+	}
+
+	return datatypes.NormalTraffic, false
+}
+
+// detectTrafficMode ...
+// @return: UpPeakTraffic if most of the recent hall orders are up from the lobby,
+// DownPeakTraffic if most of them are down from the other floors, and NormalTraffic otherwise
+func detectTrafficMode(
+	now time.Time,
+	history []hallOrderEvent,
+	traffic config.Traffic,
+	lobbyFloor int) datatypes.TrafficMode {
+
+	numOrders, numUpFromLobby, numDown := 0, 0, 0
+
+	for _, event := range history {
+		if now.Sub(event.Time) > traffic.Window.Duration {
+			continue
+		}
+
+		numOrders++
+		if event.Floor == lobbyFloor && event.Button == elevio.BT_HallUp {
+			numUpFromLobby++
+		}
+		if event.Floor != lobbyFloor && event.Button == elevio.BT_HallDown {
+			numDown++
+		}
+	}
+
+	if numOrders < traffic.MinOrders {
+		return datatypes.NormalTraffic
+	}
+	if float64(numUpFromLobby) >= traffic.PeakShare*float64(numOrders) {
+		return datatypes.UpPeakTraffic
+	}
+	if float64(numDown) >= traffic.PeakShare*float64(numOrders) {
+		return datatypes.DownPeakTraffic
+	}
+	return datatypes.NormalTraffic
+}
+
+// localTrafficMode ...
+// @return: The traffic mode of the local node. Scheduled periods take precedence over
+// the detection, which is only used if enabled.
+func localTrafficMode(
+	now time.Time,
+	history []hallOrderEvent,
+	traffic config.Traffic,
+	lobbyFloor int) datatypes.TrafficMode {
+
+	if mode, scheduled := scheduledTrafficMode(now, traffic.Schedule); scheduled {
+		return mode
+	}
+	if traffic.Detect {
+		return detectTrafficMode(now, history, traffic, lobbyFloor)
+	}
+	return datatypes.NormalTraffic
+}
+
+// groupTrafficMode ...
+// The clocks and hall order histories of the nodes may differ slightly, so the group
+// follows the traffic mode broadcast by the node with the lowest ID.
+// @return: The traffic mode of the lowest peer with a known state, or localMode
+// if there is none
+func groupTrafficMode(
+	peerlist []datatypes.NodeID,
+	currAllNodeStates datatypes.AllNodeStatesMap,
+	localMode datatypes.TrafficMode) datatypes.TrafficMode {
+
+	sortedPeers := append([]datatypes.NodeID{}, peerlist...)
+	sort.Slice(sortedPeers, func(i, j int) bool { return sortedPeers[i] < sortedPeers[j] })
+
+	for _, currID := range sortedPeers {
+		if currState, hasState := currAllNodeStates[currID]; hasState {
+			return currState.Traffic
+		}
+	}
+	return localMode
+}
@@ -0,0 +1,238 @@
+package supervisor
+
+import (
+	"../config"
+	"../datatypes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Module ...
+// A module of the node, run by the supervisor until ctx is cancelled.
+// The loop of the module must read heartbeat, so that the supervisor can tell that it isn't stalled.
+// @return: The error the module failed with, ctx.Err() if it was stopped
+type Module func(ctx context.Context, heartbeat <-chan struct{}) error
+
+// Interval between the health reports sent to the API, also sent on every change
+const reportInterval = 1 * time.Second
+
+// Supervisor ...
+// Runs the modules of a single node, restarting those that fail, and keeping track of their health.
+type Supervisor struct {
+	mtx          sync.Mutex
+	localID      datatypes.NodeID
+	stallTimeout time.Duration
+	restartDelay time.Duration
+	health       datatypes.ModuleHealthMap
+	changed      chan struct{}
+	running      sync.WaitGroup
+}
+
+// New ...
+// Creates the supervisor of a node, reporting the health of its modules on HealthChan until ctx is cancelled
+// @return: The supervisor
+func New(
+	ctx context.Context,
+	localID datatypes.NodeID,
+	supervisionConfig config.Supervision,
+	HealthChan chan<- datatypes.ModuleHealthMap) *Supervisor {
+
+	sv := &Supervisor{
+		localID:      localID,
+		stallTimeout: supervisionConfig.StallTimeout.Duration,
+		restartDelay: supervisionConfig.RestartDelay.Duration,
+		health:       make(datatypes.ModuleHealthMap),
+		changed:      make(chan struct{}, 1),
+	}
+	go sv.report(ctx, HealthChan)
+	return sv
+}
+
+// Start ...
+// Runs module in its own goroutine until ctx is cancelled.
+// A module that returns an error or panics is restarted after the restart delay.
+func (sv *Supervisor) Start(ctx context.Context, name string, module Module) {
+	sv.setStatus(name, datatypes.ModuleRunning)
+	sv.running.Add(1)
+	go func() {
+		defer sv.running.Done()
+		for {
+			err := sv.run(ctx, name, module)
+			if ctx.Err() != nil {
+				sv.setStatus(name, datatypes.ModuleStopped)
+				return
+			}
+			if err == nil {
+				err = fmt.Errorf("returned unexpectedly")
+			}
+			fmt.Println("(supervisor) Module", name, "of", sv.localID, "failed:", err,
+				"- restarting in", sv.restartDelay)
+			sv.fail(name, err)
+
+			select {
+			case <-time.After(sv.restartDelay):
+				sv.setStatus(name, datatypes.ModuleRunning)
+			case <-ctx.Done():
+				sv.setStatus(name, datatypes.ModuleStopped)
+				return
+			}
+		}
+	}()
+}
+
+// Wait ...
+// Waits for all the modules to return after ctx has been cancelled
+// @return: The names of the modules still running after timeout
+func (sv *Supervisor) Wait(timeout time.Duration) []string {
+	done := make(chan struct{})
+	go func() {
+		sv.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+	}
+
+	sv.mtx.Lock()
+	defer sv.mtx.Unlock()
+	var names []string
+	for name, health := range sv.health {
+		if health.Status != datatypes.ModuleStopped {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// run ...
+// Runs a single instance of module, probing its loop with heartbeats while it runs
+// @return: The error the module returned, or the panic it raised as an error
+func (sv *Supervisor) run(ctx context.Context, name string, module Module) (err error) {
+	moduleCtx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	heartbeat := make(chan struct{})
+	go sv.probe(moduleCtx, name, heartbeat)
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return module(moduleCtx, heartbeat)
+}
+
+// probe ...
+// Sends heartbeats to the loop of a module until ctx is cancelled.
+// A heartbeat not read within the stall timeout flags the module as stalled, until it is read.
+func (sv *Supervisor) probe(ctx context.Context, name string, heartbeat chan<- struct{}) {
+	ticker := time.NewTicker(sv.stallTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		stallTimer := time.NewTimer(sv.stallTimeout)
+		select {
+		case heartbeat <- struct{}{}:
+			stallTimer.Stop()
+			continue
+		case <-stallTimer.C:
+		case <-ctx.Done():
+			stallTimer.Stop()
+			return
+		}
+
+		fmt.Println("(supervisor) Module", name, "of", sv.localID, "stalled, no heartbeat within",
+			sv.stallTimeout)
+		sv.setStatus(name, datatypes.ModuleStalled)
+
+		select {
+		case heartbeat <- struct{}{}:
+			fmt.Println("(supervisor) Module", name, "of", sv.localID, "recovered")
+			sv.setStatus(name, datatypes.ModuleRunning)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// setStatus ...
+// Records that the module entered status, unless it already has it
+func (sv *Supervisor) setStatus(name string, status datatypes.ModuleStatus) {
+	sv.mtx.Lock()
+	defer sv.mtx.Unlock()
+
+	health := sv.health[name]
+	if health.Status == status && !health.Since.IsZero() {
+		return
+	}
+	health.Status = status
+	health.Since = time.Now()
+	sv.health[name] = health
+	sv.notify()
+}
+
+// fail ...
+// Records that the module failed with err, and is waiting to be restarted
+func (sv *Supervisor) fail(name string, err error) {
+	sv.mtx.Lock()
+	defer sv.mtx.Unlock()
+
+	health := sv.health[name]
+	health.Status = datatypes.ModuleRestarting
+	health.Since = time.Now()
+	health.Restarts++
+	health.LastError = err.Error()
+	sv.health[name] = health
+	sv.notify()
+}
+
+// notify ...
+// Wakes up the reporter after a change of the health (mtx must be held)
+func (sv *Supervisor) notify() {
+	select {
+	case sv.changed <- struct{}{}:
+	default:
+	}
+}
+
+// report ...
+// Sends a copy of the health of the modules on HealthChan on every change,
+// and at least every reportInterval. (Reports are dropped if the receiver is busy)
+func (sv *Supervisor) report(ctx context.Context, HealthChan chan<- datatypes.ModuleHealthMap) {
+	ticker := time.NewTicker(reportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-sv.changed:
+		case <-ctx.Done():
+			return
+		}
+
+		sv.mtx.Lock()
+		health := make(datatypes.ModuleHealthMap, len(sv.health))
+		for name, moduleHealth := range sv.health {
+			health[name] = moduleHealth
+		}
+		sv.mtx.Unlock()
+
+		select {
+		case HealthChan <- health:
+		default:
+		}
+	}
+}